@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The instance queried by the client subcommand unless -server or IP_POTATO_SERVER says
+// otherwise.
+const defaultClientServer = "https://ip-potato.com"
+
+// Queries a running instance for the address of this host, or another of its endpoints, and
+// prints the answer, so the same binary serves scripts checking their public address.
+// Returns the exit code of the process.
+func runClient(args []string) int {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	server := fs.String("server", envOr("IP_POTATO_SERVER", defaultClientServer), "URL of the instance to query (overrides $IP_POTATO_SERVER)")
+	format := fs.String("format", "text", "Output format: text or json")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout of each attempt")
+	retries := fs.Int("retries", 2, "How often a failed request is retried, with exponential backoff")
+	watch := fs.Duration("watch", 0, "Keep checking the public address at this interval and print it whenever it changes (disabled if zero)")
+	webhookURL := fs.String("webhook", "", "URL notified with a JSON POST whenever the address changes in -watch mode")
+	webhookSecret := fs.String("webhook-secret", os.Getenv("IP_POTATO_WEBHOOK_SECRET"), "Key the webhook payload is signed with using HMAC-SHA256 (overrides $IP_POTATO_WEBHOOK_SECRET)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s client [flags] [endpoint]\n\nPrints the public address of this host as seen by an ip-potato instance, or the answer of\nanother endpoint such as hostname, asn or bgp.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() > 1 || (*watch > 0 && fs.NArg() > 0) {
+		fs.Usage()
+		return 2
+	}
+	if *webhookURL != "" && *watch <= 0 {
+		fmt.Fprintln(os.Stderr, "-webhook requires -watch")
+		return 2
+	}
+
+	var accept string
+	switch *format {
+	case "text":
+		accept = "text/plain"
+	case "json":
+		accept = "application/json"
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q, expected text or json\n", *format)
+		return 2
+	}
+	target, err := url.JoinPath(*server, fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid server URL: %v\n", err)
+		return 2
+	}
+
+	c := &client{
+		http:    &http.Client{Timeout: *timeout},
+		retries: max(*retries, 0),
+		backoff: 500 * time.Millisecond,
+		maxWait: 30 * time.Second,
+	}
+	if *watch > 0 {
+		w := &watcher{client: c, server: target, json: *format == "json", out: os.Stdout}
+		if *webhookURL != "" {
+			w.webhook = &webhook{url: *webhookURL, secret: []byte(*webhookSecret), http: c.http, retries: 5, backoff: time.Second}
+		}
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Kill, os.Interrupt)
+		defer cancel()
+		w.run(ctx, *watch)
+		return 0
+	}
+	body, err := c.get(target, accept)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(body)
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		fmt.Println()
+	}
+	return 0
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+type client struct {
+	http    *http.Client
+	retries int
+	// Delay before the first retry, doubled for every following one.
+	backoff time.Duration
+	// Gives up rather than waiting longer than this for a server asking to retry later.
+	maxWait time.Duration
+}
+
+// Responses with these statuses are worth retrying, anything else won't change.
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// Fetches the URL, retrying network errors and retryable statuses. A Retry-After sent by the
+// server is honoured if it is longer than the backoff, unless it is longer than maxWait.
+func (c *client) get(target, accept string) ([]byte, error) {
+	delay := c.backoff
+	for attempt := 1; ; attempt++ {
+		body, wait, err := c.getOnce(target, accept)
+		if err == nil {
+			return body, nil
+		}
+		if wait < 0 || wait > c.maxWait || attempt > c.retries {
+			if attempt > 1 {
+				return nil, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+			}
+			return nil, err
+		}
+		time.Sleep(max(delay, wait))
+		delay *= 2
+	}
+}
+
+// Returns how long the server asked to wait before retrying, or a negative duration if the
+// request failed in a way retrying won't fix.
+func (c *client) getOnce(target, accept string) ([]byte, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", "ip-potato-client/"+readBuildInfo().Version)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("%s: %s: %s", target, resp.Status, strings.TrimSpace(string(body)))
+		if !retryableStatus(resp.StatusCode) {
+			return nil, -1, err
+		}
+		wait, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return nil, time.Duration(wait) * time.Second, err
+	}
+	return body, 0, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientGet(t *testing.T) {
+	tests := []struct {
+		name       string
+		responses  []int
+		retryAfter string
+		maxWait    time.Duration
+		attempts   int
+		wantErr    string
+		minElapsed time.Duration
+	}{
+		{name: "success", responses: []int{200}, attempts: 1},
+		{name: "retries server errors", responses: []int{502, 503, 200}, attempts: 3},
+		{name: "gives up after the retries", responses: []int{500, 500, 500}, attempts: 3, wantErr: "giving up after 3 attempts"},
+		{name: "doesn't retry client errors", responses: []int{404, 200}, attempts: 1, wantErr: "404 Not Found: nope"},
+		{name: "honours Retry-After", responses: []int{429, 200}, retryAfter: "1", maxWait: time.Minute, attempts: 2, minElapsed: time.Second},
+		{name: "doesn't wait longer than maxWait", responses: []int{429, 200}, retryAfter: "120", maxWait: time.Minute, attempts: 1, wantErr: "429 Too Many Requests"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Accept"); got != "text/plain" {
+					t.Errorf("Accept is %q", got)
+				}
+				status := tt.responses[attempts]
+				attempts++
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(status)
+				if status == http.StatusOK {
+					io.WriteString(w, "192.0.2.1\n")
+				} else {
+					io.WriteString(w, "nope\n")
+				}
+			}))
+			defer server.Close()
+
+			c := &client{http: server.Client(), retries: 2, backoff: time.Millisecond, maxWait: tt.maxWait}
+			start := time.Now()
+			body, err := c.get(server.URL, "text/plain")
+			if attempts != tt.attempts {
+				t.Errorf("made %d attempts, want %d", attempts, tt.attempts)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minElapsed {
+				t.Errorf("retried after %v, want at least %v", elapsed, tt.minElapsed)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != "192.0.2.1\n" {
+				t.Errorf("unexpected body %q", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jault3/ip-potato/ippotato"
+)
+
+// Settings of the server, populated from command line flags. Subcommands such as doctor
+// register the same flags so they can check the configuration the server would run with.
+type config struct {
+	listenAddr          string
+	bgpAPI              string
+	bgpAttribution      string
+	bgpTimeout          time.Duration
+	bgpCacheTTL         time.Duration
+	asnDBPath           string
+	rdnsEnabled         bool
+	rdnsTimeout         time.Duration
+	rdnsCacheTTL        time.Duration
+	rdnsNegativeTTL     time.Duration
+	proxyProtocol       bool
+	trustedProxies      string
+	adminListenAddr     string
+	debugListenAddr     string
+	pushGateway         string
+	pushInterval        time.Duration
+	pushJob             string
+	pushInstance        string
+	parseUserAgent      bool
+	readyFile           string
+	readyFD             int
+	echoRedact          string
+	echoMaxValueBytes   int
+	echoMaxHeaders      int
+	echoMaxBodyBytes    int64
+	tlsCert             string
+	tlsKey              string
+	clientAuth          string
+	clientCA            string
+	textEOL             string
+	textBOM             bool
+	textTrailingNewline bool
+	microCacheTTL       time.Duration
+	dnsListenAddr       string
+	dnsZone             string
+	dnsTTL              time.Duration
+	dnsRate             float64
+	dnsBurst            int
+
+	datasetRequireChecksum bool
+	datasetPublicKey       string
+	resolver               string
+	resolverCacheTTL       time.Duration
+	stunListenAddr         string
+	stunRate               float64
+	stunBurst              int
+	apiRate                float64
+	apiBurst               int
+	tcpListenAddr          string
+	udpListenAddr          string
+	udpRate                float64
+	udpBurst               int
+	accessLog              bool
+	historyDB              string
+	historyRetention       time.Duration
+	historyMaxIPs          int
+	apiKeys                string
+	apiKeysFile            string
+	usersFile              string
+	apiKeyDailyQuota       int
+	apiKeyRate             float64
+	apiKeyBurst            int
+	dnsblZones             string
+	dnsblTimeout           time.Duration
+	dnsblCacheTTL          time.Duration
+	rdapURL                string
+	rdapTimeout            time.Duration
+	rdapCacheTTL           time.Duration
+	portCheckPorts         string
+	portCheckTimeout       time.Duration
+	portCheckRate          float64
+	portCheckBurst         int
+	speedMaxBytes          int64
+	speedRate              float64
+	speedBurst             int
+	signingKey             string
+	uniqueClientStats      bool
+	ipv4URL                string
+	ipv6URL                string
+	templatesDir           string
+	staticDir              string
+}
+
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.listenAddr, "listen", "localhost:8080", "Listen address for the http server")
+	fs.StringVar(&c.bgpAPI, "bgp-api", "", "Base URL of a RIPEstat compatible looking glass API used for /bgp lookups, e.g. https://stat.ripe.net (disabled if empty)")
+	fs.StringVar(&c.bgpAttribution, "bgp-attribution", "data via RIPEstat", "Attribution included with routing information from the looking glass API")
+	fs.DurationVar(&c.bgpTimeout, "bgp-timeout", 3*time.Second, "Timeout for requests to the looking glass API")
+	fs.DurationVar(&c.bgpCacheTTL, "bgp-cache-ttl", 15*time.Minute, "How long routing information from the looking glass API is cached")
+	fs.StringVar(&c.asnDBPath, "asn-db", "", "Path to an ip2asn TSV database (optionally gzipped) used for AS lookups (disabled if empty)")
+	fs.BoolVar(&c.rdnsEnabled, "rdns", false, "Enable reverse DNS (PTR) lookups of client addresses for /hostname and /json, adding an outbound DNS query to requests whose hostname isn't cached")
+	fs.DurationVar(&c.rdnsTimeout, "rdns-timeout", 500*time.Millisecond, "Timeout for reverse DNS lookups")
+	fs.DurationVar(&c.rdnsCacheTTL, "rdns-cache-ttl", time.Hour, "How long hostnames from reverse DNS lookups are cached")
+	fs.DurationVar(&c.rdnsNegativeTTL, "rdns-negative-ttl", 5*time.Minute, "How long addresses without a PTR record are cached")
+	fs.BoolVar(&c.proxyProtocol, "proxy-protocol", false, "Expect a PROXY protocol v1 or v2 header on every connection to the http server")
+	fs.StringVar(&c.trustedProxies, "trusted-proxies", "", "Comma separated addresses and prefixes of proxies whose X-Real-IP and X-Forwarded-For headers name the client for rate limits, port checks, lookups such as /whois, the history and signed responses, e.g. 10.0.0.0/8")
+	fs.StringVar(&c.adminListenAddr, "admin-listen", "", "Listen address for the admin http server serving /metrics, e.g. localhost:9090 (disabled if empty)")
+	fs.StringVar(&c.pushGateway, "push-gateway", "", "URL of a Prometheus Pushgateway to periodically push metrics to (disabled if empty)")
+	fs.DurationVar(&c.pushInterval, "push-interval", 15*time.Second, "Interval between pushes to the Pushgateway")
+	fs.StringVar(&c.pushJob, "push-job", "ip-potato", "Job label used when pushing metrics")
+	fs.StringVar(&c.pushInstance, "push-instance", "", "Instance label used when pushing metrics (defaults to the hostname)")
+	fs.BoolVar(&c.parseUserAgent, "parse-user-agent", true, "Parse the User-Agent into browser, OS and device fields in the JSON form of /ua")
+	fs.StringVar(&c.readyFile, "ready-file", "", "Path of a file to write a JSON startup summary to once the server is ready (disabled if empty)")
+	fs.IntVar(&c.readyFD, "ready-fd", -1, "Inherited file descriptor to write a JSON startup summary to once the server is ready (disabled if negative)")
+	fs.StringVar(&c.echoRedact, "echo-redact-headers", "Authorization,Cookie", "Comma separated list of headers whose values are redacted by echo endpoints such as /headers")
+	fs.IntVar(&c.echoMaxValueBytes, "echo-max-value-bytes", 1024, "Header values longer than this are truncated by echo endpoints")
+	fs.IntVar(&c.echoMaxHeaders, "echo-max-headers", 64, "Maximum number of headers reflected by echo endpoints")
+	fs.Int64Var(&c.echoMaxBodyBytes, "echo-max-body-bytes", 64<<10, "Request bodies longer than this are truncated by /echo")
+	fs.StringVar(&c.tlsCert, "tls-cert", "", "Path to a PEM certificate to serve TLS with (plain http if empty)")
+	fs.StringVar(&c.tlsKey, "tls-key", "", "Path to the PEM private key of the TLS certificate")
+	fs.StringVar(&c.clientAuth, "client-auth", "none", "Client certificate mode for TLS: none, request, require, verify-if-given or require-and-verify")
+	fs.StringVar(&c.clientCA, "client-ca", "", "Path to a PEM bundle of CAs used to verify client certificates")
+	fs.StringVar(&c.textEOL, "text-eol", "lf", "Line ending of plain text responses, lf or crlf (overridable per request with ?eol=)")
+	fs.BoolVar(&c.textBOM, "text-bom", false, "Start plain text responses with a UTF-8 byte order mark (overridable per request with ?bom=)")
+	fs.BoolVar(&c.textTrailingNewline, "text-trailing-newline", true, "End plain text responses with a line ending (overridable per request with ?newline=)")
+	fs.DurationVar(&c.microCacheTTL, "micro-cache-ttl", 0, "How long the details looked up for an address are reused by following requests, e.g. 500ms (disabled if zero)")
+	fs.StringVar(&c.dnsListenAddr, "dns-listen", "", "Listen address (UDP and TCP) for an authoritative DNS server answering queries with the resolver's address, e.g. :53 (disabled if empty)")
+	fs.StringVar(&c.dnsZone, "dns-zone", "", "Zone answered by the DNS server, e.g. whoami.example.com; queries for other names are refused")
+	fs.DurationVar(&c.dnsTTL, "dns-ttl", 0, "TTL of answers from the DNS server")
+	fs.Float64Var(&c.dnsRate, "dns-rate", 20, "Queries per second the DNS server answers over UDP for each source address, so spoofed sources can't use it to flood others (unlimited if zero)")
+	fs.IntVar(&c.dnsBurst, "dns-burst", 100, "Queries the DNS server answers over UDP for each source address in a burst before -dns-rate applies")
+	fs.BoolVar(&c.datasetRequireChecksum, "dataset-require-checksum", false, "Refuse to load datasets such as -asn-db without a sha256sum style checksum file next to them (<path>.sha256)")
+	fs.StringVar(&c.datasetPublicKey, "dataset-public-key", "", "Base64 encoded Ed25519 public key; datasets must then be signed with a base64 encoded signature next to them (<path>.sig)")
+	fs.StringVar(&c.resolver, "resolver", "system", "Resolver used for all DNS lookups: system, a DNS over TLS upstream as tls://host[:port] or a DNS over HTTPS endpoint as https://host/path")
+	fs.DurationVar(&c.resolverCacheTTL, "resolver-cache-ttl", 0, "How long answers of the resolver are cached, including names which don't exist (disabled if zero)")
+	fs.StringVar(&c.stunListenAddr, "stun-listen", "", "UDP listen address for a STUN server answering Binding requests with the client's public address and port, e.g. :3478 (disabled if empty)")
+	fs.Float64Var(&c.stunRate, "stun-rate", 2, "Binding requests per second the STUN server answers for each source address, so spoofed sources can't use it to flood others (unlimited if zero)")
+	fs.IntVar(&c.stunBurst, "stun-burst", 10, "Binding requests the STUN server answers for each source address in a burst before -stun-rate applies")
+	fs.Float64Var(&c.apiRate, "api-rate", 0.5, "Requests per second each client may make to the browser API, /api/v1/ip and /both together (unlimited if zero)")
+	fs.IntVar(&c.apiBurst, "api-burst", 10, "Requests each client may make to the browser API in a burst before -api-rate applies")
+	fs.StringVar(&c.tcpListenAddr, "tcp-listen", "", "Listen address for a plain TCP server writing the client's address to every connection, e.g. :9000 (disabled if empty)")
+	fs.StringVar(&c.udpListenAddr, "udp-listen", "", "Listen address for a UDP server answering every datagram with the sender's address and port, e.g. :9000 (disabled if empty)")
+	fs.Float64Var(&c.udpRate, "udp-rate", 1, "Datagrams per second the UDP server answers for each source address, so spoofed sources can't use it to flood others (unlimited if zero)")
+	fs.IntVar(&c.udpBurst, "udp-burst", 5, "Datagrams the UDP server answers for each source address in a burst before -udp-rate applies")
+	fs.BoolVar(&c.accessLog, "access-log", false, "Log every request to the public http server")
+	fs.StringVar(&c.historyDB, "history-db", "", "Path of a database recording the addresses requests with an API key come from, enabling /history; needs -api-keys (disabled if empty)")
+	fs.DurationVar(&c.historyRetention, "history-retention", 90*24*time.Hour, "How long addresses which haven't been seen again are kept in the history (forever if zero); changes of address older than 30 days are kept as daily snapshots")
+	fs.IntVar(&c.historyMaxIPs, "history-max-ips", 1000, "Maximum number of addresses, and of changes of address, kept in the history of each API key; the least recently seen addresses and the oldest changes are dropped first")
+	fs.StringVar(&c.apiKeys, "api-keys", "", "Comma separated name=key pairs of API keys; once any are configured, /bgp, /asn, /hostname, /whois, /blacklist, /portcheck and /history need one as a bearer token, as do the lookups of /json")
+	fs.StringVar(&c.apiKeysFile, "api-keys-file", "", "File with a name and an API key on each line, in addition to -api-keys")
+	fs.StringVar(&c.usersFile, "users-file", "", "File with the ID and optionally the quota of a user on each line; keys of the keys file owned by a user with user=<id> share its quota and history")
+	fs.IntVar(&c.apiKeyDailyQuota, "api-key-daily-quota", 0, "Requests each API key or user may make per day (UTC) unless the keys or users file gives it its own quota (unlimited if zero)")
+	fs.Float64Var(&c.apiKeyRate, "api-key-rate", 0, "Requests per second each API key or user may make unless the keys or users file gives it its own quota (unlimited if zero)")
+	fs.IntVar(&c.apiKeyBurst, "api-key-burst", 10, "Requests each API key or user may make in a burst before -api-key-rate applies")
+	fs.StringVar(&c.dnsblZones, "dnsbl", "", "Comma separated DNSBL zones, e.g. zen.spamhaus.org, the client address is checked against at /blacklist (disabled if empty)")
+	fs.DurationVar(&c.dnsblTimeout, "dnsbl-timeout", 2*time.Second, "Timeout for checking an address against every DNSBL")
+	fs.DurationVar(&c.dnsblCacheTTL, "dnsbl-cache-ttl", 15*time.Minute, "How long the DNSBL results of an address are cached")
+	fs.StringVar(&c.rdapURL, "rdap-url", "", "Base URL of an RDAP bootstrap service used for /whois lookups, e.g. https://rdap.org (disabled if empty)")
+	fs.DurationVar(&c.rdapTimeout, "rdap-timeout", 3*time.Second, "Timeout for RDAP lookups, including redirects to the registry")
+	fs.DurationVar(&c.rdapCacheTTL, "rdap-cache-ttl", 24*time.Hour, "How long registrations from RDAP lookups are cached")
+	fs.StringVar(&c.portCheckPorts, "portcheck-ports", "", "Comma separated ports and ranges, e.g. 22,80,443,1024-65535, /portcheck may connect back to the client on; needs -api-keys (disabled if empty)")
+	fs.DurationVar(&c.portCheckTimeout, "portcheck-timeout", 3*time.Second, "Timeout for connecting back to the client, after which a port is reported as filtered")
+	fs.Float64Var(&c.portCheckRate, "portcheck-rate", 0.2, "Port checks per second each client may request (unlimited if zero)")
+	fs.IntVar(&c.portCheckBurst, "portcheck-burst", 5, "Port checks each client may request in a burst before -portcheck-rate applies")
+	fs.Int64Var(&c.speedMaxBytes, "speed-max-bytes", 0, "Maximum bytes a single bandwidth test may transfer, enabling /speed/down and /speed/up (disabled if zero)")
+	fs.Float64Var(&c.speedRate, "speed-rate", 0.1, "Bandwidth tests per second each client may run (unlimited if zero)")
+	fs.IntVar(&c.speedBurst, "speed-burst", 6, "Bandwidth tests each client may run in a burst before -speed-rate applies")
+	fs.StringVar(&c.signingKey, "signing-key", "", "PEM encoded Ed25519 private key (openssl genpkey -algorithm ed25519) to sign JSON responses with, enabling /pubkey (disabled if empty)")
+	fs.BoolVar(&c.uniqueClientStats, "unique-client-stats", true, "Estimate the number of unique clients per hour and day, served at /stats of the admin server and in the metrics, without keeping their addresses")
+	fs.StringVar(&c.ipv4URL, "ipv4-url", "", "Base URL of a hostname resolving only to the IPv4 addresses of this server, e.g. https://ipv4.example.com; with -ipv6-url the HTML page shows both addresses of the client")
+	fs.StringVar(&c.ipv6URL, "ipv6-url", "", "Base URL of a hostname resolving only to the IPv6 addresses of this server, e.g. https://ipv6.example.com")
+	fs.StringVar(&c.templatesDir, "templates-dir", "", "Directory of HTML templates overriding the embedded ones of the same name, reloaded on SIGHUP")
+	fs.StringVar(&c.debugListenAddr, "debug-listen", "", "Listen address for the debug http server serving pprof profiles, expvar and build info under /debug/, on localhost unless it names a host, e.g. :6060 (disabled if empty)")
+	fs.StringVar(&c.staticDir, "static-dir", "", "Directory of files served under /static/ in place of the embedded ones of the same name")
+}
+
+// The options of the http handler which follow directly from flags, or an error naming a flag
+// with an invalid value. Anything which has to be loaded first, such as TLS certificates and
+// datasets, is left for the caller.
+func (c *config) options() (ippotato.Options, error) {
+	var textCRLF bool
+	switch strings.ToLower(c.textEOL) {
+	case "lf":
+	case "crlf":
+		textCRLF = true
+	default:
+		return ippotato.Options{}, fmt.Errorf("unknown -text-eol %q, expected lf or crlf", c.textEOL)
+	}
+	opts := ippotato.Options{
+		BGPAPI:                c.bgpAPI,
+		BGPAttribution:        c.bgpAttribution,
+		BGPTimeout:            c.bgpTimeout,
+		BGPCacheTTL:           c.bgpCacheTTL,
+		RDAPURL:               c.rdapURL,
+		RDAPTimeout:           c.rdapTimeout,
+		RDAPCacheTTL:          c.rdapCacheTTL,
+		ReverseDNS:            c.rdnsEnabled,
+		RDNSTimeout:           c.rdnsTimeout,
+		RDNSCacheTTL:          c.rdnsCacheTTL,
+		RDNSNegativeTTL:       c.rdnsNegativeTTL,
+		EchoRedactHeaders:     strings.Split(c.echoRedact, ","),
+		EchoMaxValueBytes:     c.echoMaxValueBytes,
+		EchoMaxHeaders:        c.echoMaxHeaders,
+		EchoMaxBodyBytes:      c.echoMaxBodyBytes,
+		ParseUserAgent:        c.parseUserAgent,
+		TextCRLF:              textCRLF,
+		TextBOM:               c.textBOM,
+		TextNoTrailingNewline: !c.textTrailingNewline,
+		MicroCacheTTL:         c.microCacheTTL,
+		APIRate:               c.apiRate,
+		APIBurst:              c.apiBurst,
+		DefaultQuota:          ippotato.Quota{Daily: c.apiKeyDailyQuota, Rate: c.apiKeyRate, Burst: c.apiKeyBurst},
+		DNSBLTimeout:          c.dnsblTimeout,
+		PortCheckTimeout:      c.portCheckTimeout,
+		PortCheckRate:         c.portCheckRate,
+		PortCheckBurst:        c.portCheckBurst,
+		SpeedMaxBytes:         c.speedMaxBytes,
+		SpeedRate:             c.speedRate,
+		SpeedBurst:            c.speedBurst,
+		IPv4URL:               c.ipv4URL,
+		IPv6URL:               c.ipv6URL,
+		StaticDir:             c.staticDir,
+		DNSBLCacheTTL:         c.dnsblCacheTTL,
+	}
+	for _, zone := range strings.Split(c.dnsblZones, ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			opts.DNSBLZones = append(opts.DNSBLZones, zone)
+		}
+	}
+	if c.accessLog {
+		opts.Middleware = append(opts.Middleware, ippotato.AccessLog(slog.Default()))
+	}
+	return opts, nil
+}
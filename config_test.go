@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestConfigTextEOL(t *testing.T) {
+	tests := []struct {
+		eol      string
+		wantCRLF bool
+		wantErr  bool
+	}{
+		{eol: "lf"},
+		{eol: "CRLF", wantCRLF: true},
+		{eol: "crl", wantErr: true},
+		{eol: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		var cfg config
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg.registerFlags(fs)
+		if err := fs.Parse([]string{"-text-eol=" + tt.eol}); err != nil {
+			t.Fatal(err)
+		}
+		opts, err := cfg.options()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("-text-eol=%s: got error %v, want one: %v", tt.eol, err, tt.wantErr)
+		}
+		if err == nil && opts.TextCRLF != tt.wantCRLF {
+			t.Errorf("-text-eol=%s: got TextCRLF %v, want %v", tt.eol, opts.TextCRLF, tt.wantCRLF)
+		}
+	}
+}
+
+// Lookups which query other servers on behalf of every request are opt-in.
+func TestConfigDefaultsWithoutOutboundLookups(t *testing.T) {
+	var cfg config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.registerFlags(fs)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := cfg.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.ReverseDNS || opts.BGPAPI != "" || opts.RDAPURL != "" || len(opts.DNSBLZones) != 0 {
+		t.Errorf("outbound lookups are enabled by default: %+v", opts)
+	}
+}
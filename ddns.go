@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// The configuration file of the ddns subcommand. It holds provider credentials, so it should
+// only be readable by the user running the updater.
+type ddnsConfig struct {
+	// The instance asked for the public address, -server of the client subcommand.
+	Server string `json:"server"`
+	// How often the address is checked, 5m if empty.
+	Interval duration `json:"interval"`
+	// Which address is kept up to date, ipv4 (an A record, the default) or ipv6 (AAAA).
+	Family    string               `json:"family"`
+	Providers []ddnsProviderConfig `json:"providers"`
+}
+
+type ddnsProviderConfig struct {
+	// cloudflare, route53 or url.
+	Type string `json:"type"`
+	// The record to update, for cloudflare and route53.
+	Name string `json:"name"`
+	TTL  int    `json:"ttl"`
+
+	// Cloudflare: an API token allowed to edit DNS records of the zone.
+	APIToken string `json:"api_token"`
+	ZoneID   string `json:"zone_id"`
+	Proxied  bool   `json:"proxied"`
+
+	// Route53: credentials of an IAM user allowed to change record sets of the hosted zone.
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+	HostedZoneID    string `json:"hosted_zone_id"`
+
+	// url: an update URL requested with GET, in which {ip} is replaced by the address. Typical
+	// for providers speaking the dyndns2 protocol, whose error answers are recognised.
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// A time.Duration which is written as a string such as "5m" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+func loadDDNSConfig(path string) (*ddnsConfig, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ddnsConfig{Server: envOr("IP_POTATO_SERVER", defaultClientServer), Interval: duration(5 * time.Minute), Family: "ipv4"}
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if cfg.Family != "ipv4" && cfg.Family != "ipv6" {
+		return nil, fmt.Errorf("%s: unknown family %q, expected ipv4 or ipv6", path, cfg.Family)
+	}
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("%s: the interval must be positive", path)
+	}
+	if len(cfg.Providers) == 0 {
+		return nil, fmt.Errorf("%s: no providers configured", path)
+	}
+	return cfg, nil
+}
+
+// Updates a DNS record to point at an address.
+type ddnsProvider interface {
+	Name() string
+	Update(ctx context.Context, ip net.IP) error
+}
+
+func newDDNSProvider(cfg ddnsProviderConfig, client *http.Client) (ddnsProvider, error) {
+	switch cfg.Type {
+	case "cloudflare":
+		if cfg.APIToken == "" || cfg.ZoneID == "" || cfg.Name == "" {
+			return nil, errors.New("cloudflare: api_token, zone_id and name are required")
+		}
+		return &cloudflareProvider{cfg: cfg, client: client}, nil
+	case "route53":
+		if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" || cfg.HostedZoneID == "" || cfg.Name == "" {
+			return nil, errors.New("route53: access_key_id, secret_access_key, hosted_zone_id and name are required")
+		}
+		return &route53Provider{cfg: cfg, client: client}, nil
+	case "url":
+		if !strings.Contains(cfg.URL, "{ip}") {
+			return nil, errors.New("url: the url must contain {ip}")
+		}
+		return &urlProvider{cfg: cfg, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider type %q, expected cloudflare, route53 or url", cfg.Type)
+	}
+}
+
+func recordType(ip net.IP) string {
+	if ip.To4() != nil {
+		return "A"
+	}
+	return "AAAA"
+}
+
+// Keeps DNS records pointing at the public address of this host. It checks the address with
+// a running instance every interval and updates the records of every provider when it
+// changes. Providers which fail are retried on the next check. Returns the exit code of the
+// process.
+func runDDNS(args []string) int {
+	fs := flag.NewFlagSet("ddns", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path of the JSON configuration file with the providers to update (required)")
+	once := fs.Bool("once", false, "Check and update once and exit, e.g. when run from cron")
+	timeout := fs.Duration("timeout", 10*time.Second, "Timeout of each request")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ddns -config <path> [flags]\n\nKeeps DNS records at Cloudflare, Route53 or a dyndns2 style update URL pointing at the\npublic address of this host.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if *configPath == "" {
+		fs.Usage()
+		return 2
+	}
+	cfg, err := loadDDNSConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	providerClient := &http.Client{Timeout: *timeout}
+	providers := make([]ddnsProvider, len(cfg.Providers))
+	for i, p := range cfg.Providers {
+		if providers[i], err = newDDNSProvider(p, providerClient); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: provider %d: %v\n", *configPath, i+1, err)
+			return 2
+		}
+	}
+
+	network := "tcp4"
+	if cfg.Family == "ipv6" {
+		network = "tcp6"
+	}
+	dialer := &net.Dialer{Timeout: *timeout}
+	u := &ddnsUpdater{
+		server: cfg.Server,
+		client: &client{
+			http: &http.Client{
+				Timeout: *timeout,
+				// The address of the family to update is only seen if the check uses it
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+						return dialer.DialContext(ctx, network, addr)
+					},
+				},
+			},
+			retries: 2,
+			backoff: time.Second,
+			maxWait: 30 * time.Second,
+		},
+		providers: providers,
+		current:   map[string]string{},
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Kill, os.Interrupt)
+	defer cancel()
+	if *once {
+		if err := u.check(ctx); err != nil {
+			slog.Error("ddns update failed", slog.Any("error", err))
+			return 1
+		}
+		return 0
+	}
+	slog.Info("Starting ddns updater", slog.String("server", cfg.Server), slog.Duration("interval", time.Duration(cfg.Interval)), slog.Int("providers", len(providers)))
+	ticker := time.NewTicker(time.Duration(cfg.Interval))
+	defer ticker.Stop()
+	for {
+		if err := u.check(ctx); err != nil {
+			slog.Error("ddns update failed", slog.Any("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-ticker.C:
+		}
+	}
+}
+
+type ddnsUpdater struct {
+	server    string
+	client    *client
+	providers []ddnsProvider
+	// The address each provider was last updated to successfully, by provider name.
+	current map[string]string
+}
+
+// Checks the public address and updates every provider which doesn't point at it yet.
+func (u *ddnsUpdater) check(ctx context.Context) error {
+	body, err := u.client.get(u.server, "text/plain")
+	if err != nil {
+		return fmt.Errorf("checking the public address: %w", err)
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return fmt.Errorf("checking the public address: %s answered %q, not an address", u.server, body)
+	}
+
+	var errs []error
+	for _, p := range u.providers {
+		if u.current[p.Name()] == ip.String() {
+			continue
+		}
+		if err := p.Update(ctx, ip); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		slog.Info("Updated ddns record", slog.String("provider", p.Name()), slog.String("ip", ip.String()), slog.String("previous", u.current[p.Name()]))
+		u.current[p.Name()] = ip.String()
+	}
+	return errors.Join(errs...)
+}
+
+// Sends the request and decodes the JSON response into v, unless v is nil. Responses which
+// aren't successful are returned as errors with the start of their body.
+func doRequest(client *http.Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(body) > 512 {
+			body = body[:512]
+		}
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+// Updates a record through the Cloudflare API, creating it if it doesn't exist yet.
+type cloudflareProvider struct {
+	cfg    ddnsProviderConfig
+	client *http.Client
+}
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+func (p *cloudflareProvider) Name() string { return "cloudflare:" + p.cfg.Name }
+
+func (p *cloudflareProvider) Update(ctx context.Context, ip net.IP) error {
+	records := cloudflareAPI + "/zones/" + url.PathEscape(p.cfg.ZoneID) + "/dns_records"
+	typ := recordType(ip)
+
+	var existing struct {
+		Result []struct {
+			ID      string `json:"id"`
+			Content string `json:"content"`
+		} `json:"result"`
+	}
+	req, err := p.request(ctx, http.MethodGet, records+"?"+url.Values{"type": {typ}, "name": {p.cfg.Name}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if err := doRequest(p.client, req, &existing); err != nil {
+		return err
+	}
+
+	ttl := p.cfg.TTL
+	if ttl == 0 {
+		ttl = 1 // automatic
+	}
+	record, err := json.Marshal(map[string]any{"type": typ, "name": p.cfg.Name, "content": ip.String(), "ttl": ttl, "proxied": p.cfg.Proxied})
+	if err != nil {
+		return err
+	}
+	method, target := http.MethodPost, records
+	if len(existing.Result) > 0 {
+		if existing.Result[0].Content == ip.String() {
+			return nil
+		}
+		method, target = http.MethodPut, records+"/"+url.PathEscape(existing.Result[0].ID)
+	}
+	if req, err = p.request(ctx, method, target, record); err != nil {
+		return err
+	}
+	return doRequest(p.client, req, nil)
+}
+
+func (p *cloudflareProvider) request(ctx context.Context, method, target string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.cfg.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// Requests an update URL, as offered by most dynamic DNS services.
+type urlProvider struct {
+	cfg    ddnsProviderConfig
+	client *http.Client
+}
+
+func (p *urlProvider) Name() string {
+	if u, err := url.Parse(p.cfg.URL); err == nil {
+		return "url:" + u.Host
+	}
+	return "url"
+}
+
+// Answers of the dyndns2 protocol which mean the update failed, even though they are sent
+// with 200 OK.
+var dyndnsErrors = []string{"badauth", "notfqdn", "nohost", "numhost", "abuse", "badagent", "dnserr", "911", "!donator"}
+
+func (p *urlProvider) Update(ctx context.Context, ip net.IP) error {
+	target := strings.ReplaceAll(p.cfg.URL, "{ip}", url.QueryEscape(ip.String()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	if p.cfg.Username != "" {
+		req.SetBasicAuth(p.cfg.Username, p.cfg.Password)
+	}
+	req.Header.Set("User-Agent", "ip-potato-ddns/"+readBuildInfo().Version)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	answer := strings.TrimSpace(string(body))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s: %s", endpoint(req.URL), resp.Status, answer)
+	}
+	for _, code := range dyndnsErrors {
+		if strings.HasPrefix(answer, code) {
+			return fmt.Errorf("%s: update refused: %s", endpoint(req.URL), answer)
+		}
+	}
+	return nil
+}
+
+// Update URLs often carry credentials in their query, which must not end up in logs.
+func endpoint(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.Path
+}
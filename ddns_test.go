@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestURLProviderUpdate(t *testing.T) {
+	tests := []struct {
+		answer  string
+		status  int
+		wantErr string
+	}{
+		{answer: "good 192.0.2.1", status: http.StatusOK},
+		{answer: "nochg 192.0.2.1", status: http.StatusOK},
+		{answer: "badauth", status: http.StatusOK, wantErr: "update refused: badauth"},
+		{answer: "nohost", status: http.StatusOK, wantErr: "update refused: nohost"},
+		{answer: "911", status: http.StatusOK, wantErr: "update refused: 911"},
+		{answer: "unavailable", status: http.StatusServiceUnavailable, wantErr: "503 Service Unavailable: unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.answer, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+					t.Errorf("unexpected credentials %q %q", user, pass)
+				}
+				if got := r.URL.Query().Get("myip"); got != "192.0.2.1" {
+					t.Errorf("myip is %q", got)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.answer+"\n")
+			}))
+			defer server.Close()
+
+			p, err := newDDNSProvider(ddnsProviderConfig{
+				Type:     "url",
+				URL:      server.URL + "/nic/update?hostname=home.example.com&myip={ip}&token=hidden",
+				Username: "user",
+				Password: "pass",
+			}, server.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.Update(context.Background(), net.ParseIP("192.0.2.1"))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+			if strings.Contains(err.Error(), "hidden") {
+				t.Errorf("the error leaks the query: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime/debug"
+)
+
+// Serves the profiles of net/http/pprof under /debug/pprof/, the variables of expvar at
+// /debug/vars and the build info of the binary at /debug/buildinfo. Profiles reveal the
+// internals of the process and some of them are expensive to collect, so it must only be
+// reachable by operators. It lives in package main rather than the library since importing
+// net/http/pprof and expvar registers them on http.DefaultServeMux, which programs embedding
+// the library may serve publicly.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("GET /debug/buildinfo", handleBuildInfoReq)
+	return mux
+}
+
+// Writes the module versions and build settings of the binary, as go version -m does.
+func handleBuildInfoReq(w http.ResponseWriter, req *http.Request) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		http.Error(w, "the binary was built without module support", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(info.String()))
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	h := debugHandler()
+	for path, want := range map[string]string{
+		"/debug/pprof/":             "goroutine",
+		"/debug/pprof/heap?debug=1": "heap profile",
+		"/debug/vars":               `"memstats"`,
+		"/debug/buildinfo":          "go\t",
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("%s: got status %d and %.200q, want %d containing %q", path, rec.Code, rec.Body, http.StatusOK, want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jault3/ip-potato/ippotato"
+)
+
+type checkStatus string
+
+const (
+	checkOK   checkStatus = " OK "
+	checkWarn checkStatus = "WARN"
+	checkFail checkStatus = "FAIL"
+)
+
+// Runs the checks of the doctor subcommand and prints a line for each of them, with a hint
+// on how to fix anything that isn't right.
+type doctor struct {
+	out      io.Writer
+	timeout  time.Duration
+	failures int
+}
+
+func (d *doctor) report(status checkStatus, name, result, hint string) {
+	fmt.Fprintf(d.out, "[%s] %s: %s\n", status, name, result)
+	if hint != "" && status != checkOK {
+		fmt.Fprintf(d.out, "       hint: %s\n", hint)
+	}
+	if status == checkFail {
+		d.failures++
+	}
+}
+
+// Checks the local environment of a self-hosted instance: public connectivity, the clock,
+// whether the configured ports can be bound and whether the configured data sources work.
+// It accepts the same flags as the server. Returns the exit code of the process.
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	var cfg config
+	cfg.registerFlags(fs)
+	probeURL := fs.String("probe-url", "https://ip-potato.com", "URL of a running instance used to check public connectivity and the clock")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout of each network check")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s doctor [flags]\n\nChecks whether this host is ready to run ip-potato with the given flags.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	d := &doctor{out: os.Stdout, timeout: *timeout}
+	if _, err := cfg.options(); err != nil {
+		d.report(checkFail, "flags", err.Error(), "")
+	}
+	resolver, err := ippotato.NewResolver(cfg.resolver, 0)
+	if err != nil {
+		d.report(checkFail, "resolver", err.Error(), "check the -resolver flag")
+	}
+	d.checkConnectivity(*probeURL, "tcp4", "IPv4")
+	d.checkConnectivity(*probeURL, "tcp6", "IPv6")
+	d.checkClock(*probeURL)
+	d.checkBindable("HTTP listener", "tcp", cfg.listenAddr)
+	if cfg.adminListenAddr != "" {
+		d.checkBindable("admin listener", "tcp", cfg.adminListenAddr)
+	}
+	if cfg.debugListenAddr != "" {
+		d.checkBindable("debug listener", "tcp", NewDebugServer(cfg.debugListenAddr).Addr)
+	}
+	if cfg.dnsListenAddr != "" {
+		if cfg.dnsZone == "" {
+			d.report(checkFail, "DNS listener", "no zone to answer", "set -dns-zone to the name delegated to this host")
+		}
+		d.checkBindable("DNS listener (UDP)", "udp", cfg.dnsListenAddr)
+		d.checkBindable("DNS listener (TCP)", "tcp", cfg.dnsListenAddr)
+	}
+	if cfg.stunListenAddr != "" {
+		d.checkBindable("STUN listener", "udp", cfg.stunListenAddr)
+	}
+	if cfg.tcpListenAddr != "" {
+		d.checkBindable("TCP listener", "tcp", cfg.tcpListenAddr)
+	}
+	if cfg.udpListenAddr != "" {
+		d.checkBindable("UDP listener", "udp", cfg.udpListenAddr)
+	}
+	if cfg.tlsCert != "" {
+		d.checkTLS(cfg)
+	}
+	if cfg.asnDBPath != "" {
+		d.checkASNDB(cfg.asnDBPath)
+	}
+	if cfg.bgpAPI != "" {
+		d.checkBGP(cfg)
+	}
+	if cfg.rdapURL != "" {
+		d.checkRDAP(cfg)
+	}
+	if cfg.rdnsEnabled && resolver != nil {
+		d.checkReverseDNS(cfg, resolver)
+	}
+	if cfg.pushGateway != "" {
+		d.checkPushgateway(cfg.pushGateway)
+	}
+
+	if d.failures > 0 {
+		fmt.Fprintf(d.out, "\n%d check(s) failed\n", d.failures)
+		return 1
+	}
+	fmt.Fprintln(d.out, "\nAll checks passed")
+	return 0
+}
+
+// Asks the probe instance which address it sees, forcing the connection over the network.
+func (d *doctor) checkConnectivity(probeURL, network, name string) {
+	dialer := &net.Dialer{Timeout: d.timeout}
+	client := &http.Client{
+		Timeout: d.timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, probeURL, nil)
+	if err != nil {
+		d.report(checkFail, name+" connectivity", err.Error(), "check the -probe-url flag")
+		return
+	}
+	req.Header.Set("Accept", "text/plain")
+	resp, err := client.Do(req)
+	if err != nil {
+		status := checkWarn
+		if network == "tcp4" {
+			status = checkFail
+		}
+		d.report(status, name+" connectivity", err.Error(), "clients will only reach this instance over "+name+" if the host has a public "+name+" route")
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	d.report(checkOK, name+" connectivity", "public address "+strings.TrimSpace(string(body)), "")
+}
+
+func (d *doctor) checkClock(probeURL string) {
+	if time.Now().Year() < 2024 {
+		d.report(checkFail, "clock", "local time is "+time.Now().Format(time.RFC3339), "the clock is far in the past, TLS certificates will fail to validate; enable NTP")
+		return
+	}
+	client := &http.Client{Timeout: d.timeout}
+	resp, err := client.Head(probeURL)
+	if err != nil {
+		d.report(checkWarn, "clock", "could not compare with a remote clock: "+err.Error(), "")
+		return
+	}
+	resp.Body.Close()
+	remote, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		d.report(checkWarn, "clock", "the probe did not send a usable Date header", "")
+		return
+	}
+	skew := time.Since(remote).Round(time.Second)
+	if skew.Abs() > time.Minute {
+		d.report(checkFail, "clock", fmt.Sprintf("local clock is off by %s", skew), "enable NTP, a skewed clock breaks TLS and makes cache expiry unreliable")
+		return
+	}
+	d.report(checkOK, "clock", fmt.Sprintf("within %s of %s", skew.Abs(), resp.Request.URL.Host), "")
+}
+
+// Binds the address with tcp or udp, the UDP listeners use packet connections.
+func (d *doctor) checkBindable(name, network, addr string) {
+	var closer io.Closer
+	var err error
+	if network == "udp" {
+		closer, err = net.ListenPacket(network, addr)
+	} else {
+		closer, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		d.report(checkFail, name, err.Error(), "is ip-potato or another service already running on "+addr+"? Ports below 1024 also need elevated privileges")
+		return
+	}
+	closer.Close()
+	d.report(checkOK, name, addr+" can be bound", "")
+}
+
+func (d *doctor) checkTLS(cfg config) {
+	if _, err := ippotato.NewTLSConfig(cfg.tlsCert, cfg.tlsKey, cfg.clientAuth, cfg.clientCA); err != nil {
+		d.report(checkFail, "TLS", err.Error(), "check -tls-cert, -tls-key, -client-auth and -client-ca")
+		return
+	}
+	d.report(checkOK, "TLS", "certificate and key load", "")
+}
+
+func (d *doctor) checkASNDB(path string) {
+	db, err := ippotato.LoadASNDB(path)
+	if err != nil {
+		d.report(checkFail, "ASN database", err.Error(), "download ip2asn-combined.tsv.gz from https://iptoasn.com")
+		return
+	}
+	age := time.Since(db.Info().Modified).Round(time.Hour)
+	if age > 30*24*time.Hour {
+		d.report(checkWarn, "ASN database", fmt.Sprintf("%d ranges, last modified %s ago", db.Info().Entries, age), "the database is over a month old, refresh it")
+		return
+	}
+	d.report(checkOK, "ASN database", fmt.Sprintf("%d ranges, last modified %s ago", db.Info().Entries, age), "")
+}
+
+// Serves a request for path on behalf of a client with the given address from a handler with
+// the options, exercising the same code as requests to the server.
+func probeHandler(opts ippotato.Options, path, clientIP string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = net.JoinHostPort(clientIP, "1234")
+	req.Header.Set("Accept", "application/json")
+	ippotato.Handler(opts).ServeHTTP(rec, req)
+	return rec
+}
+
+func (d *doctor) checkBGP(cfg config) {
+	opts := ippotato.Options{BGPAPI: cfg.bgpAPI, BGPAttribution: cfg.bgpAttribution, BGPTimeout: d.timeout}
+	// The address of RIPE NCC's own website, which is always announced
+	rec := probeHandler(opts, "/bgp", "193.0.6.139")
+	var info struct {
+		Prefix string `json:"prefix"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &info) != nil {
+		d.report(checkFail, "looking glass", strings.TrimSpace(rec.Body.String()), "check that "+cfg.bgpAPI+" is reachable from this host")
+		return
+	}
+	d.report(checkOK, "looking glass", fmt.Sprintf("193.0.6.139 is announced in %s", info.Prefix), "")
+}
+
+func (d *doctor) checkRDAP(cfg config) {
+	opts := ippotato.Options{RDAPURL: cfg.rdapURL, RDAPTimeout: d.timeout}
+	rec := probeHandler(opts, "/whois", "193.0.6.139")
+	var info struct {
+		Handle string `json:"handle"`
+		Source string `json:"source"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &info) != nil {
+		d.report(checkFail, "RDAP", strings.TrimSpace(rec.Body.String()), "check that "+cfg.rdapURL+" is reachable from this host")
+		return
+	}
+	d.report(checkOK, "RDAP", fmt.Sprintf("193.0.6.139 is registered as %s according to %s", info.Handle, info.Source), "")
+}
+
+func (d *doctor) checkReverseDNS(cfg config, resolver ippotato.Resolver) {
+	ctx, cancel := context.WithTimeout(context.Background(), max(cfg.rdnsTimeout, d.timeout))
+	defer cancel()
+	names, err := resolver.LookupAddr(ctx, "8.8.8.8")
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		d.report(checkWarn, "reverse DNS", err.Error(), "hostnames will be missing from responses; leave -rdns off if outbound DNS isn't allowed")
+		return
+	}
+	if len(names) == 0 {
+		d.report(checkWarn, "reverse DNS", "no PTR record found for 8.8.8.8", "the resolver of this host may not be able to reach public DNS")
+		return
+	}
+	d.report(checkOK, "reverse DNS", "8.8.8.8 resolves to "+strings.TrimSuffix(names[0], "."), "")
+}
+
+func (d *doctor) checkPushgateway(gatewayURL string) {
+	client := &http.Client{Timeout: d.timeout}
+	resp, err := client.Get(strings.TrimSuffix(gatewayURL, "/") + "/-/healthy")
+	if err != nil {
+		d.report(checkFail, "pushgateway", err.Error(), "check that "+gatewayURL+" is reachable from this host")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		d.report(checkFail, "pushgateway", fmt.Sprintf("health check returned status %d", resp.StatusCode), "")
+		return
+	}
+	d.report(checkOK, "pushgateway", "healthy", "")
+}
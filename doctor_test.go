@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckBindable(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	tests := []struct {
+		network, addr string
+		status        checkStatus
+	}{
+		{network: "tcp", addr: tcp.Addr().String(), status: checkFail},
+		{network: "udp", addr: udp.LocalAddr().String(), status: checkFail},
+		{network: "tcp", addr: "127.0.0.1:0", status: checkOK},
+		{network: "udp", addr: "127.0.0.1:0", status: checkOK},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		d := &doctor{out: &out}
+		d.checkBindable("listener", tt.network, tt.addr)
+		if !strings.HasPrefix(out.String(), "["+string(tt.status)+"] listener: ") {
+			t.Errorf("%s %s: reported %q, want %q", tt.network, tt.addr, out.String(), tt.status)
+		}
+	}
+}
@@ -1,3 +1,9 @@
 module github.com/jault3/ip-potato
 
 go 1.22.5
+
+require (
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/net v0.34.0
+	golang.org/x/sys v0.29.0
+)
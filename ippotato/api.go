@@ -0,0 +1,51 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+var apiRateLimited = newCounterVec("ippotato_api_rate_limited_total", "Number of requests rejected by the rate limit of clients, by route.", "route")
+
+// Sets the headers shared by every response of the browser API. Any page may call it, but
+// never with credentials: without Access-Control-Allow-Credentials browsers don't send cookies
+// or expose the response of credentialed requests, and the API doesn't set any cookies either.
+func apiHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", "*")
+		h.Set("Cross-Origin-Resource-Policy", "cross-origin")
+		h.Set("Cache-Control", "no-store")
+		h.Set("X-Content-Type-Options", "nosniff")
+		next.ServeHTTP(w, req)
+	})
+}
+
+// The middleware of the browser API routes, in order. The routes share the rate limit of each
+// client, their rejections are counted by route.
+func (s *service) apiMiddleware(route string) []Middleware {
+	middleware := []Middleware{apiHeaders}
+	if s.apiLimiter != nil {
+		middleware = append(middleware, rateLimit(s.apiLimiter, s.proxies, route, s.rejectAPIReq))
+	}
+	return middleware
+}
+
+func (s *service) rejectAPIReq(w http.ResponseWriter, req *http.Request, retryAfter time.Duration) {
+	s.rejectRateLimited(w, req, retryAfter, "rate limit exceeded")
+}
+
+func handleAPIPreflightReq(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// A JSON API for third-party web pages embedding the address of the visitor. Unlike / and
+// /json it isn't negotiated and only ever returns the address, so its shape can't change
+// under the pages which embed it.
+func (s *service) handleAPIIPReq(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"ip": RealIP(req)})
+}
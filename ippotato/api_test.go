@@ -0,0 +1,29 @@
+package ippotato
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The browser API routes share the limit of each client but count their rejections apart.
+func TestAPIRateLimitedByRoute(t *testing.T) {
+	h := Handler(Options{APIRate: 0.001, APIBurst: 1, IPv4URL: "https://ipv4.example.com", IPv6URL: "https://ipv6.example.com"})
+	rejected := func(route string) float64 {
+		apiRateLimited.mu.Lock()
+		defer apiRateLimited.mu.Unlock()
+		return apiRateLimited.values[formatLabels(apiRateLimited.labelNames, []string{route})]
+	}
+	before := map[string]float64{"/api/v1/ip": rejected("/api/v1/ip"), "/both": rejected("/both")}
+	for _, target := range []string{"/api/v1/ip", "/both", "/both"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if got := rejected("/both") - before["/both"]; got != 2 {
+		t.Errorf("counted %v rejections of /both, want 2", got)
+	}
+	if got := rejected("/api/v1/ip") - before["/api/v1/ip"]; got != 0 {
+		t.Errorf("counted %v rejections of /api/v1/ip, want none", got)
+	}
+}
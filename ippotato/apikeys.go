@@ -0,0 +1,204 @@
+package ippotato
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var apiKeyRequests = newCounterVec("ippotato_api_key_requests_total", "Number of http requests authenticated with an API key, by key name and status code.", "key", "code")
+
+// An APIKey grants access to the routes which need one, see Options.APIKeys.
+type APIKey struct {
+	// Identifies the key in access logs and metrics, which never contain the key itself.
+	Name string
+	Key  string
+	// The user owning the key, if any. The keys of a user share its quota, and each of them
+	// can read the history of the others.
+	User string
+	// Limits of the key, Options.DefaultQuota if nil. Keys owned by a user don't have their
+	// own, they are limited by the quota of the user.
+	Quota *Quota
+}
+
+// A User owns API keys, see APIKey.User. Users are only identified by their ID, which can be
+// any name or one provided by an identity provider, e.g. the subject of an OIDC token.
+type User struct {
+	ID string
+	// Limits shared by all keys of the user, Options.DefaultQuota if nil.
+	Quota *Quota
+}
+
+// ParseAPIKeys parses a comma separated list of name=key pairs.
+func ParseAPIKeys(s string) ([]APIKey, error) {
+	var keys []APIKey
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, key, ok := strings.Cut(pair, "=")
+		if !ok || name == "" || key == "" {
+			return nil, fmt.Errorf("invalid API key %q, expected name=key", pair)
+		}
+		keys = append(keys, APIKey{Name: name, Key: key})
+	}
+	return keys, nil
+}
+
+// LoadAPIKeys reads API keys from a file with a name and a key separated by whitespace on
+// each line, optionally followed by user=<id> naming the user owning the key, or by the quota
+// of the key as daily=<requests per day>, rate=<requests per second> and burst=<requests>.
+// Limits which aren't given for a key with a quota are unlimited. Empty lines and lines
+// starting with # are ignored.
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	var keys []APIKey
+	err := readConfigLines(path, func(fields []string) error {
+		if len(fields) < 2 {
+			return errors.New("expected a name and a key")
+		}
+		key := APIKey{Name: fields[0], Key: fields[1]}
+		if err := CheckAPIKeys(append(keys, key)); err != nil {
+			return err
+		}
+		options := fields[2:]
+		if len(options) > 0 && strings.HasPrefix(options[0], "user=") {
+			key.User, options = strings.TrimPrefix(options[0], "user="), options[1:]
+			if key.User == "" {
+				return errors.New("expected a user ID after user=")
+			}
+			if len(options) > 0 {
+				return errors.New("a key owned by a user has the quota of the user")
+			}
+		}
+		if len(options) > 0 {
+			quota, err := parseQuota(options)
+			if err != nil {
+				return err
+			}
+			key.Quota = &quota
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+// LoadUsers reads users from a file with the ID of a user on each line, optionally followed
+// by their quota in the options of LoadAPIKeys. Empty lines and lines starting with # are
+// ignored.
+func LoadUsers(path string) ([]User, error) {
+	var users []User
+	seen := map[string]bool{}
+	err := readConfigLines(path, func(fields []string) error {
+		user := User{ID: fields[0]}
+		if seen[user.ID] {
+			return fmt.Errorf("duplicate user %q", user.ID)
+		}
+		seen[user.ID] = true
+		if len(fields) > 1 {
+			quota, err := parseQuota(fields[1:])
+			if err != nil {
+				return err
+			}
+			user.Quota = &quota
+		}
+		users = append(users, user)
+		return nil
+	})
+	return users, err
+}
+
+// CheckAPIKeys returns an error naming the first key with the name or the key of one before
+// it. Keys are told apart by both, so neither may be shared.
+func CheckAPIKeys(keys []APIKey) error {
+	names, secrets := map[string]bool{}, map[string]string{}
+	for _, k := range keys {
+		if names[k.Name] {
+			return fmt.Errorf("duplicate API key name %q", k.Name)
+		}
+		if other, ok := secrets[k.Key]; ok {
+			return fmt.Errorf("API key %q is the same as %q", k.Name, other)
+		}
+		names[k.Name], secrets[k.Key] = true, k.Name
+	}
+	return nil
+}
+
+// Calls parse with the whitespace separated fields of every line of the file which isn't
+// empty or a comment, prefixing its errors with the position of the line.
+func readConfigLines(path string, parse func(fields []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := parse(strings.Fields(text)); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// API key names by the sha256 of the key. Looking up hashes rather than the keys themselves
+// doesn't leak how much of a guessed key is right through timing.
+type apiKeySet map[[32]byte]string
+
+func newAPIKeySet(keys []APIKey) apiKeySet {
+	set := make(apiKeySet, len(keys))
+	for _, k := range keys {
+		set[sha256.Sum256([]byte(k.Key))] = k.Name
+	}
+	return set
+}
+
+type apiKeyContextKey struct{}
+
+// APIKeyName returns the name of the API key the request was made with, or an empty string if
+// it wasn't made with one of the configured keys.
+func APIKeyName(req *http.Request) string {
+	name, _ := req.Context().Value(apiKeyContextKey{}).(string)
+	return name
+}
+
+// Identifies the API key of every request, so it is known to every following middleware
+// whether or not the route needs a key.
+func (s *service) identifyAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if key, ok := requestAPIKey(req); ok {
+			if name, ok := s.apiKeys[sha256.Sum256([]byte(key))]; ok {
+				req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, name))
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Rejects requests without a valid API key, unless no keys are configured.
+func (s *service) requireAPIKey(h http.HandlerFunc) http.HandlerFunc {
+	if s.apiKeys == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if APIKeyName(req) != "" {
+			h(w, req)
+			return
+		}
+		challenge := `Bearer realm="ip-potato"`
+		if _, ok := requestAPIKey(req); ok {
+			challenge += `, error="invalid_token"`
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		s.writeError(w, req, http.StatusUnauthorized, "a valid API key is required as a bearer token")
+	}
+}
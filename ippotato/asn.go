@@ -0,0 +1,174 @@
+package ippotato
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The autonomous system an address belongs to.
+type asnInfo struct {
+	Number       int    `json:"number"`
+	Organization string `json:"organization"`
+	Network      string `json:"network"`
+}
+
+type asnRange struct {
+	start, end   netip.Addr
+	number       int
+	organization string
+}
+
+// ASNDB is an in-memory snapshot of a routing table, mapping address ranges to the AS
+// announcing them.
+type ASNDB struct {
+	ranges []asnRange
+	info   DatasetInfo
+}
+
+// LoadASNDB loads an ASN database in the tab separated ip2asn format published by https://iptoasn.com
+// (range_start, range_end, AS_number, country_code, AS_description). Files ending in .gz are
+// decompressed on the fly.
+func LoadASNDB(path string) (*ASNDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return readASNDB(path, f, stat)
+}
+
+// Parses a database read from path, which is only used to name it and to recognise compressed
+// files.
+func readASNDB(path string, r io.Reader, stat fs.FileInfo) (*ASNDB, error) {
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	db := &ASNDB{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("%s:%d: expected 5 fields, got %d", path, line, len(fields))
+		}
+		number, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid AS number: %w", path, line, err)
+		}
+		// AS 0 marks ranges which are not announced by anyone
+		if number == 0 {
+			continue
+		}
+		start, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		end, err := netip.ParseAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if start.Is4() != end.Is4() || end.Less(start) {
+			return nil, fmt.Errorf("%s:%d: invalid range %s - %s", path, line, start, end)
+		}
+		db.ranges = append(db.ranges, asnRange{
+			start:        start,
+			end:          end,
+			number:       number,
+			organization: fields[4],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db.ranges, func(i, j int) bool { return db.ranges[i].start.Less(db.ranges[j].start) })
+	db.info = DatasetInfo{
+		Name:     "asn",
+		Path:     path,
+		Size:     stat.Size(),
+		Modified: stat.ModTime(),
+		Entries:  len(db.ranges),
+	}
+	return db, nil
+}
+
+func (db *ASNDB) dataset() *DatasetInfo {
+	return &db.info
+}
+
+// Info describes the file the database was loaded from.
+func (db *ASNDB) Info() DatasetInfo {
+	return db.info
+}
+
+// Returns nil if the address isn't part of any announced range.
+func (db *ASNDB) Lookup(ip string) *asnInfo {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	i := sort.Search(len(db.ranges), func(i int) bool { return addr.Less(db.ranges[i].start) }) - 1
+	if i < 0 || db.ranges[i].end.Less(addr) || db.ranges[i].start.Is4() != addr.Is4() {
+		return nil
+	}
+	r := db.ranges[i]
+	return &asnInfo{
+		Number:       r.number,
+		Organization: r.organization,
+		Network:      largestPrefix(addr, r.start, r.end).String(),
+	}
+}
+
+// Ranges in the database don't have to be aligned to CIDR boundaries, so this finds the
+// largest prefix containing addr which still fits entirely within the range.
+func largestPrefix(addr, start, end netip.Addr) netip.Prefix {
+	for bits := 0; bits < addr.BitLen(); bits++ {
+		prefix := netip.PrefixFrom(addr, bits).Masked()
+		if !prefix.Addr().Less(start) && !end.Less(lastAddr(prefix)) {
+			return prefix
+		}
+	}
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+func (s *service) handleASNReq(w http.ResponseWriter, req *http.Request) {
+	ip := s.proxies.clientIP(req)
+	info := s.asns.Lookup(ip)
+	if info == nil {
+		s.writeError(w, req, http.StatusNotFound, "no AS information available for "+ip)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		IP string `json:"ip"`
+		*asnInfo
+	}{ip, info})
+}
@@ -0,0 +1,75 @@
+package ippotato
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"sync/atomic"
+)
+
+// Templates are the HTML templates of the pages. Templates in a directory take precedence
+// over the embedded ones of the same file name, so operators can rebrand pages by copying and
+// editing only the templates they need, layout.html for the header and footer of every page.
+type Templates struct {
+	dir     string
+	current atomic.Pointer[template.Template]
+}
+
+// The embedded templates, used when Options.Templates is nil.
+var embeddedTemplates = mustLoadTemplates("")
+
+func mustLoadTemplates(dir string) *Templates {
+	t, err := LoadTemplates(dir)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// LoadTemplates parses the embedded templates and, unless dir is empty, the *.html templates
+// in dir overriding them.
+func LoadTemplates(dir string) (*Templates, error) {
+	t := &Templates{dir: dir}
+	return t, t.Reload()
+}
+
+// Reload parses the templates again, so edits in the directory are picked up without a
+// restart. If they don't parse, the templates loaded before are kept.
+func (t *Templates) Reload() error {
+	parsed, err := template.ParseFS(htmlTemplates, "templates/*.html")
+	if err != nil {
+		return err
+	}
+	if t.dir != "" {
+		dir := os.DirFS(t.dir)
+		// ParseFS refuses patterns without matches, a directory without overrides is fine
+		if matches, err := fs.Glob(dir, "*.html"); err != nil {
+			return err
+		} else if len(matches) > 0 {
+			if parsed, err = parsed.ParseFS(dir, "*.html"); err != nil {
+				return err
+			}
+		}
+	}
+	t.current.Store(parsed)
+	return nil
+}
+
+func (t *Templates) execute(w io.Writer, name string, data any) error {
+	return t.current.Load().ExecuteTemplate(w, name, data)
+}
+
+// Serves files from primary, falling back to fallback for files which don't exist there.
+type overlayFS struct {
+	primary, fallback fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.primary.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.fallback.Open(name)
+	}
+	return f, err
+}
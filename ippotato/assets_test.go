@@ -0,0 +1,64 @@
+package ippotato
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplateOverrides(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("index.html", `<p>Hello {{.ip}}</p>`)
+	write("logo.png", "override")
+
+	templates, err := LoadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(Options{Templates: templates, StaticDir: dir})
+	get := func(target string) string {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("Accept", "text/html")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	if got := get("/"); got != "<p>Hello 192.0.2.10</p>" {
+		t.Errorf("got %q, want the overridden index", got)
+	}
+	if got := get("/headers"); !strings.Contains(got, "Your Request Headers") {
+		t.Errorf("got %q, want the embedded template of a page which isn't overridden", got)
+	}
+	if got := get("/static/logo.png"); got != "override" {
+		t.Errorf("got %q, want the file of the static directory", got)
+	}
+	if got := get("/static/favicon.ico"); got == "" || strings.Contains(got, "404") {
+		t.Errorf("got %q, want the embedded favicon", got)
+	}
+
+	write("index.html", `<p>Reloaded</p>`)
+	if err := templates.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("/"); got != "<p>Reloaded</p>" {
+		t.Errorf("got %q after reloading, want the edited index", got)
+	}
+	write("index.html", `{{if}}`)
+	if err := templates.Reload(); err == nil {
+		t.Error("reloaded a broken template, want an error")
+	}
+	if got := get("/"); got != "<p>Reloaded</p>" {
+		t.Errorf("got %q after a failed reload, want the templates loaded before", got)
+	}
+}
@@ -0,0 +1,112 @@
+package ippotato
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The routing information currently announced for an address, as seen by a looking glass.
+type bgpInfo struct {
+	Prefix      string `json:"prefix"`
+	OriginASNs  []int  `json:"origin_asns"`
+	Attribution string `json:"attribution"`
+}
+
+// Looks up the covering prefix and origin AS of an address using a RIPEstat compatible
+// data API (https://stat.ripe.net/docs/data_api). Successful lookups are cached since
+// announcements rarely change from one minute to the next.
+type bgpClient struct {
+	baseURL     string
+	attribution string
+	httpClient  *http.Client
+	cache       *ttlCache[string, *bgpInfo]
+}
+
+func newBGPClient(baseURL, attribution string, timeout, cacheTTL time.Duration) *bgpClient {
+	return &bgpClient{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		attribution: attribution,
+		httpClient:  &http.Client{Timeout: timeout},
+		cache:       newTTLCache[string, *bgpInfo](cacheTTL, 10000),
+	}
+}
+
+func (c *bgpClient) Lookup(ctx context.Context, ip string) (*bgpInfo, error) {
+	if info, ok := c.cache.Get(ip); ok {
+		return info, nil
+	}
+
+	query := url.Values{}
+	query.Set("resource", ip)
+	query.Set("sourceapp", "ip-potato")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/data/network-info/data.json?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("looking glass returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Status string `json:"status"`
+		Data   struct {
+			ASNs   []string `json:"asns"`
+			Prefix string   `json:"prefix"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Status != "ok" {
+		return nil, fmt.Errorf("looking glass returned status %q", body.Status)
+	}
+
+	info := &bgpInfo{
+		Prefix:      body.Data.Prefix,
+		OriginASNs:  make([]int, 0, len(body.Data.ASNs)),
+		Attribution: c.attribution,
+	}
+	for _, asn := range body.Data.ASNs {
+		n, err := strconv.Atoi(strings.TrimPrefix(asn, "AS"))
+		if err != nil {
+			return nil, fmt.Errorf("looking glass returned invalid asn %q", asn)
+		}
+		info.OriginASNs = append(info.OriginASNs, n)
+	}
+	c.cache.Set(ip, info)
+	return info, nil
+}
+
+func (s *service) handleBGPReq(w http.ResponseWriter, req *http.Request) {
+	ip := s.proxies.clientIP(req)
+	if ip == "" {
+		s.writeError(w, req, http.StatusBadRequest, "unable to determine client ip")
+		return
+	}
+	info, err := s.bgp.Lookup(req.Context(), ip)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			slog.Error("failed to look up bgp information", slog.String("ip", ip), slog.Any("error", err))
+		}
+		s.writeError(w, req, http.StatusBadGateway, "routing information is currently unavailable")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		IP string `json:"ip"`
+		*bgpInfo
+	}{ip, info})
+}
@@ -0,0 +1,51 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// A connection only ever has one address family, so /both reports the address of the
+// connection it is fetched over and where to fetch it over the other family. Pages fetch it
+// from both single stack hostnames and merge the answers, a failure of the IPv6 one telling
+// the client it has no working IPv6.
+type bothInfo struct {
+	IPv4    string `json:"ipv4,omitempty"`
+	IPv6    string `json:"ipv6,omitempty"`
+	IPv4URL string `json:"ipv4_url"`
+	IPv6URL string `json:"ipv6_url"`
+}
+
+// The /both URLs of the single stack hostnames, empty unless both are configured.
+type dualStackURLs struct {
+	ipv4, ipv6 string
+}
+
+func newDualStackURLs(ipv4URL, ipv6URL string) dualStackURLs {
+	if ipv4URL == "" || ipv6URL == "" {
+		return dualStackURLs{}
+	}
+	return dualStackURLs{
+		ipv4: strings.TrimSuffix(ipv4URL, "/") + "/both",
+		ipv6: strings.TrimSuffix(ipv6URL, "/") + "/both",
+	}
+}
+
+func (u dualStackURLs) enabled() bool {
+	return u.ipv4 != ""
+}
+
+func (s *service) handleBothReq(w http.ResponseWriter, req *http.Request) {
+	info := bothInfo{IPv4URL: s.dualStack.ipv4, IPv6URL: s.dualStack.ipv6}
+	if ip, err := netip.ParseAddr(RealIP(req)); err == nil {
+		if ip = ip.Unmap(); ip.Is4() {
+			info.IPv4 = ip.String()
+		} else {
+			info.IPv6 = ip.String()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,68 @@
+package ippotato
+
+import (
+	"sync"
+	"time"
+)
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// A small, concurrency safe cache with a per-entry expiry. Once the cache holds maxEntries
+// values, expired entries are swept and, if that isn't enough, an arbitrary entry is evicted
+// to make room.
+type ttlCache[K comparable, V any] struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[K]cacheEntry[V]
+}
+
+func newTTLCache[K comparable, V any](ttl time.Duration, maxEntries int) *ttlCache[K, V] {
+	return &ttlCache[K, V]{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[K]cacheEntry[V]),
+	}
+}
+
+func (c *ttlCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// Stores the value using the default ttl of the cache.
+func (c *ttlCache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.ttl)
+}
+
+func (c *ttlCache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.maxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry[V]{value: value, expires: now.Add(ttl)}
+}
@@ -0,0 +1,60 @@
+package ippotato
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+type connContextKey struct{}
+
+// State kept for every accepted connection, shared by all requests arriving on it.
+type connState struct {
+	conn     net.Conn
+	requests atomic.Int64
+
+	synOnce sync.Once
+	syn     *tcpSYNInfo
+}
+
+// ConnContext stores the accepted connection in the context of its requests, for handlers
+// which report details of the connection rather than the request. Use it as the ConnContext
+// of the http.Server serving Handler.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, &connState{conn: conn})
+}
+
+// Numbers the requests of each connection, so handlers can tell whether a connection was
+// reused. Requests count from 1.
+func countConnRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if state, ok := req.Context().Value(connContextKey{}).(*connState); ok {
+			n := state.requests.Add(1)
+			req = req.WithContext(context.WithValue(req.Context(), connRequestKey{}, n))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+type connRequestKey struct{}
+
+// Returns 0 if the number of the request on its connection is unknown.
+func connRequestNumber(req *http.Request) int64 {
+	n, _ := req.Context().Value(connRequestKey{}).(int64)
+	return n
+}
+
+// Returns the connection the request arrived on, below any TLS layer.
+func requestNetConn(req *http.Request) net.Conn {
+	state, ok := req.Context().Value(connContextKey{}).(*connState)
+	if !ok {
+		return nil
+	}
+	if tlsConn, ok := state.conn.(*tls.Conn); ok {
+		return tlsConn.NetConn()
+	}
+	return state.conn
+}
@@ -0,0 +1,281 @@
+package ippotato
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DatasetInfo describes the version of a data file which has been loaded.
+type DatasetInfo struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Entries  int       `json:"entries"`
+
+	SHA256        string `json:"sha256,omitempty"`
+	Verified      bool   `json:"verified"`
+	LastKnownGood bool   `json:"last_known_good,omitempty"`
+}
+
+// A DatasetVerifier checks datasets before they are loaded. Checksums are read from a
+// sha256sum style sidecar next to the dataset (path + ".sha256"), signatures from a base64
+// encoded Ed25519 signature of the whole file (path + ".sig").
+type DatasetVerifier struct {
+	// Refuse datasets without a checksum, rather than only checking those which have one.
+	RequireChecksum bool
+	// If set, datasets must be signed with the corresponding private key.
+	PublicKey ed25519.PublicKey
+}
+
+// The datasets in use by handlers, process wide like the metrics they are exported as.
+type datasetRegistry struct {
+	mu     sync.Mutex
+	loaded map[string]DatasetInfo
+}
+
+var datasets = &datasetRegistry{loaded: map[string]DatasetInfo{}}
+
+func init() {
+	newGaugeVecFunc("ippotato_dataset_age_seconds", "Time since each loaded dataset was last modified in seconds.", "dataset", func() map[string]float64 {
+		ages := map[string]float64{}
+		for _, d := range datasets.list() {
+			ages[d.Name] = time.Since(d.Modified).Seconds()
+		}
+		return ages
+	})
+}
+
+// ParseDatasetPublicKey decodes a base64 encoded Ed25519 public key for DatasetVerifier.
+func ParseDatasetPublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dataset public key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid dataset public key: expected %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Reads a dataset in one go, so the bytes which are verified are the ones which are loaded
+// and kept, even if the file is replaced in the meantime.
+func readDataset(path string) ([]byte, fs.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	contents, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return contents, stat, nil
+}
+
+// Checks the contents of the file at path against its checksum and signature. A missing
+// checksum is only an error if checksums are required, a missing signature whenever a public
+// key is configured. Returns the hex encoded sha256 of the contents and whether anything
+// vouched for them.
+func (v DatasetVerifier) verify(path string, contents []byte) (string, bool, error) {
+	sum := sha256.Sum256(contents)
+	digest := hex.EncodeToString(sum[:])
+
+	verified := false
+	sidecar, err := os.ReadFile(path + ".sha256")
+	switch {
+	case err == nil:
+		want, _, _ := strings.Cut(strings.TrimSpace(string(sidecar)), " ")
+		if !strings.EqualFold(want, digest) {
+			return digest, false, fmt.Errorf("%s: checksum mismatch, expected %s but the file hashes to %s", path, want, digest)
+		}
+		verified = true
+	case errors.Is(err, fs.ErrNotExist):
+		if v.RequireChecksum {
+			return digest, false, fmt.Errorf("%s: no checksum found at %s.sha256", path, path)
+		}
+	default:
+		return digest, false, err
+	}
+
+	if v.PublicKey != nil {
+		encoded, err := os.ReadFile(path + ".sig")
+		if err != nil {
+			return digest, false, fmt.Errorf("%s: reading signature: %w", path, err)
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || !ed25519.Verify(v.PublicKey, contents, sig) {
+			return digest, false, fmt.Errorf("%s: invalid signature", path)
+		}
+		verified = true
+	}
+	return digest, verified, nil
+}
+
+// The last-known-good copy is kept next to the dataset as a hidden file, keeping the original
+// name so loaders can still recognise e.g. compressed files by their extension.
+func lastKnownGoodPath(path string) string {
+	return filepath.Join(filepath.Dir(path), ".last-known-good."+filepath.Base(path))
+}
+
+// Keeps the contents of a dataset which loaded successfully. The copy only gets a checksum,
+// and the signature of the dataset, if the dataset was verified, so the verifier vouches for
+// the copy exactly when it vouched for the original. The modification time is preserved since
+// it is what the age of a dataset is measured from.
+func saveLastKnownGood(path string, contents []byte, modified time.Time, digest string, verified bool) error {
+	lkg := lastKnownGoodPath(path)
+	if err := writeFileAtomic(lkg, contents); err != nil {
+		return err
+	}
+	if err := os.Chtimes(lkg, time.Time{}, modified); err != nil {
+		return err
+	}
+	if !verified {
+		// Don't let the sidecars of an earlier, verified copy vouch for this one
+		for _, sidecar := range []string{lkg + ".sha256", lkg + ".sig"} {
+			if err := os.Remove(sidecar); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	}
+	sig, err := os.ReadFile(path + ".sig")
+	switch {
+	case err == nil:
+		err = writeFileAtomic(lkg+".sig", sig)
+	case errors.Is(err, fs.ErrNotExist):
+		err = os.Remove(lkg + ".sig")
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(lkg+".sha256", []byte(digest+"  "+filepath.Base(lkg)+"\n"), 0o644)
+}
+
+func writeFileAtomic(path string, contents []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadASNDB verifies and loads an ASN database, see the package level LoadASNDB for its
+// format.
+func (v DatasetVerifier) LoadASNDB(path string) (*ASNDB, error) {
+	return loadDataset(v, path, readASNDB, (*ASNDB).dataset)
+}
+
+// Parses a dataset from its contents, path names it and stat describes the file they were
+// read from.
+type datasetLoader[T any] func(path string, r io.Reader, stat fs.FileInfo) (T, error)
+
+// Verifies and loads the dataset at path. If it fails verification or doesn't load, the
+// last-known-good copy from an earlier successful load is loaded instead, so a corrupt or
+// tampered download doesn't take the service down. The info of the loaded dataset is updated
+// with the outcome.
+func loadDataset[T any](verifier DatasetVerifier, path string, load datasetLoader[T], info func(T) *DatasetInfo) (T, error) {
+	var v T
+	contents, stat, err := readDataset(path)
+	if err == nil {
+		var digest string
+		var verified bool
+		if digest, verified, err = verifier.verify(path, contents); err == nil {
+			if v, err = load(path, bytes.NewReader(contents), stat); err == nil {
+				if err := saveLastKnownGood(path, contents, stat.ModTime(), digest, verified); err != nil {
+					slog.Warn("failed to keep a last-known-good copy of dataset", slog.String("path", path), slog.Any("error", err))
+				}
+				setIntegrity(info(v), digest, verified, false)
+				return v, nil
+			}
+		}
+	}
+
+	lkg := lastKnownGoodPath(path)
+	lkgContents, lkgStat, lkgErr := readDataset(lkg)
+	if errors.Is(lkgErr, fs.ErrNotExist) {
+		return v, err
+	}
+	slog.Error("failed to load dataset, falling back to the last-known-good copy", slog.String("path", path), slog.Any("error", err))
+	if lkgErr != nil {
+		return v, errors.Join(err, lkgErr)
+	}
+	// The copy has a checksum and a signature only if the dataset it was saved from was
+	// verified, so it is held to the same requirements
+	lkgDigest, lkgVerified, lkgErr := verifier.verify(lkg, lkgContents)
+	if lkgErr != nil {
+		return v, errors.Join(err, lkgErr)
+	}
+	if v, lkgErr = load(lkg, bytes.NewReader(lkgContents), lkgStat); lkgErr != nil {
+		return v, errors.Join(err, lkgErr)
+	}
+	setIntegrity(info(v), lkgDigest, lkgVerified, true)
+	return v, nil
+}
+
+func setIntegrity(info *DatasetInfo, digest string, verified, lastKnownGood bool) {
+	info.SHA256, info.Verified, info.LastKnownGood = digest, verified, lastKnownGood
+}
+
+func (s *datasetRegistry) register(info DatasetInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loaded[info.Name] = info
+}
+
+func (s *datasetRegistry) list() []DatasetInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]DatasetInfo, 0, len(s.loaded))
+	for _, d := range s.loaded {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Lists the loaded datasets on the admin server, with the version (checksum) and age of each.
+func handleDatasetsReq(w http.ResponseWriter, _ *http.Request) {
+	type dataset struct {
+		DatasetInfo
+		AgeSeconds int64 `json:"age_seconds"`
+	}
+	list := datasets.list()
+	resp := make([]dataset, len(list))
+	for i, d := range list {
+		resp[i] = dataset{DatasetInfo: d, AgeSeconds: int64(time.Since(d.Modified).Seconds())}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
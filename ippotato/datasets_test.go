@@ -0,0 +1,212 @@
+package ippotato
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testDatasetGood  = "192.0.2.0\t192.0.2.255\t64496\tZZ\tEXAMPLE-AS\n"
+	testDatasetNewer = "192.0.2.0\t192.0.2.255\t64497\tZZ\tNEWER-AS\n"
+)
+
+func writeTestDataset(t *testing.T, path, contents string, key ed25519.PrivateKey) {
+	t.Helper()
+	sum := sha256.Sum256([]byte(contents))
+	files := map[string]string{
+		path:             contents,
+		path + ".sha256": hex.EncodeToString(sum[:]) + "  " + filepath.Base(path) + "\n",
+	}
+	if key != nil {
+		files[path+".sig"] = base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(contents))) + "\n"
+	}
+	for name, data := range files {
+		if err := os.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadDataset(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := DatasetVerifier{RequireChecksum: true, PublicKey: public}
+
+	tests := []struct {
+		name string
+		// Replaces the verified dataset loaded first.
+		replace       func(t *testing.T, path string)
+		wantAS        int
+		lastKnownGood bool
+		wantErr       string
+	}{
+		{
+			name:    "newer dataset",
+			replace: func(t *testing.T, path string) { writeTestDataset(t, path, testDatasetNewer, private) },
+			wantAS:  64497,
+		},
+		{
+			name: "checksum mismatch",
+			replace: func(t *testing.T, path string) {
+				writeTestDataset(t, path, testDatasetNewer, private)
+				if err := os.WriteFile(path, []byte(strings.ReplaceAll(testDatasetNewer, "64497", "64498")), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantAS:        64496,
+			lastKnownGood: true,
+		},
+		{
+			name:          "bad signature",
+			replace:       func(t *testing.T, path string) { writeTestDataset(t, path, testDatasetNewer, otherKey) },
+			wantAS:        64496,
+			lastKnownGood: true,
+		},
+		{
+			name: "unparseable dataset",
+			replace: func(t *testing.T, path string) {
+				writeTestDataset(t, path, "not\ta\tdataset\n", private)
+			},
+			wantAS:        64496,
+			lastKnownGood: true,
+		},
+		{
+			name: "corrupt last-known-good copy",
+			replace: func(t *testing.T, path string) {
+				writeTestDataset(t, path, testDatasetNewer, otherKey)
+				if err := os.WriteFile(lastKnownGoodPath(path), []byte(testDatasetNewer), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "invalid signature",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "asn.tsv")
+			writeTestDataset(t, path, testDatasetGood, private)
+			db, err := verifier.LoadASNDB(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info := db.Info(); !info.Verified || info.LastKnownGood {
+				t.Fatalf("unexpected info of the first load %+v", info)
+			}
+			saved, err := os.ReadFile(lastKnownGoodPath(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(saved) != testDatasetGood {
+				t.Fatalf("kept %q as last-known-good, want the verified contents", saved)
+			}
+
+			tt.replace(t, path)
+			db, err = verifier.LoadASNDB(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			as := db.Lookup("192.0.2.1")
+			if as == nil || as.Number != tt.wantAS {
+				t.Fatalf("looked up %+v, want AS%d", as, tt.wantAS)
+			}
+			if info := db.Info(); info.LastKnownGood != tt.lastKnownGood || !info.Verified {
+				t.Errorf("unexpected info %+v", info)
+			}
+			saved, err = os.ReadFile(lastKnownGoodPath(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[bool]string{true: testDatasetGood, false: testDatasetNewer}[tt.lastKnownGood]; string(saved) != want {
+				t.Errorf("kept %q as last-known-good, want %q", saved, want)
+			}
+		})
+	}
+}
+
+func TestLoadDatasetWithoutLastKnownGood(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asn.tsv")
+	writeTestDataset(t, path, testDatasetGood, nil)
+	if err := os.WriteFile(path, []byte(testDatasetNewer), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (DatasetVerifier{}).LoadASNDB(path); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(lastKnownGoodPath(path)); err == nil {
+		t.Error("kept a last-known-good copy of a dataset which failed verification")
+	}
+}
+
+// A copy of a dataset which nothing vouched for isn't reported as verified when it is fallen
+// back to, and isn't used at all once datasets need a signature.
+func TestLoadDatasetUnverifiedLastKnownGood(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "asn.tsv")
+	if err := os.WriteFile(path, []byte(testDatasetGood), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := (DatasetVerifier{}).LoadASNDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := db.Info(); info.Verified {
+		t.Fatalf("a dataset without a checksum or signature was reported verified: %+v", info)
+	}
+
+	if err := os.WriteFile(path, []byte("not\ta\tdataset\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, err = (DatasetVerifier{}).LoadASNDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := db.Info(); !info.LastKnownGood || info.Verified {
+		t.Errorf("expected an unverified last-known-good copy, got %+v", info)
+	}
+	if _, err := (DatasetVerifier{PublicKey: public}).LoadASNDB(path); err == nil {
+		t.Error("fell back to an unsigned copy although datasets need a signature")
+	}
+}
+
+// The digest is computed over the bytes which are loaded and kept, not whatever the file
+// holds by the time it is read again.
+func TestVerifyUsesTheGivenContents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asn.tsv")
+	writeTestDataset(t, path, testDatasetGood, nil)
+	if err := os.WriteFile(path, []byte(testDatasetNewer), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	digest, verified, err := DatasetVerifier{RequireChecksum: true}.verify(path, []byte(testDatasetGood))
+	if err != nil || !verified {
+		t.Fatalf("expected the given contents to verify, got %v", err)
+	}
+	sum := sha256.Sum256([]byte(testDatasetGood))
+	if digest != hex.EncodeToString(sum[:]) {
+		t.Errorf("digest %s isn't the one of the given contents", digest)
+	}
+	if _, _, err := (DatasetVerifier{}).verify(path, []byte(testDatasetNewer)); err == nil {
+		t.Error("expected other contents to fail verification")
+	}
+}
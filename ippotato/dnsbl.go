@@ -0,0 +1,168 @@
+package ippotato
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The result of checking an address against one DNSBL.
+type dnsblResult struct {
+	Zone   string `json:"zone"`
+	Listed bool   `json:"listed"`
+	// The return codes of a listing, which many lists use to tell why the address is listed.
+	Codes []string `json:"codes,omitempty"`
+	// The TXT record of a listing, usually a URL explaining it.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Checks addresses against DNS based blocklists. An address is listed if the list has an A
+// record for its reversed octets (or nibbles, for IPv6) below the zone of the list.
+type dnsblChecker struct {
+	zones    []string
+	resolver Resolver
+	timeout  time.Duration
+	cache    *ttlCache[string, []dnsblResult]
+}
+
+func newDNSBLChecker(zones []string, resolver Resolver, timeout, cacheTTL time.Duration) *dnsblChecker {
+	return &dnsblChecker{
+		zones:    zones,
+		resolver: resolver,
+		timeout:  timeout,
+		cache:    newTTLCache[string, []dnsblResult](cacheTTL, 10000),
+	}
+}
+
+// Checks the address against every list in parallel, returning the results in the order the
+// lists are configured. Lists which fail or don't answer in time are reported with an error.
+func (c *dnsblChecker) Check(ctx context.Context, ip netip.Addr) []dnsblResult {
+	ip = ip.Unmap()
+	if results, ok := c.cache.Get(ip.String()); ok {
+		return results
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	results := make([]dnsblResult, len(c.zones))
+	var wg sync.WaitGroup
+	for i, zone := range c.zones {
+		wg.Add(1)
+		go func(i int, zone string) {
+			defer wg.Done()
+			results[i] = c.checkZone(ctx, ip, zone)
+		}(i, zone)
+	}
+	wg.Wait()
+
+	// Failed checks aren't cached, so a list which was down is asked again on the next request
+	for _, r := range results {
+		if r.Error != "" {
+			return results
+		}
+	}
+	c.cache.Set(ip.String(), results)
+	return results
+}
+
+func (c *dnsblChecker) checkZone(ctx context.Context, ip netip.Addr, zone string) dnsblResult {
+	result := dnsblResult{Zone: zone}
+	name := reverseLabels(ip) + strings.TrimSuffix(zone, ".") + "."
+	addrs, err := c.resolver.LookupHost(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return result
+	}
+	if err != nil {
+		slog.Warn("failed to check dnsbl", slog.String("zone", zone), slog.String("ip", ip.String()), slog.Any("error", err))
+		result.Error = lookupErrorMessage(err)
+		return result
+	}
+	for _, addr := range addrs {
+		code, err := netip.ParseAddr(addr)
+		if err != nil || !code.Is4() {
+			continue
+		}
+		// Answers in 127.255.255.0/24 are errors, e.g. Spamhaus refusing queries through open
+		// resolvers, rather than listings
+		if dnsblErrorCodes.Contains(code) {
+			slog.Warn("dnsbl refused the query", slog.String("zone", zone), slog.String("code", addr))
+			result.Error = "query refused by the list"
+			return result
+		}
+		result.Codes = append(result.Codes, addr)
+	}
+	result.Listed = len(result.Codes) > 0
+	if result.Listed {
+		if txts, err := c.resolver.LookupTXT(ctx, name); err == nil && len(txts) > 0 {
+			result.Reason = txts[0]
+		}
+	}
+	return result
+}
+
+var dnsblErrorCodes = netip.MustParsePrefix("127.255.255.0/24")
+
+func (s *service) dnsblHandler() http.HandlerFunc {
+	return Negotiate(map[string]http.HandlerFunc{
+		"application/json": s.handleDNSBLJSONReq,
+	}, s.handleDNSBLTextReq)
+}
+
+// Checks the client address against the configured lists. Returns false if the address isn't
+// valid, after responding with an error.
+func (s *service) checkDNSBL(w http.ResponseWriter, req *http.Request) (netip.Addr, []dnsblResult, bool) {
+	ip, err := netip.ParseAddr(s.proxies.clientIP(req))
+	if err != nil {
+		s.writeError(w, req, http.StatusBadRequest, "unable to determine client ip")
+		return ip, nil, false
+	}
+	return ip, s.dnsbl.Check(req.Context(), ip), true
+}
+
+func (s *service) handleDNSBLJSONReq(w http.ResponseWriter, req *http.Request) {
+	ip, results, ok := s.checkDNSBL(w, req)
+	if !ok {
+		return
+	}
+	listed := false
+	for _, r := range results {
+		listed = listed || r.Listed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ip":     ip.String(),
+		"listed": listed,
+		"lists":  results,
+	})
+}
+
+func (s *service) handleDNSBLTextReq(w http.ResponseWriter, req *http.Request) {
+	_, results, ok := s.checkDNSBL(w, req)
+	if !ok {
+		return
+	}
+	lines := make([]string, len(results))
+	for i, r := range results {
+		switch {
+		case r.Error != "":
+			lines[i] = r.Zone + ": " + r.Error
+		case r.Listed:
+			lines[i] = r.Zone + ": listed (" + strings.Join(r.Codes, ", ") + ")"
+			if r.Reason != "" {
+				lines[i] += " " + r.Reason
+			}
+		default:
+			lines[i] = r.Zone + ": not listed"
+		}
+	}
+	s.writeText(w, req, lines...)
+}
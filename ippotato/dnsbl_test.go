@@ -0,0 +1,65 @@
+package ippotato
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Answers from a map of names, every other name doesn't exist. Names mapped to nil fail.
+type fakeResolver struct {
+	hosts map[string][]string
+	txts  map[string][]string
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, name string) ([]string, error) {
+	addrs, ok := r.hosts[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if addrs == nil {
+		return nil, errors.New("server misbehaving")
+	}
+	return addrs, nil
+}
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.txts[name], nil
+}
+
+func (r fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestDNSBLCheck(t *testing.T) {
+	resolver := fakeResolver{
+		hosts: map[string][]string{
+			"2.0.0.127.listed.example.":  {"127.0.0.2", "127.0.0.4"},
+			"2.0.0.127.refused.example.": {"127.255.255.254"},
+			"2.0.0.127.broken.example.":  nil,
+		},
+		txts: map[string][]string{
+			"2.0.0.127.listed.example.": {"https://listed.example/query/127.0.0.2"},
+		},
+	}
+	zones := []string{"listed.example", "clean.example.", "refused.example", "broken.example"}
+	checker := newDNSBLChecker(zones, resolver, time.Second, time.Minute)
+
+	got := checker.Check(context.Background(), netip.MustParseAddr("::ffff:127.0.0.2"))
+	want := []dnsblResult{
+		{Zone: "listed.example", Listed: true, Codes: []string{"127.0.0.2", "127.0.0.4"}, Reason: "https://listed.example/query/127.0.0.2"},
+		{Zone: "clean.example."},
+		{Zone: "refused.example", Error: "query refused by the list"},
+		{Zone: "broken.example", Error: "lookup failed"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if _, ok := checker.cache.Get("127.0.0.2"); ok {
+		t.Error("results with failed lists are cached, want them to be checked again")
+	}
+}
@@ -0,0 +1,358 @@
+package ippotato
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	dnsQueries       = newCounterVec("ippotato_dns_queries_total", "Number of DNS queries answered, by transport and response code.", "transport", "rcode")
+	dnsConnsRejected = newCounterVec("ippotato_dns_connections_rejected_total", "Number of DNS connections over TCP closed since too many were open at once.")
+	dnsRateLimited   = newCounterVec("ippotato_dns_rate_limited_total", "Number of DNS queries over UDP dropped since their source exceeded its rate limit.")
+)
+
+// TCP connections served at once, beyond which new ones are closed right away rather than
+// queued, since every connection may be held open until it goes idle.
+const maxConcurrentDNSConns = 256
+
+// DNSServer is a small authoritative DNS server answering every A, AAAA and TXT query within
+// its zone with the address of whoever sent the query, usually the recursive resolver of the
+// client. This lets users discover their resolver's egress address with dig, like
+// whoami.akamai.net. TXT answers also include the client subnet the resolver disclosed, if
+// any. Since UDP sources can be spoofed, answers over UDP are rate limited by source address
+// so the server can't be used to flood a third party. Resolvers which are limited can still
+// retry over TCP.
+type DNSServer struct {
+	zone     string
+	ttl      uint32
+	udpConn  net.PacketConn
+	tcpLn    net.Listener
+	limiter  *rateLimiter
+	tcpConns chan struct{}
+}
+
+// ListenDNS binds both UDP and TCP on the address for a DNS server answering queries within
+// zone. The zone is normalised to a fully qualified, lower case name. Each source address is
+// answered rate queries per second over UDP after an initial burst, a rate of zero leaves
+// them unlimited.
+func ListenDNS(addr, zone string, ttl time.Duration, rate float64, burst int) (*DNSServer, error) {
+	zone = strings.ToLower(strings.TrimSuffix(zone, ".")) + "."
+	if zone == "." {
+		return nil, errors.New("a zone is required to serve DNS")
+	}
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tcpLn, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	s := &DNSServer{zone: zone, ttl: uint32(ttl.Seconds()), udpConn: udpConn, tcpLn: tcpLn, tcpConns: make(chan struct{}, maxConcurrentDNSConns)}
+	if rate > 0 {
+		s.limiter = newRateLimiter(rate, burst)
+	}
+	return s, nil
+}
+
+// Addr returns the address the server is bound to.
+func (s *DNSServer) Addr() string {
+	return s.udpConn.LocalAddr().String()
+}
+
+// Serve answers queries until the context expires.
+func (s *DNSServer) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.udpConn.Close()
+		s.tcpLn.Close()
+	}()
+	go s.serveTCP()
+	s.serveUDP()
+}
+
+func (s *DNSServer) serveUDP() {
+	buf := make([]byte, 65535)
+	var retry retryDelay
+	for {
+		n, addr, err := s.udpConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			wait := retry.next()
+			slog.Error("failed to read DNS query", slog.Any("error", err), slog.Duration("retry_in", wait))
+			time.Sleep(wait)
+			continue
+		}
+		retry.reset()
+		source := addrOf(addr)
+		if s.limiter != nil {
+			if ok, _ := s.limiter.Allow(source.String()); !ok {
+				dnsRateLimited.Inc()
+				continue
+			}
+		}
+		resp, rcode, err := s.answer(buf[:n], source)
+		if err != nil {
+			continue
+		}
+		dnsQueries.Inc("udp", rcode.String())
+		_, _ = s.udpConn.WriteTo(resp, addr)
+	}
+}
+
+func (s *DNSServer) serveTCP() {
+	var retry retryDelay
+	for {
+		conn, err := s.tcpLn.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			wait := retry.next()
+			slog.Error("failed to accept DNS connection", slog.Any("error", err), slog.Duration("retry_in", wait))
+			time.Sleep(wait)
+			continue
+		}
+		retry.reset()
+		select {
+		case s.tcpConns <- struct{}{}:
+			go func() {
+				defer func() { <-s.tcpConns }()
+				s.handleTCPConn(conn)
+			}()
+		default:
+			dnsConnsRejected.Inc()
+			conn.Close()
+		}
+	}
+}
+
+// Answers length prefixed queries (RFC 1035 section 4.2.2) until the client goes idle.
+func (s *DNSServer) handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(r, query); err != nil {
+			return
+		}
+		resp, rcode, err := s.answer(query, addrOf(conn.RemoteAddr()))
+		if err != nil {
+			return
+		}
+		dnsQueries.Inc("tcp", rcode.String())
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+func addrOf(addr net.Addr) netip.Addr {
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+		return ap.Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// Builds the response to a query. Queries which can't even be parsed far enough to respond
+// are dropped by returning an error.
+func (s *DNSServer) answer(query []byte, source netip.Addr) ([]byte, dnsmessage.RCode, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.Response {
+		return nil, 0, errors.New("received a response instead of a query")
+	}
+	respHeader := dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		OpCode:           header.OpCode,
+		Authoritative:    true,
+		RecursionDesired: header.RecursionDesired,
+	}
+	question, err := p.Question()
+	if err != nil || header.OpCode != 0 {
+		respHeader.Authoritative = false
+		respHeader.RCode = dnsmessage.RCodeFormatError
+		if header.OpCode != 0 {
+			respHeader.RCode = dnsmessage.RCodeNotImplemented
+		}
+		b := dnsmessage.NewBuilder(nil, respHeader)
+		resp, err := b.Finish()
+		return resp, respHeader.RCode, err
+	}
+	_ = p.SkipAllQuestions()
+	_ = p.SkipAllAnswers()
+	_ = p.SkipAllAuthorities()
+	var edns *dnsmessage.OPTResource
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			break
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			if opt, err := p.OPTResource(); err == nil {
+				edns = &opt
+			}
+			break
+		}
+		_ = p.SkipAdditional()
+	}
+	var ecs *clientSubnet
+	if edns != nil {
+		ecs = findClientSubnet(edns.Options)
+	}
+
+	name := strings.ToLower(question.Name.String())
+	if name != s.zone && !strings.HasSuffix(name, "."+s.zone) {
+		respHeader.Authoritative = false
+		respHeader.RCode = dnsmessage.RCodeRefused
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), respHeader)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(question); err != nil {
+		return nil, 0, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, 0, err
+	}
+	answered := false
+	if respHeader.RCode == dnsmessage.RCodeSuccess && question.Class == dnsmessage.ClassINET {
+		rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+		switch {
+		case question.Type == dnsmessage.TypeA && source.Is4():
+			err, answered = b.AResource(rh, dnsmessage.AResource{A: source.As4()}), true
+		case question.Type == dnsmessage.TypeAAAA && source.Is6():
+			err, answered = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: source.As16()}), true
+		case question.Type == dnsmessage.TypeTXT:
+			err, answered = b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{source.String()}}), true
+			if err == nil && ecs != nil {
+				err = b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{"edns0-client-subnet " + ecs.prefix.String()}})
+			}
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := b.StartAuthorities(); err != nil {
+		return nil, 0, err
+	}
+	// Negative answers carry the SOA of the zone so resolvers know how long to cache them
+	if respHeader.RCode == dnsmessage.RCodeSuccess && !answered {
+		if err := b.SOAResource(s.soaHeader(), s.soa()); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, 0, err
+	}
+	if edns != nil {
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(1232, respHeader.RCode, false); err != nil {
+			return nil, 0, err
+		}
+		var options []dnsmessage.Option
+		if ecs != nil {
+			options = append(options, ecs.option())
+		}
+		if err := b.OPTResource(opt, dnsmessage.OPTResource{Options: options}); err != nil {
+			return nil, 0, err
+		}
+	}
+	resp, err := b.Finish()
+	return resp, respHeader.RCode, err
+}
+
+func (s *DNSServer) soaHeader() dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{
+		Name:  dnsmessage.MustNewName(s.zone),
+		Type:  dnsmessage.TypeSOA,
+		Class: dnsmessage.ClassINET,
+		TTL:   s.ttl,
+	}
+}
+
+func (s *DNSServer) soa() dnsmessage.SOAResource {
+	return dnsmessage.SOAResource{
+		NS:      dnsmessage.MustNewName(s.zone),
+		MBox:    dnsmessage.MustNewName("hostmaster." + s.zone),
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		MinTTL:  s.ttl,
+	}
+}
+
+// The EDNS Client Subnet option (RFC 7871), which resolvers may add to disclose a prefix of
+// the address of their client.
+type clientSubnet struct {
+	family uint16
+	prefix netip.Prefix
+}
+
+const optionClientSubnet = 8
+
+func findClientSubnet(options []dnsmessage.Option) *clientSubnet {
+	for _, o := range options {
+		if o.Code != optionClientSubnet || len(o.Data) < 4 {
+			continue
+		}
+		family, sourceBits := binary.BigEndian.Uint16(o.Data), int(o.Data[2])
+		var addr [16]byte
+		if len(o.Data)-4 > len(addr) {
+			return nil
+		}
+		copy(addr[:], o.Data[4:])
+		var ip netip.Addr
+		switch family {
+		case 1:
+			ip = netip.AddrFrom4([4]byte(addr[:4]))
+		case 2:
+			ip = netip.AddrFrom16(addr)
+		default:
+			return nil
+		}
+		prefix, err := ip.Prefix(sourceBits)
+		if err != nil {
+			return nil
+		}
+		return &clientSubnet{family: family, prefix: prefix}
+	}
+	return nil
+}
+
+// Echoes the option back as required by the RFC. The scope covers the whole source prefix,
+// since the TXT answer differs for every prefix and must not be cached beyond it.
+func (ecs *clientSubnet) option() dnsmessage.Option {
+	bits := ecs.prefix.Bits()
+	data := binary.BigEndian.AppendUint16(nil, ecs.family)
+	data = append(data, byte(bits), byte(bits))
+	addr := ecs.prefix.Addr().AsSlice()
+	data = append(data, addr[:(bits+7)/8]...)
+	return dnsmessage.Option{Code: optionClientSubnet, Data: data}
+}
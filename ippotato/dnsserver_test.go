@@ -0,0 +1,363 @@
+package ippotato
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func dnsTestQuery(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x1234, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatal(err)
+	}
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func TestListenDNSRequiresAZone(t *testing.T) {
+	for _, zone := range []string{"", "."} {
+		if _, err := ListenDNS("127.0.0.1:0", zone, time.Minute, 0, 0); err == nil {
+			t.Errorf("expected zone %q to be refused", zone)
+		}
+	}
+	s, err := ListenDNS("127.0.0.1:0", "WhoAmI.Example.com.", time.Minute, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.udpConn.Close()
+	defer s.tcpLn.Close()
+	if s.zone != "whoami.example.com." {
+		t.Errorf("normalised the zone to %q", s.zone)
+	}
+	if s.tcpLn.Addr().String() != s.Addr() {
+		t.Errorf("listening on %s over TCP but %s over UDP", s.tcpLn.Addr(), s.Addr())
+	}
+}
+
+func TestDNSServerRateLimitsUDP(t *testing.T) {
+	server, err := ListenDNS("127.0.0.1:0", "whoami.example.com", time.Minute, 0.001, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx)
+
+	conn, err := net.Dial("udp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	query := dnsTestQuery(t, "whoami.example.com.", dnsmessage.TypeA)
+	answered := 0
+	buf := make([]byte, 1500)
+	for range 4 {
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := conn.Read(buf); err == nil {
+			answered++
+		}
+	}
+	if answered != 2 {
+		t.Errorf("answered %d queries, want the burst of 2", answered)
+	}
+
+	// TCP can't be spoofed, so a limited resolver can still get its answer
+	resolver := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", server.Addr())
+	}}
+	addrs, err := resolver.LookupHost(ctx, "whoami.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+		t.Errorf("resolved %v over TCP, want 127.0.0.1", addrs)
+	}
+}
+
+// Connections beyond the limit are closed, those within it are still answered, and the
+// listener keeps accepting after failing to.
+func TestDNSServerLimitsTCPConns(t *testing.T) {
+	server, err := ListenDNS("127.0.0.1:0", "whoami.example.com", time.Minute, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.tcpLn = &flakyListener{Listener: server.tcpLn, failures: 2}
+	server.tcpConns = make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx)
+
+	idle, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	// The idle connection holds the only slot once it has been answered
+	query := dnsTestQuery(t, "whoami.example.com.", dnsmessage.TypeA)
+	if _, err := idle.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+		t.Fatal(err)
+	}
+	_ = idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.Read(make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	_ = rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v reading from a connection beyond the limit, want it closed", err)
+	}
+}
+
+func TestDNSAnswer(t *testing.T) {
+	s := &DNSServer{zone: "whoami.example.com.", ttl: 60}
+	v4, v6 := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  dnsmessage.Type
+		source netip.Addr
+		rcode  dnsmessage.RCode
+		// The answers in presentation format, an SOA in the authority section for NODATA.
+		answers []string
+		soa     bool
+	}{
+		{name: "A", qname: "whoami.example.com.", qtype: dnsmessage.TypeA, source: v4, answers: []string{"A 192.0.2.1"}},
+		{name: "AAAA", qname: "whoami.example.com.", qtype: dnsmessage.TypeAAAA, source: v6, answers: []string{"AAAA 2001:db8::1"}},
+		{name: "TXT", qname: "whoami.example.com.", qtype: dnsmessage.TypeTXT, source: v6, answers: []string{"TXT 2001:db8::1"}},
+		{name: "subdomain in mixed case", qname: "Any.WHOAMI.example.com.", qtype: dnsmessage.TypeA, source: v4, answers: []string{"A 192.0.2.1"}},
+		{name: "AAAA for an IPv4 source", qname: "whoami.example.com.", qtype: dnsmessage.TypeAAAA, source: v4, soa: true},
+		{name: "A for an IPv6 source", qname: "whoami.example.com.", qtype: dnsmessage.TypeA, source: v6, soa: true},
+		{name: "other type", qname: "whoami.example.com.", qtype: dnsmessage.TypeMX, source: v4, soa: true},
+		{name: "outside the zone", qname: "example.com.", qtype: dnsmessage.TypeA, source: v4, rcode: dnsmessage.RCodeRefused},
+		{name: "suffix without a dot", qname: "notwhoami.example.com.", qtype: dnsmessage.TypeA, source: v4, rcode: dnsmessage.RCodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, rcode, err := s.answer(dnsTestQuery(t, tt.qname, tt.qtype), tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			if rcode != tt.rcode || msg.RCode != tt.rcode {
+				t.Errorf("answered %v (reported %v), want %v", msg.RCode, rcode, tt.rcode)
+			}
+			if msg.ID != 0x1234 || !msg.Response || !msg.RecursionDesired {
+				t.Errorf("unexpected header %+v", msg.Header)
+			}
+			if msg.Authoritative != (tt.rcode == dnsmessage.RCodeSuccess) {
+				t.Errorf("authoritative is %v", msg.Authoritative)
+			}
+			if len(msg.Questions) != 1 || !strings.EqualFold(msg.Questions[0].Name.String(), tt.qname) || msg.Questions[0].Type != tt.qtype {
+				t.Errorf("answered the question %+v", msg.Questions)
+			}
+			var answers []string
+			for _, rr := range msg.Answers {
+				if rr.Header.TTL != 60 {
+					t.Errorf("answered with TTL %d", rr.Header.TTL)
+				}
+				switch body := rr.Body.(type) {
+				case *dnsmessage.AResource:
+					answers = append(answers, "A "+netip.AddrFrom4(body.A).String())
+				case *dnsmessage.AAAAResource:
+					answers = append(answers, "AAAA "+netip.AddrFrom16(body.AAAA).String())
+				case *dnsmessage.TXTResource:
+					answers = append(answers, "TXT "+strings.Join(body.TXT, " "))
+				default:
+					answers = append(answers, rr.Header.Type.String())
+				}
+			}
+			if !reflect.DeepEqual(answers, tt.answers) {
+				t.Errorf("answered %q, want %q", answers, tt.answers)
+			}
+			soa := len(msg.Authorities) == 1 && msg.Authorities[0].Header.Type == dnsmessage.TypeSOA && msg.Authorities[0].Header.Name.String() == "whoami.example.com."
+			if soa != tt.soa || (!tt.soa && len(msg.Authorities) > 0) {
+				t.Errorf("unexpected authorities %+v", msg.Authorities)
+			}
+		})
+	}
+}
+
+func TestDNSAnswerRejectsMalformedQueries(t *testing.T) {
+	s := &DNSServer{zone: "whoami.example.com.", ttl: 60}
+	source := netip.MustParseAddr("192.0.2.1")
+	if _, _, err := s.answer([]byte{0x12, 0x34, 0x01}, source); err == nil {
+		t.Error("expected a truncated header to be dropped")
+	}
+
+	query := dnsTestQuery(t, "whoami.example.com.", dnsmessage.TypeA)
+	response := append([]byte{}, query...)
+	response[2] |= 0x80
+	if _, _, err := s.answer(response, source); err == nil {
+		t.Error("expected a response to be dropped")
+	}
+
+	// A header announcing a question which isn't there
+	resp, rcode, err := s.answer(query[:12], source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rcode != dnsmessage.RCodeFormatError {
+		t.Errorf("answered %v to a missing question, want FORMERR", rcode)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || msg.ID != 0x1234 || msg.RCode != dnsmessage.RCodeFormatError {
+		t.Errorf("unexpected response %+v, %v", msg.Header, err)
+	}
+
+	notify := append([]byte{}, query...)
+	notify[2] |= 4 << 3
+	if _, rcode, err := s.answer(notify, source); err != nil || rcode != dnsmessage.RCodeNotImplemented {
+		t.Errorf("answered %v, %v to a NOTIFY, want NOTIMP", rcode, err)
+	}
+}
+
+func dnsTestQueryWithOptions(t *testing.T, name string, typ dnsmessage.Type, options ...dnsmessage.Option) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x1234, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StartAdditionals(); err != nil {
+		t.Fatal(err)
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{Options: options}); err != nil {
+		t.Fatal(err)
+	}
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func TestDNSAnswerClientSubnet(t *testing.T) {
+	s := &DNSServer{zone: "whoami.example.com.", ttl: 60}
+	tests := []struct {
+		name string
+		// FAMILY, SOURCE PREFIX-LENGTH, SCOPE PREFIX-LENGTH and ADDRESS of the option.
+		data []byte
+		txt  []string
+		echo []byte
+	}{
+		{
+			name: "IPv4 /24",
+			data: []byte{0, 1, 24, 0, 198, 51, 100},
+			txt:  []string{"192.0.2.53", "edns0-client-subnet 198.51.100.0/24"},
+			echo: []byte{0, 1, 24, 24, 198, 51, 100},
+		},
+		{
+			name: "IPv6 /56",
+			data: []byte{0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x34, 0x56},
+			txt:  []string{"192.0.2.53", "edns0-client-subnet 2001:db8:1234:5600::/56"},
+			echo: []byte{0, 2, 56, 56, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x34, 0x56},
+		},
+		{
+			name: "bits beyond the prefix are cleared",
+			data: []byte{0, 1, 20, 0, 198, 51, 255},
+			txt:  []string{"192.0.2.53", "edns0-client-subnet 198.51.240.0/20"},
+			echo: []byte{0, 1, 20, 20, 198, 51, 240},
+		},
+		{
+			name: "prefix longer than the family",
+			data: []byte{0, 1, 33, 0, 198, 51, 100, 1, 0},
+			txt:  []string{"192.0.2.53"},
+		},
+		{
+			name: "unknown family",
+			data: []byte{0, 3, 24, 0, 198, 51, 100},
+			txt:  []string{"192.0.2.53"},
+		},
+		{
+			name: "address longer than 16 bytes",
+			data: append([]byte{0, 2, 128, 0}, make([]byte, 17)...),
+			txt:  []string{"192.0.2.53"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := dnsTestQueryWithOptions(t, "whoami.example.com.", dnsmessage.TypeTXT, dnsmessage.Option{Code: optionClientSubnet, Data: tt.data})
+			resp, _, err := s.answer(query, netip.MustParseAddr("192.0.2.53"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(resp); err != nil {
+				t.Fatal(err)
+			}
+			var txt []string
+			for _, rr := range msg.Answers {
+				txt = append(txt, strings.Join(rr.Body.(*dnsmessage.TXTResource).TXT, " "))
+			}
+			if !reflect.DeepEqual(txt, tt.txt) {
+				t.Errorf("answered %q, want %q", txt, tt.txt)
+			}
+
+			if len(msg.Additionals) != 1 {
+				t.Fatalf("expected an OPT record, got %+v", msg.Additionals)
+			}
+			opt, ok := msg.Additionals[0].Body.(*dnsmessage.OPTResource)
+			if !ok {
+				t.Fatalf("expected an OPT record, got %+v", msg.Additionals[0])
+			}
+			var echo []byte
+			for _, o := range opt.Options {
+				if o.Code == optionClientSubnet {
+					echo = o.Data
+				}
+			}
+			if !reflect.DeepEqual(echo, tt.echo) {
+				t.Errorf("echoed the option as %v, want %v", echo, tt.echo)
+			}
+		})
+	}
+}
+
+func TestDNSAnswerWithoutEDNS(t *testing.T) {
+	s := &DNSServer{zone: "whoami.example.com.", ttl: 60}
+	resp, _, err := s.answer(dnsTestQuery(t, "whoami.example.com.", dnsmessage.TypeTXT), netip.MustParseAddr("192.0.2.53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Additionals) != 0 {
+		t.Errorf("answered a query without EDNS with %+v", msg.Additionals)
+	}
+}
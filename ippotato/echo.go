@@ -0,0 +1,105 @@
+package ippotato
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Everything the server saw of a request, for debugging the proxies and clients in between.
+// Headers follow the echo policy like those of /headers. Bodies which aren't valid UTF-8 are
+// base64 encoded, as reported by body_encoding.
+type echoedRequest struct {
+	Method        string            `json:"method"`
+	Path          string            `json:"path"`
+	Query         url.Values        `json:"query"`
+	Headers       map[string]string `json:"headers"`
+	IP            string            `json:"ip"`
+	Proto         string            `json:"proto"`
+	Body          string            `json:"body"`
+	BodyEncoding  string            `json:"body_encoding,omitempty"`
+	BodyBytes     int               `json:"body_bytes"`
+	BodyTruncated bool              `json:"body_truncated,omitempty"`
+}
+
+func (s *service) echoRequest(req *http.Request) (echoedRequest, error) {
+	echoed := echoedRequest{
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Query:   req.URL.Query(),
+		Headers: map[string]string{},
+		IP:      RealIP(req),
+		Proto:   req.Proto,
+	}
+	for _, h := range s.requestHeaders(req) {
+		echoed.Headers[h.Name] = h.Value
+	}
+	// One byte past the limit tells whether there was more
+	body, err := io.ReadAll(io.LimitReader(req.Body, s.echo.maxBodyBytes+1))
+	if err != nil {
+		return echoedRequest{}, err
+	}
+	if int64(len(body)) > s.echo.maxBodyBytes {
+		body, echoed.BodyTruncated = body[:s.echo.maxBodyBytes], true
+	}
+	echoed.BodyBytes = len(body)
+	if utf8.Valid(body) {
+		echoed.Body = string(body)
+	} else {
+		echoed.Body, echoed.BodyEncoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	return echoed, nil
+}
+
+func (s *service) echoHandler() http.HandlerFunc {
+	return Negotiate(map[string]http.HandlerFunc{
+		"application/json": s.handleEchoJSONReq,
+	}, s.handleEchoTextReq)
+}
+
+// Reflects the request, answering 400 Bad Request if its body can't be read.
+func (s *service) receiveEcho(w http.ResponseWriter, req *http.Request) (echoedRequest, bool) {
+	echoed, err := s.echoRequest(req)
+	if err != nil {
+		s.writeError(w, req, http.StatusBadRequest, "failed to read the request body")
+		return echoedRequest{}, false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return echoed, true
+}
+
+func (s *service) handleEchoJSONReq(w http.ResponseWriter, req *http.Request) {
+	echoed, ok := s.receiveEcho(w, req)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(echoed)
+}
+
+// Writes the request line and headers as they would appear on the wire, after the address of
+// the client, followed by the body.
+func (s *service) handleEchoTextReq(w http.ResponseWriter, req *http.Request) {
+	echoed, ok := s.receiveEcho(w, req)
+	if !ok {
+		return
+	}
+	lines := []string{"ip: " + echoed.IP, "", echoed.Method + " " + req.URL.RequestURI() + " " + echoed.Proto}
+	for _, h := range s.requestHeaders(req) {
+		lines = append(lines, h.Name+": "+h.Value)
+	}
+	if echoed.BodyBytes > 0 {
+		lines = append(lines, "", echoed.Body)
+		if echoed.BodyEncoding != "" {
+			lines = append(lines, "", "(body "+echoed.BodyEncoding+" encoded)")
+		}
+		if echoed.BodyTruncated {
+			lines = append(lines, "", "(body truncated to "+strconv.Itoa(echoed.BodyBytes)+" bytes)")
+		}
+	}
+	s.writeText(w, req, lines...)
+}
@@ -0,0 +1,51 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEcho(t *testing.T) {
+	h := Handler(Options{EchoMaxBodyBytes: 8})
+	request := func(method, target, body string) echoedRequest {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+		}
+		var echoed echoedRequest
+		if err := json.Unmarshal(rec.Body.Bytes(), &echoed); err != nil {
+			t.Fatal(err)
+		}
+		return echoed
+	}
+
+	got := request(http.MethodPost, "/echo?a=1&a=2&b=", "hello")
+	want := echoedRequest{
+		Method:    http.MethodPost,
+		Path:      "/echo",
+		Query:     map[string][]string{"a": {"1", "2"}, "b": {""}},
+		Headers:   map[string]string{"Accept": "application/json", "Authorization": "[redacted]", "Host": "example.com"},
+		IP:        "192.0.2.10",
+		Proto:     "HTTP/1.1",
+		Body:      "hello",
+		BodyBytes: 5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	got = request(http.MethodPut, "/echo", "\xff\xfe too long")
+	if got.Body != "//4gdG9vIGw=" || got.BodyEncoding != "base64" || got.BodyBytes != 8 || !got.BodyTruncated {
+		t.Errorf("got body %q (%s, %d bytes, truncated %t), want the first 8 bytes base64 encoded", got.Body, got.BodyEncoding, got.BodyBytes, got.BodyTruncated)
+	}
+}
@@ -0,0 +1,95 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// Responds with an error in the media type the client asked for: a page for browsers, an
+// object with the message under error for JSON clients and the message as text otherwise.
+func (s *service) writeError(w http.ResponseWriter, req *http.Request, status int, message string) {
+	Negotiate(map[string]http.HandlerFunc{
+		"text/html": func(w http.ResponseWriter, req *http.Request) {
+			s.renderPageStatus(w, req, status, "error.html", map[string]any{
+				"status":     status,
+				"statusText": http.StatusText(status),
+				"message":    message,
+			})
+		},
+		"application/json": func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(status)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": message})
+		},
+	}, func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, message, status)
+	})(w, req)
+}
+
+// Answers requests mux has no route for, or no route for their method, with writeError
+// rather than the plain text errors of mux. The Allow header mux sets on 405 Method Not
+// Allowed is kept.
+func (s *service) negotiateMuxErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, pattern := mux.Handler(req); pattern != "" {
+			mux.ServeHTTP(w, req)
+			return
+		}
+		rec := &headerRecorder{header: http.Header{}}
+		mux.ServeHTTP(rec, req)
+		if rec.status == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", rec.header.Get("Allow"))
+			s.writeError(w, req, rec.status, fmt.Sprintf("the %s method is not allowed for %s", req.Method, req.URL.Path))
+			return
+		}
+		s.writeError(w, req, http.StatusNotFound, "nothing is served at "+req.URL.Path)
+	})
+}
+
+// Keeps the status and headers of a response, discarding its body.
+type headerRecorder struct {
+	header http.Header
+	status int
+}
+
+func (r *headerRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *headerRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *headerRecorder) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// Recovers from panics of the handler, logging them with the stack and answering 500 Internal
+// Server Error with writeError if nothing was written yet. Otherwise the connection is
+// aborted, so the client doesn't take the partial response for a complete one.
+func (s *service) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			slog.Error("handler panicked", slog.String("path", req.URL.Path), slog.Any("panic", v), slog.String("stack", string(debug.Stack())))
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			s.writeError(rec, req, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(rec, req)
+	})
+}
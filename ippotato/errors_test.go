@@ -0,0 +1,132 @@
+package ippotato
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMuxErrors(t *testing.T) {
+	h := Handler(Options{})
+	tests := []struct {
+		method, path, accept string
+		wantStatus           int
+		wantAllow            string
+		wantContentType      string
+		wantBody             string
+	}{
+		{http.MethodGet, "/nope", "", http.StatusNotFound, "", "text/plain; charset=utf-8", "nothing is served at /nope\n"},
+		{http.MethodGet, "/nope", "application/json", http.StatusNotFound, "", "application/json", `{"error":"nothing is served at /nope"}` + "\n"},
+		{http.MethodGet, "/nope", "text/html", http.StatusNotFound, "", "text/html; charset=utf-8", "404 Not Found"},
+		{http.MethodPost, "/", "application/json", http.StatusMethodNotAllowed, "GET, HEAD", "application/json", `{"error":"the POST method is not allowed for /"}` + "\n"},
+		{http.MethodDelete, "/api/v1/ip", "", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS", "text/plain; charset=utf-8", "the DELETE method is not allowed for /api/v1/ip\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path+" "+tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("Accept", tt.accept)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("got Allow %q, want %q", got, tt.wantAllow)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("got Content-Type %q, want %q", got, tt.wantContentType)
+			}
+			if got := rec.Body.String(); !strings.Contains(got, tt.wantBody) {
+				t.Errorf("got %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+// Errors of the routes themselves are negotiated like those of the mux.
+func TestRouteErrors(t *testing.T) {
+	h := Handler(Options{SpeedMaxBytes: 1000, APIKeys: []APIKey{{Name: "a", Key: "secret"}}, ASNDB: &ASNDB{}})
+	for target, want := range map[string]string{
+		"/speed/down?bytes=x":    `{"error":"the bytes query parameter must be a positive number"}`,
+		"/speed/down?bytes=5000": `{"error":"downloads are limited to 1000 bytes"}`,
+		"/asn":                   `{"error":"a valid API key is required as a bearer token"}`,
+		"/json?schema=1999-01":   `{"error":"unknown schema version, expected one of 2024-01, 2026-10"}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if got := strings.TrimSpace(rec.Body.String()); got != want || rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: got %s (%s), want %s", target, got, rec.Header().Get("Content-Type"), want)
+		}
+	}
+}
+
+// Rate limits and quotas reject clients in the format they asked for, telling them when to
+// retry.
+func TestRateLimitErrors(t *testing.T) {
+	h := Handler(Options{
+		APIRate: 0.001, APIBurst: 1,
+		APIKeys: []APIKey{{Name: "a", Key: "secret", Quota: &Quota{Daily: 1}}},
+	})
+	for _, target := range []string{"/api/v1/ip", "/"} {
+		request := func(accept string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.Header.Set("Accept", accept)
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			return rec
+		}
+		request("application/json")
+		for accept, wantContentType := range map[string]string{
+			"application/json": "application/json",
+			"text/plain":       "text/plain; charset=utf-8",
+			"text/html":        "text/html; charset=utf-8",
+		} {
+			rec := request(accept)
+			if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+				t.Errorf("%s with Accept %s: got status %d with Retry-After %q, want %d", target, accept, rec.Code, rec.Header().Get("Retry-After"), http.StatusTooManyRequests)
+			}
+			if got := rec.Header().Get("Content-Type"); got != wantContentType {
+				t.Errorf("%s with Accept %s: got Content-Type %q, want %q", target, accept, got, wantContentType)
+			}
+		}
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	s := newService(Options{})
+	h := s.recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		panic("oops")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if want := `{"error":"internal server error"}` + "\n"; rec.Code != http.StatusInternalServerError || rec.Body.String() != want {
+		t.Errorf("got status %d and %q, want %d and %q", rec.Code, rec.Body, http.StatusInternalServerError, want)
+	}
+
+	// Middleware of the options panicking is recovered from too
+	explode := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { panic("oops") })
+	}
+	rec = httptest.NewRecorder()
+	Handler(Options{Middleware: []Middleware{explode}}).ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d when middleware panics, want %d", rec.Code, http.StatusInternalServerError)
+	}
+
+	h = s.recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic("oops")
+	}))
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("got panic %v after the response started, want the connection to be aborted", v)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), req)
+}
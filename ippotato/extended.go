@@ -0,0 +1,115 @@
+package ippotato
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// Everything the enabled lookups know about an address. It only depends on the address, so
+// it can be shared between requests from the same client.
+type ipDetails struct {
+	Hostname  string `json:"hostname,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	OriginASN int    `json:"origin_asn,omitempty"`
+	// Credits the looking glass when it provided the prefix and origin AS, like /bgp does.
+	RouteAttribution string   `json:"route_attribution,omitempty"`
+	ASN              *asnInfo `json:"asn,omitempty"`
+
+	Warnings []lookupWarning `json:"warnings,omitempty"`
+}
+
+// Reported when a lookup failed or timed out, so clients can tell fields which were omitted
+// because of it apart from fields which are absent because there is no data. The message is
+// deliberately vague, errors can contain internal addresses and are logged instead.
+type lookupWarning struct {
+	Source  string   `json:"source"`
+	Fields  []string `json:"fields"`
+	Message string   `json:"message"`
+}
+
+func newLookupWarning(source string, err error, fields ...string) lookupWarning {
+	return lookupWarning{Source: source, Fields: fields, Message: lookupErrorMessage(err)}
+}
+
+// Describes why a lookup failed without revealing anything about the upstream, such as its
+// address, to clients.
+func lookupErrorMessage(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "lookup timed out"
+	}
+	return "lookup failed"
+}
+
+// The payload served by /json: the client's address, the details known about it and how the
+// request arrived. Fields of lookups which are disabled are omitted, as are all of them once
+// API keys are configured and the request has none, like the routes serving them alone. The
+// details are only ever looked up for the address the connection or a trusted proxy vouches
+// for, and left out if the client claims another one, so forged forwarding headers can't aim
+// lookups at arbitrary addresses.
+type extendedInfo struct {
+	IP     string `json:"ip"`
+	Port   int    `json:"port,omitempty"`
+	IPType string `json:"ip_type,omitempty"`
+	ipDetails
+
+	HTTPVersion      string          `json:"http_version,omitempty"`
+	ConnectionReused bool            `json:"connection_reused"`
+	TLSFingerprint   *tlsFingerprint `json:"tls_fingerprint,omitempty"`
+}
+
+func (s *service) lookupDetails(ctx context.Context, ip string) ipDetails {
+	var details ipDetails
+	if s.asns != nil {
+		details.ASN = s.asns.Lookup(ip)
+	}
+	var err error
+	details.Prefix, details.OriginASN, details.RouteAttribution, err = s.lookupRoute(ctx, ip, details.ASN)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		details.Warnings = append(details.Warnings, newLookupWarning("bgp", err, "prefix", "origin_asn"))
+	}
+	if s.rdns != nil {
+		hostname, err := s.rdns.Lookup(ctx, ip)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			slog.Warn("failed to look up hostname", slog.String("ip", ip), slog.Any("error", err))
+			details.Warnings = append(details.Warnings, newLookupWarning("rdns", err, "hostname"))
+		}
+		details.Hostname = hostname
+	}
+	return details
+}
+
+func (s *service) handleExtendedReq(w http.ResponseWriter, req *http.Request) {
+	info := extendedInfo{IP: RealIP(req), Port: clientPort(req)}
+	info.IPType = classifyIP(info.IP)
+	if ip := s.proxies.clientIP(req); ip != "" && ip == info.IP && (s.apiKeys == nil || APIKeyName(req) != "") {
+		info.ipDetails = s.details.Lookup(req.Context(), ip)
+	}
+	proto := requestProto(req)
+	info.HTTPVersion, info.ConnectionReused = proto.HTTPVersion, proto.ConnectionReused
+	info.TLSFingerprint = requestTLSFingerprint(req)
+	s.writeVersionedJSON(w, req, info)
+}
+
+// Finds the announced prefix covering ip and the AS originating it. The looking glass is
+// preferred since it reflects what is announced right now, with the ASN database as a
+// fallback when it isn't configured or unavailable. The attribution of the looking glass is
+// returned with its answers. Its error is only returned if the fallback couldn't fill in for it.
+func (s *service) lookupRoute(ctx context.Context, ip string, asn *asnInfo) (string, int, string, error) {
+	var err error
+	if s.bgp != nil {
+		var info *bgpInfo
+		info, err = s.bgp.Lookup(ctx, ip)
+		if err == nil && len(info.OriginASNs) > 0 {
+			return info.Prefix, info.OriginASNs[0], info.Attribution, nil
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			slog.Warn("failed to look up bgp information", slog.String("ip", ip), slog.Any("error", err))
+		}
+	}
+	if asn != nil {
+		return asn.Network, asn.Number, "", nil
+	}
+	return "", 0, "", err
+}
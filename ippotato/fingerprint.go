@@ -0,0 +1,361 @@
+package ippotato
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Fingerprints of the TLS ClientHello sent by the client, see https://github.com/salesforce/ja3
+// and https://github.com/FoxIO-LLC/ja4.
+type tlsFingerprint struct {
+	JA3     string `json:"ja3"`
+	JA3Hash string `json:"ja3_hash"`
+	JA4     string `json:"ja4"`
+}
+
+// Wraps the listener below the TLS layer so the raw ClientHello of every connection can be
+// captured. Go's crypto/tls doesn't expose the order of extensions or GREASE values, which
+// both fingerprints depend on.
+type helloListener struct {
+	net.Listener
+}
+
+func (l *helloListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &helloConn{Conn: conn}, nil
+}
+
+// Records everything read from the connection until a complete ClientHello has arrived.
+type helloConn struct {
+	net.Conn
+	mu       sync.Mutex
+	buf      []byte
+	done     bool
+	hello    *clientHello
+	helloErr error
+}
+
+// The largest ClientHello we are willing to buffer.
+const maxHelloBytes = 32 * 1024
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done && n > 0 {
+		c.buf = append(c.buf, b[:n]...)
+		msg, complete, parseErr := handshakeMessage(c.buf)
+		switch {
+		case parseErr != nil:
+			c.done, c.helloErr = true, parseErr
+		case complete:
+			c.done = true
+			c.hello, c.helloErr = parseClientHello(msg)
+		case len(c.buf) > maxHelloBytes:
+			c.done, c.helloErr = true, errors.New("ClientHello is too large")
+		}
+		if c.done {
+			c.buf = nil
+		}
+	}
+	return n, err
+}
+
+func (c *helloConn) clientHello() (*clientHello, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done {
+		return nil, errors.New("no ClientHello received")
+	}
+	return c.hello, c.helloErr
+}
+
+// Reassembles the first handshake message from TLS records, which may be split across
+// several of them.
+func handshakeMessage(records []byte) (msg []byte, complete bool, err error) {
+	for len(records) >= 5 {
+		if records[0] != 22 {
+			return nil, false, errors.New("connection did not start with a TLS handshake")
+		}
+		length := int(binary.BigEndian.Uint16(records[3:5]))
+		if len(records) < 5+length {
+			break
+		}
+		msg = append(msg, records[5:5+length]...)
+		records = records[5+length:]
+		if len(msg) >= 4 && len(msg) >= 4+(int(msg[1])<<16|int(msg[2])<<8|int(msg[3])) {
+			return msg, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+type clientHello struct {
+	version         uint16
+	ciphers         []uint16
+	extensions      []uint16
+	groups          []uint16
+	pointFormats    []uint8
+	sigAlgs         []uint16
+	alpn            []string
+	supportedVers   []uint16
+	serverNameFound bool
+}
+
+func parseClientHello(msg []byte) (*clientHello, error) {
+	if len(msg) < 4 || msg[0] != 1 {
+		return nil, errors.New("first handshake message is not a ClientHello")
+	}
+	r := &byteReader{b: msg[4:]}
+	hello := &clientHello{}
+	hello.version = r.uint16()
+	r.skip(32)
+	r.skip(int(r.uint8()))
+	ciphers := r.sub(int(r.uint16()))
+	for ciphers.len() >= 2 {
+		hello.ciphers = append(hello.ciphers, ciphers.uint16())
+	}
+	r.skip(int(r.uint8()))
+	exts := r.sub(int(r.uint16()))
+	for exts.len() >= 4 {
+		typ := exts.uint16()
+		data := exts.sub(int(exts.uint16()))
+		hello.extensions = append(hello.extensions, typ)
+		switch typ {
+		case 0:
+			hello.serverNameFound = true
+		case 10:
+			groups := data.sub(int(data.uint16()))
+			for groups.len() >= 2 {
+				hello.groups = append(hello.groups, groups.uint16())
+			}
+		case 11:
+			hello.pointFormats = append(hello.pointFormats, data.bytes(int(data.uint8()))...)
+		case 13:
+			algs := data.sub(int(data.uint16()))
+			for algs.len() >= 2 {
+				hello.sigAlgs = append(hello.sigAlgs, algs.uint16())
+			}
+		case 16:
+			protos := data.sub(int(data.uint16()))
+			for protos.len() > 0 {
+				hello.alpn = append(hello.alpn, string(protos.bytes(int(protos.uint8()))))
+			}
+		case 43:
+			versions := data.sub(int(data.uint8()))
+			for versions.len() >= 2 {
+				hello.supportedVers = append(hello.supportedVers, versions.uint16())
+			}
+		}
+	}
+	if r.truncated || ciphers.truncated || exts.truncated {
+		return nil, errors.New("malformed ClientHello")
+	}
+	return hello, nil
+}
+
+// A cursor over a byte slice which turns reads past the end into empty values, so parsing
+// only needs to check for truncation once at the end.
+type byteReader struct {
+	b         []byte
+	truncated bool
+}
+
+func (r *byteReader) len() int { return len(r.b) }
+
+func (r *byteReader) bytes(n int) []byte {
+	if n > len(r.b) {
+		r.b, r.truncated = nil, true
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *byteReader) skip(n int) { r.bytes(n) }
+
+// Reads a nested structure prefixed with its length, as used throughout the ClientHello.
+func (r *byteReader) sub(n int) *byteReader {
+	return &byteReader{b: r.bytes(n), truncated: r.truncated}
+}
+
+func (r *byteReader) uint8() uint8 {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *byteReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// GREASE values (RFC 8701) are random per connection and excluded from fingerprints.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinUint16(values []uint16, format func(uint16) string) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = format(v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func decimal(v uint16) string { return strconv.Itoa(int(v)) }
+func hex4(v uint16) string    { return fmt.Sprintf("%04x", v) }
+
+func (h *clientHello) ja3() string {
+	points := make([]uint16, len(h.pointFormats))
+	for i, p := range h.pointFormats {
+		points[i] = uint16(p)
+	}
+	fields := []string{
+		decimal(h.version),
+		joinUint16(withoutGREASE(h.ciphers), decimal),
+		joinUint16(withoutGREASE(h.extensions), decimal),
+		joinUint16(withoutGREASE(h.groups), decimal),
+		joinUint16(points, decimal),
+	}
+	for i := range fields {
+		fields[i] = strings.ReplaceAll(fields[i], ",", "-")
+	}
+	return strings.Join(fields, ",")
+}
+
+func (h *clientHello) ja4() string {
+	version := h.version
+	for _, v := range withoutGREASE(h.supportedVers) {
+		if v > version {
+			version = v
+		}
+	}
+	versionCode := map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3"}[version]
+	if versionCode == "" {
+		versionCode = "00"
+	}
+	sni := "i"
+	if h.serverNameFound {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		first, last := h.alpn[0][0], h.alpn[0][len(h.alpn[0])-1]
+		if isAlphanumeric(first) && isAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			alpn = hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+		}
+	}
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+	a := fmt.Sprintf("t%s%s%02d%02d%s", versionCode, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	sortedCiphers := append([]uint16{}, ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+	b := truncatedHash(joinUint16(sortedCiphers, hex4))
+
+	var sortedExtensions []uint16
+	for _, ext := range extensions {
+		if ext != 0 && ext != 16 {
+			sortedExtensions = append(sortedExtensions, ext)
+		}
+	}
+	sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+	c := joinUint16(sortedExtensions, hex4)
+	if len(h.sigAlgs) > 0 {
+		c += "_" + joinUint16(h.sigAlgs, hex4)
+	}
+	return a + "_" + b + "_" + truncatedHash(c)
+}
+
+func isAlphanumeric(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Returns nil if the request didn't arrive over a fingerprinted TLS connection.
+func requestTLSFingerprint(req *http.Request) *tlsFingerprint {
+	conn, ok := requestNetConn(req).(*helloConn)
+	if !ok {
+		return nil
+	}
+	hello, err := conn.clientHello()
+	if err != nil {
+		return nil
+	}
+	ja3 := hello.ja3()
+	sum := md5.Sum([]byte(ja3))
+	return &tlsFingerprint{
+		JA3:     ja3,
+		JA3Hash: hex.EncodeToString(sum[:]),
+		JA4:     hello.ja4(),
+	}
+}
+
+func (s *service) fingerprintHandler() http.HandlerFunc {
+	return Negotiate(map[string]http.HandlerFunc{
+		"application/json": s.handleFingerprintJSONReq,
+	}, s.handleFingerprintTextReq)
+}
+
+func (s *service) handleFingerprintJSONReq(w http.ResponseWriter, req *http.Request) {
+	fingerprint := requestTLSFingerprint(req)
+	if fingerprint == nil {
+		s.writeError(w, req, http.StatusNotFound, "no TLS fingerprint is available for this connection")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(fingerprint)
+}
+
+func (s *service) handleFingerprintTextReq(w http.ResponseWriter, req *http.Request) {
+	fingerprint := requestTLSFingerprint(req)
+	if fingerprint == nil {
+		s.writeError(w, req, http.StatusNotFound, "no TLS fingerprint is available for this connection")
+		return
+	}
+	s.writeText(w, req,
+		"JA3: "+fingerprint.JA3,
+		"JA3 hash: "+fingerprint.JA3Hash,
+		"JA4: "+fingerprint.JA4,
+	)
+}
@@ -0,0 +1,241 @@
+package ippotato
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type testExtension struct {
+	typ  uint16
+	data []byte
+}
+
+func uint16List(lengthBytes int, values ...uint16) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	if lengthBytes == 1 {
+		return append([]byte{byte(len(b))}, b...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...)
+}
+
+// Encodes a ClientHello handshake message with an empty session ID and null compression.
+func buildClientHello(version uint16, ciphers []uint16, extensions []testExtension) []byte {
+	body := binary.BigEndian.AppendUint16(nil, version)
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0)
+	body = append(body, uint16List(2, ciphers...)...)
+	body = append(body, 1, 0)
+	var exts []byte
+	for _, ext := range extensions {
+		exts = binary.BigEndian.AppendUint16(exts, ext.typ)
+		exts = binary.BigEndian.AppendUint16(exts, uint16(len(ext.data)))
+		exts = append(exts, ext.data...)
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(exts)))
+	body = append(body, exts...)
+	msg := []byte{1, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(msg, body...)
+}
+
+// Wraps a handshake message in TLS records carrying at most size bytes each.
+func handshakeRecords(msg []byte, size int) []byte {
+	var records []byte
+	for len(msg) > 0 {
+		n := min(size, len(msg))
+		records = append(records, 22, 3, 1)
+		records = binary.BigEndian.AppendUint16(records, uint16(n))
+		records = append(records, msg[:n]...)
+		msg = msg[n:]
+	}
+	return records
+}
+
+// A ClientHello of Chrome with GREASE values in the places Chrome puts them. Its ciphers,
+// extensions and signature algorithms are those of the example in the JA4 technical
+// details, https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md, and its JA3
+// is the widely published one of Chrome.
+func chromeClientHello() []byte {
+	alpn := []byte{0, 12, 2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1'}
+	sni := []byte{0, 14, 0, 0, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm'}
+	return buildClientHello(0x0303,
+		[]uint16{0x1a1a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		[]testExtension{
+			{typ: 0x0a0a},
+			{typ: 0x0000, data: sni},
+			{typ: 0x0017},
+			{typ: 0xff01, data: []byte{0}},
+			{typ: 0x000a, data: uint16List(2, 0x2a2a, 0x001d, 0x0017, 0x0018)},
+			{typ: 0x000b, data: []byte{1, 0}},
+			{typ: 0x0023},
+			{typ: 0x0010, data: alpn},
+			{typ: 0x0005, data: []byte{1, 0, 0, 0, 0}},
+			{typ: 0x000d, data: uint16List(2, 0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)},
+			{typ: 0x0012},
+			{typ: 0x0033, data: []byte{0, 0}},
+			{typ: 0x002d, data: []byte{1, 1}},
+			{typ: 0x002b, data: uint16List(1, 0x5a5a, 0x0304, 0x0303)},
+			{typ: 0x001b, data: []byte{2, 0, 2}},
+			{typ: 0x4469, data: []byte{0, 3, 2, 'h', '2'}},
+			{typ: 0xfafa, data: []byte{0}},
+			{typ: 0x0015, data: make([]byte, 32)},
+		})
+}
+
+func TestFingerprints(t *testing.T) {
+	tests := []struct {
+		name    string
+		hello   []byte
+		ja3     string
+		ja3Hash string
+		ja4     string
+	}{
+		{
+			name:    "Chrome",
+			hello:   chromeClientHello(),
+			ja3:     "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0",
+			ja3Hash: "cd08e31494f9531f560d64c695473da9",
+			ja4:     "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+		{
+			// The example of https://github.com/salesforce/ja3, a TLS 1.0 client without
+			// ALPN or signature algorithms
+			name: "JA3 example",
+			hello: buildClientHello(0x0301,
+				[]uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+				[]testExtension{
+					{typ: 0, data: []byte{0, 6, 0, 0, 3, 'a', '.', 'b'}},
+					{typ: 10, data: uint16List(2, 23, 24, 25)},
+					{typ: 11, data: []byte{1, 0}},
+				}),
+			ja3:     "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0",
+			ja3Hash: "ada70206e40642a3e4461f35503241d5",
+			ja4:     "t10d120300_" + truncatedHash("0004,0005,000a,0013,002f,0032,0035,0038,c009,c00a,c013,c014") + "_" + truncatedHash("000a,000b"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Clients may split the ClientHello across records
+			for _, size := range []int{16384, 100} {
+				msg, complete, err := handshakeMessage(handshakeRecords(tt.hello, size))
+				if err != nil || !complete {
+					t.Fatalf("records of %d bytes: complete %v, %v", size, complete, err)
+				}
+				hello, err := parseClientHello(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := hello.ja3(); got != tt.ja3 {
+					t.Errorf("JA3 is\n%s\nwant\n%s", got, tt.ja3)
+				}
+				if sum := md5.Sum([]byte(hello.ja3())); hex.EncodeToString(sum[:]) != tt.ja3Hash {
+					t.Errorf("JA3 hash is %x, want %s", sum, tt.ja3Hash)
+				}
+				if got := hello.ja4(); got != tt.ja4 {
+					t.Errorf("JA4 is %s, want %s", got, tt.ja4)
+				}
+			}
+		})
+	}
+}
+
+// GREASE values are random per connection, so they must not change the fingerprints.
+func TestFingerprintsIgnoreGREASE(t *testing.T) {
+	withGREASE, err := parseClientHello(chromeClientHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := *withGREASE
+	hello.ciphers = withoutGREASE(hello.ciphers)
+	hello.extensions = withoutGREASE(hello.extensions)
+	hello.groups = withoutGREASE(hello.groups)
+	hello.supportedVers = withoutGREASE(hello.supportedVers)
+	if hello.ja3() != withGREASE.ja3() || hello.ja4() != withGREASE.ja4() {
+		t.Errorf("GREASE changed the fingerprints from %s %s to %s %s", hello.ja3(), hello.ja4(), withGREASE.ja3(), withGREASE.ja4())
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	greases := 0
+	for v := 0; v <= 0xffff; v++ {
+		if isGREASE(uint16(v)) {
+			greases++
+			if b := byte(v); byte(v>>8) != b || b&0x0f != 0x0a {
+				t.Errorf("%#04x isn't a GREASE value", v)
+			}
+		}
+	}
+	// RFC 8701 reserves 0x0a0a, 0x1a1a, ... 0xfafa
+	if greases != 16 {
+		t.Errorf("found %d GREASE values, want 16", greases)
+	}
+}
+
+func TestHandshakeMessage(t *testing.T) {
+	records := handshakeRecords(chromeClientHello(), 100)
+	if _, complete, err := handshakeMessage(records[:len(records)-1]); complete || err != nil {
+		t.Errorf("a truncated ClientHello is complete %v, %v", complete, err)
+	}
+	if _, _, err := handshakeMessage([]byte("GET / HTTP/1.1\r\n")); err == nil {
+		t.Error("expected a connection not speaking TLS to be refused")
+	}
+	if _, err := parseClientHello([]byte{2, 0, 0, 0}); err == nil {
+		t.Error("expected a ServerHello to be refused")
+	}
+	hello := chromeClientHello()
+	if _, err := parseClientHello(hello[:len(hello)-10]); err == nil {
+		t.Error("expected a truncated ClientHello to be refused")
+	}
+}
+
+// The ClientHello is captured below the TLS layer of a real connection.
+func TestFingerprintRoute(t *testing.T) {
+	pki := newTestPKI(t)
+	config, err := NewTLSConfig(pki.server.certFile, pki.server.keyFile, "none", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: Handler(Options{TLSConfig: config}), ConnContext: ConnContext}
+	go server.Serve(tls.NewListener(NewListener(ln, false, true), config))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pki.ca.cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequest(http.MethodGet, "https://"+ln.Addr().String()+"/fingerprint", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var fingerprint tlsFingerprint
+	if err := json.NewDecoder(resp.Body).Decode(&fingerprint); err != nil {
+		t.Fatal(err)
+	}
+	if sum := md5.Sum([]byte(fingerprint.JA3)); hex.EncodeToString(sum[:]) != fingerprint.JA3Hash {
+		t.Errorf("JA3 hash %s isn't the hash of %s", fingerprint.JA3Hash, fingerprint.JA3)
+	}
+	// Go offers TLS 1.3 and doesn't send SNI for an IP address
+	if !strings.HasPrefix(fingerprint.JA3, "771,") || !strings.HasPrefix(fingerprint.JA4, "t13i") {
+		t.Errorf("unexpected fingerprint %+v", fingerprint)
+	}
+}
@@ -0,0 +1,102 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type header struct {
+	Name  string
+	Value string
+}
+
+// Controls what echo endpoints reflect back, so they can be enabled on semi-public instances
+// without credentials ending up in logs or screenshots.
+type echoPolicy struct {
+	// Canonical names of headers whose values are replaced by a placeholder
+	redacted map[string]bool
+	// Values longer than this are truncated
+	maxValueBytes int
+	// Headers beyond this count, in sorted order, are left out
+	maxHeaders int
+	// Bodies are read up to this many bytes
+	maxBodyBytes int64
+}
+
+func newEchoPolicy(redacted []string, maxValueBytes, maxHeaders int, maxBodyBytes int64) echoPolicy {
+	p := echoPolicy{
+		redacted:      map[string]bool{},
+		maxValueBytes: maxValueBytes,
+		maxHeaders:    maxHeaders,
+		maxBodyBytes:  maxBodyBytes,
+	}
+	for _, name := range redacted {
+		if name = strings.TrimSpace(name); name != "" {
+			p.redacted[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return p
+}
+
+func (p echoPolicy) value(name, value string) string {
+	if p.redacted[name] {
+		return "[redacted]"
+	}
+	if len(value) > p.maxValueBytes {
+		return strings.ToValidUTF8(value[:p.maxValueBytes], "") + "...[truncated]"
+	}
+	return value
+}
+
+// Returns the headers of the request sorted by name, with repeated headers combined into a
+// single comma separated value and the echo policy applied. Go moves the Host header out of
+// the header map, so it is added back to show exactly what arrived.
+func (s *service) requestHeaders(req *http.Request) []header {
+	headers := make([]header, 0, len(req.Header)+1)
+	if req.Host != "" {
+		headers = append(headers, header{Name: "Host", Value: req.Host})
+	}
+	for name, values := range req.Header {
+		headers = append(headers, header{Name: name, Value: strings.Join(values, ", ")})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].Name < headers[j].Name })
+	if len(headers) > s.echo.maxHeaders {
+		headers = headers[:s.echo.maxHeaders]
+	}
+	for i := range headers {
+		headers[i].Value = s.echo.value(headers[i].Name, headers[i].Value)
+	}
+	return headers
+}
+
+func (s *service) headersHandler() http.HandlerFunc {
+	return Negotiate(map[string]http.HandlerFunc{
+		"text/html":        s.handleHeadersHTTPReq,
+		"application/json": s.handleHeadersJSONReq,
+	}, s.handleHeadersTextReq)
+}
+
+func (s *service) handleHeadersHTTPReq(w http.ResponseWriter, req *http.Request) {
+	s.renderPage(w, req, "headers.html", map[string]any{
+		"headers": s.requestHeaders(req),
+	})
+}
+
+func (s *service) handleHeadersJSONReq(w http.ResponseWriter, req *http.Request) {
+	headers := map[string]string{}
+	for _, h := range s.requestHeaders(req) {
+		headers[h.Name] = h.Value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(headers)
+}
+
+func (s *service) handleHeadersTextReq(w http.ResponseWriter, req *http.Request) {
+	var lines []string
+	for _, h := range s.requestHeaders(req) {
+		lines = append(lines, h.Name+": "+h.Value)
+	}
+	s.writeText(w, req, lines...)
+}
@@ -0,0 +1,81 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// The User-Agent client hints (https://wicg.github.io/ua-client-hints/) requested from
+// browsers. Sec-CH-UA, Sec-CH-UA-Mobile and Sec-CH-UA-Platform are sent by default, the
+// others are high entropy and only sent once the server asks for them.
+var clientHints = []string{
+	"Sec-CH-UA",
+	"Sec-CH-UA-Mobile",
+	"Sec-CH-UA-Platform",
+	"Sec-CH-UA-Platform-Version",
+	"Sec-CH-UA-Arch",
+	"Sec-CH-UA-Bitness",
+	"Sec-CH-UA-Model",
+	"Sec-CH-UA-Full-Version-List",
+	"Sec-CH-UA-WoW64",
+	"Sec-CH-UA-Form-Factors",
+}
+
+// Asks browsers to send the client hints on subsequent requests.
+func advertiseClientHints(w http.ResponseWriter) {
+	w.Header().Set("Accept-CH", strings.Join(clientHints, ", "))
+	w.Header().Add("Vary", strings.Join(clientHints, ", "))
+}
+
+// Returns the client hints present on the request, in the order they are requested.
+func requestClientHints(req *http.Request) []header {
+	var hints []header
+	for _, name := range clientHints {
+		if value := req.Header.Get(name); value != "" {
+			hints = append(hints, header{Name: name, Value: value})
+		}
+	}
+	return hints
+}
+
+func (s *service) hintsHandler() http.HandlerFunc {
+	h := Negotiate(map[string]http.HandlerFunc{
+		"text/html":        s.handleHintsHTTPReq,
+		"application/json": s.handleHintsJSONReq,
+	}, s.handleHintsTextReq)
+	return func(w http.ResponseWriter, req *http.Request) {
+		advertiseClientHints(w)
+		// Makes browsers retry the first request with the high entropy hints included, rather
+		// than only sending them on the next one
+		w.Header().Set("Critical-CH", strings.Join(clientHints, ", "))
+		h(w, req)
+	}
+}
+
+func (s *service) handleHintsHTTPReq(w http.ResponseWriter, req *http.Request) {
+	s.renderPage(w, req, "hints.html", map[string]any{
+		"ip":    RealIP(req),
+		"hints": requestClientHints(req),
+	})
+}
+
+func (s *service) handleHintsJSONReq(w http.ResponseWriter, req *http.Request) {
+	hints := map[string]string{}
+	for _, h := range requestClientHints(req) {
+		hints[h.Name] = h.Value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ip":    RealIP(req),
+		"hints": hints,
+	})
+}
+
+func (s *service) handleHintsTextReq(w http.ResponseWriter, req *http.Request) {
+	lines := []string{RealIP(req)}
+	for _, h := range requestClientHints(req) {
+		lines = append(lines, h.Name+": "+h.Value)
+	}
+	s.writeText(w, req, lines...)
+}
@@ -0,0 +1,541 @@
+package ippotato
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Layout of the history database, version 2:
+//
+//	meta                      schema -> "2"
+//	keys/<sha256 of key>      <16 byte address> -> first seen, last seen (unix nanoseconds, big endian)
+//	changes/<sha256 of key>   <time of the change (unix nanoseconds, big endian)> -> <16 byte address>
+//
+// API keys are only stored hashed, so the database can't be used to make requests on behalf
+// of their owners. Addresses are stored in their 16 byte form, IPv4 mapped to IPv6. Version 1
+// lacked the changes, databases written by it are upgraded when opened.
+const historySchema = "2"
+
+var (
+	historyMetaBucket    = []byte("meta")
+	historyKeysBucket    = []byte("keys")
+	historyChangesBucket = []byte("changes")
+	historySchemaKey     = []byte("schema")
+)
+
+const (
+	// The last seen time of an address is only written when it is at least this old, so
+	// clients polling every few seconds don't turn every request into a write.
+	historyResolution = time.Minute
+	// Every change of address is kept for this long, older ones are downsampled to daily
+	// snapshots, the last change of each UTC day.
+	historyDailyAfter = 30 * 24 * time.Hour
+)
+
+// HistoryStore persists the addresses each API key has been seen from, for /history.
+type HistoryStore struct {
+	db *bolt.DB
+	// Entries not seen for longer than this are pruned, never if zero.
+	retention time.Duration
+	// Once a key has been seen from this many addresses, the least recently seen is dropped
+	// for every new one, and so is the oldest change of address beyond this many.
+	maxEntries int
+}
+
+// A HistoryChange is a change of the address an API key is seen from. Changes older than 30
+// days are daily snapshots: the address the key was last seen from that day.
+type HistoryChange struct {
+	IP   string    `json:"ip"`
+	Time time.Time `json:"time"`
+}
+
+// A HistoryEntry is an address an API key has been seen from.
+type HistoryEntry struct {
+	IP        string    `json:"ip"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// OpenHistoryStore opens or creates the history database at path. Entries which haven't been
+// seen for longer than retention are removed by Prune, at most maxEntries addresses and as many
+// changes are kept per key (1000 if zero).
+func OpenHistoryStore(path string, retention time.Duration, maxEntries int) (*HistoryStore, error) {
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening history database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(historyMetaBucket)
+		if err != nil {
+			return err
+		}
+		switch schema := meta.Get(historySchemaKey); {
+		case schema == nil:
+			if err := meta.Put(historySchemaKey, []byte(historySchema)); err != nil {
+				return err
+			}
+		case string(schema) == "1":
+			// Only adds the changes, which start with the next request of each key
+			if err := meta.Put(historySchemaKey, []byte(historySchema)); err != nil {
+				return err
+			}
+		case string(schema) != historySchema:
+			return fmt.Errorf("unsupported schema version %s, expected %s", schema, historySchema)
+		}
+		if _, err := tx.CreateBucketIfNotExists(historyKeysBucket); err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(historyChangesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("history database %s: %w", path, err)
+	}
+	return &HistoryStore{db: db, retention: retention, maxEntries: maxEntries}, nil
+}
+
+// Close closes the database.
+func (s *HistoryStore) Close() error {
+	return s.db.Close()
+}
+
+func hashAPIKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+func encodeHistoryTimes(first, last time.Time) []byte {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v[:8], uint64(first.UnixNano()))
+	binary.BigEndian.PutUint64(v[8:], uint64(last.UnixNano()))
+	return v
+}
+
+func decodeHistoryTimes(v []byte) (first, last time.Time, ok bool) {
+	if len(v) != 16 {
+		return time.Time{}, time.Time{}, false
+	}
+	first = time.Unix(0, int64(binary.BigEndian.Uint64(v[:8]))).UTC()
+	last = time.Unix(0, int64(binary.BigEndian.Uint64(v[8:]))).UTC()
+	return first, last, true
+}
+
+func encodeHistoryTime(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano()))
+}
+
+func decodeHistoryTime(k []byte) (time.Time, bool) {
+	if len(k) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k))).UTC(), true
+}
+
+// Returns the time and address of the most recent change in the bucket, nil if there is none.
+func lastChange(b *bolt.Bucket) (k, v []byte) {
+	if b == nil {
+		return nil, nil
+	}
+	return b.Cursor().Last()
+}
+
+// Record notes that the key has been seen from the address at the given time. Changes are kept
+// at the resolution of a minute too: a change less than a minute after the previous one
+// replaces it, so clients alternating between addresses, e.g. IPv4 and IPv6, add at most a
+// change a minute.
+func (s *HistoryStore) Record(key string, ip netip.Addr, now time.Time) error {
+	hashed, addr := hashAPIKey(key), ip.As16()
+	var current, lastAt []byte
+	changed := true
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(historyKeysBucket).Bucket(hashed); b != nil {
+			current = b.Get(addr[:])
+		}
+		k, v := lastChange(tx.Bucket(historyChangesBucket).Bucket(hashed))
+		lastAt, changed = k, !bytes.Equal(v, addr[:])
+		return nil
+	})
+	if _, last, ok := decodeHistoryTimes(current); ok && now.Sub(last) < historyResolution {
+		if at, ok := decodeHistoryTime(lastAt); !changed || ok && now.Sub(at) < historyResolution {
+			return nil
+		}
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(historyKeysBucket).CreateBucketIfNotExists(hashed)
+		if err != nil {
+			return err
+		}
+		first, _, ok := decodeHistoryTimes(b.Get(addr[:]))
+		if !ok {
+			first = now
+			if err := makeRoom(b, s.maxEntries); err != nil {
+				return err
+			}
+		}
+		if err := b.Put(addr[:], encodeHistoryTimes(first, now)); err != nil {
+			return err
+		}
+		changes, err := tx.Bucket(historyChangesBucket).CreateBucketIfNotExists(hashed)
+		if err != nil {
+			return err
+		}
+		return recordChange(changes, addr[:], now, s.maxEntries)
+	})
+}
+
+// Adds a change to the address unless it is the current one, replacing the last change if it
+// is less than historyResolution old, and drops the oldest changes beyond maxEntries.
+func recordChange(b *bolt.Bucket, addr []byte, now time.Time, maxEntries int) error {
+	c := b.Cursor()
+	k, v := c.Last()
+	if bytes.Equal(v, addr) {
+		return nil
+	}
+	if at, ok := decodeHistoryTime(k); ok && now.Sub(at) < historyResolution {
+		// Changing back to the address before the replaced change undoes it
+		if _, prev := c.Prev(); bytes.Equal(prev, addr) {
+			return b.Delete(k)
+		}
+		return b.Put(k, addr)
+	}
+	if err := b.Put(encodeHistoryTime(now), addr); err != nil {
+		return err
+	}
+	var excess [][]byte
+	c = b.Cursor()
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		if maxEntries--; maxEntries < 0 {
+			excess = append(excess, append([]byte(nil), k...))
+		}
+	}
+	for _, k := range excess {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drops the least recently seen entry of the bucket if it already holds maxEntries.
+func makeRoom(b *bolt.Bucket, maxEntries int) error {
+	var oldest []byte
+	var oldestSeen time.Time
+	n := 0
+	_ = b.ForEach(func(k, v []byte) error {
+		n++
+		if _, last, ok := decodeHistoryTimes(v); !ok || oldest == nil || last.Before(oldestSeen) {
+			oldest, oldestSeen = k, last
+		}
+		return nil
+	})
+	if n < maxEntries {
+		return nil
+	}
+	return b.Delete(oldest)
+}
+
+// History returns the addresses the key has been seen from, the most recently seen first.
+func (s *HistoryStore) History(key string) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyKeysBucket).Bucket(hashAPIKey(key))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			first, last, ok := decodeHistoryTimes(v)
+			if !ok || len(k) != 16 {
+				return nil
+			}
+			addr := netip.AddrFrom16([16]byte(k)).Unmap()
+			entries = append(entries, HistoryEntry{IP: addr.String(), FirstSeen: first, LastSeen: last})
+			return nil
+		})
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastSeen.After(entries[j].LastSeen) })
+	return entries, err
+}
+
+// Changes returns the changes of the address the key has been seen from, the most recent
+// first.
+func (s *HistoryStore) Changes(key string) ([]HistoryChange, error) {
+	var changes []HistoryChange
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyChangesBucket).Bucket(hashAPIKey(key))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			at, ok := decodeHistoryTime(k)
+			if !ok || len(v) != 16 {
+				continue
+			}
+			addr := netip.AddrFrom16([16]byte(v)).Unmap()
+			changes = append(changes, HistoryChange{IP: addr.String(), Time: at})
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// Prune removes the entries which haven't been seen for longer than the retention, keys which
+// are left without any, and the changes made before the retention but the most recent one.
+// Changes older than 30 days are downsampled to the last one of each UTC day, and snapshots
+// which didn't change the address are dropped. Returns the number of entries and changes
+// removed.
+func (s *HistoryStore) Prune(now time.Time) (int, error) {
+	var cutoff time.Time
+	if s.retention > 0 {
+		cutoff = now.Add(-s.retention)
+	}
+	daily := now.Add(-historyDailyAfter)
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		keys, changes := tx.Bucket(historyKeysBucket), tx.Bucket(historyChangesBucket)
+		var emptyKeys [][]byte
+		err := changes.ForEachBucket(func(hashed []byte) error {
+			n, err := pruneChanges(changes.Bucket(hashed), cutoff, daily)
+			removed += n
+			return err
+		})
+		if err != nil || cutoff.IsZero() {
+			return err
+		}
+		err = keys.ForEachBucket(func(hashed []byte) error {
+			b := keys.Bucket(hashed)
+			var expired [][]byte
+			n := 0
+			_ = b.ForEach(func(k, v []byte) error {
+				n++
+				if _, last, ok := decodeHistoryTimes(v); !ok || last.Before(cutoff) {
+					expired = append(expired, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			removed += len(expired)
+			if n == len(expired) {
+				emptyKeys = append(emptyKeys, append([]byte(nil), hashed...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, hashed := range emptyKeys {
+			if err := keys.DeleteBucket(hashed); err != nil {
+				return err
+			}
+			if err := changes.DeleteBucket(hashed); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// A change of address as stored, for pruning.
+type storedChange struct {
+	k, addr []byte
+	at      time.Time
+}
+
+// Downsamples the changes made before daily to the last change of each UTC day, drops changes
+// to the address it already was, and removes those made before the cutoff except the most
+// recent one, which is the address at the cutoff. Returns the number of changes removed.
+func pruneChanges(b *bolt.Bucket, cutoff, daily time.Time) (int, error) {
+	var all, invalid []storedChange
+	_ = b.ForEach(func(k, v []byte) error {
+		c := storedChange{k: append([]byte(nil), k...), addr: append([]byte(nil), v...)}
+		var ok bool
+		if c.at, ok = decodeHistoryTime(k); !ok || len(v) != 16 {
+			invalid = append(invalid, c)
+		} else {
+			all = append(all, c)
+		}
+		return nil
+	})
+
+	var snapshots []storedChange
+	for i, c := range all {
+		if c.at.Before(daily) && i+1 < len(all) && all[i+1].at.Format(time.DateOnly) == c.at.Format(time.DateOnly) {
+			continue
+		}
+		snapshots = append(snapshots, c)
+	}
+	var kept []storedChange
+	for i, c := range snapshots {
+		if len(kept) > 0 && bytes.Equal(kept[len(kept)-1].addr, c.addr) {
+			continue
+		}
+		// The last change before the cutoff is the address at the start of the retained
+		// window, only those it superseded are dropped
+		if c.at.Before(cutoff) && i+1 < len(snapshots) && snapshots[i+1].at.Before(cutoff) {
+			continue
+		}
+		kept = append(kept, c)
+	}
+
+	keep := make(map[string]bool, len(kept))
+	for _, c := range kept {
+		keep[string(c.k)] = true
+	}
+	removed := 0
+	for _, c := range append(invalid, all...) {
+		if keep[string(c.k)] {
+			continue
+		}
+		if err := b.Delete(c.k); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// PruneEvery prunes the history at the interval until the context expires.
+func (s *HistoryStore) PruneEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if removed, err := s.Prune(time.Now()); err != nil {
+			slog.Error("failed to prune history", slog.Any("error", err))
+		} else if removed > 0 {
+			slog.Info("Pruned history", slog.Int("removed", removed))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Returns the API key of a request, sent as a bearer token.
+func requestAPIKey(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// Records the address of every request made with one of the configured API keys. Anything
+// else is never written, so clients can't grow the database by making up keys. The address is
+// the one the connection vouches for, not what the client claims in forwarding headers.
+func (s *service) recordHistory(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if key, ok := requestAPIKey(req); ok && APIKeyName(req) != "" {
+			if ip, err := netip.ParseAddr(s.proxies.clientIP(req)); err == nil {
+				if err := s.history.Record(key, ip, time.Now()); err != nil {
+					slog.Warn("failed to record history", slog.Any("error", err))
+				}
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Lists the addresses the API key of the request has been seen from, including the one of
+// the request itself, and the changes of its address. The changes alone are exported as CSV
+// when asked for with Accept: text/csv. A key owned by a user can list the history of the
+// other keys of the user with ?key=<name>. The route is only served with API keys, which it
+// requires.
+func (s *service) handleHistoryReq(w http.ResponseWriter, req *http.Request) {
+	Negotiate(map[string]http.HandlerFunc{
+		"text/csv": s.handleHistoryCSVReq,
+	}, s.handleHistoryJSONReq)(w, req)
+}
+
+// Returns the API key whose history the request asks for, writing an error and returning
+// false if it isn't the key of the request or another key of the same user.
+func (s *service) historyKey(w http.ResponseWriter, req *http.Request) (string, bool) {
+	own := s.keysByName[APIKeyName(req)]
+	name := req.URL.Query().Get("key")
+	if name == "" || name == own.Name {
+		return own.Key, true
+	}
+	if k, ok := s.keysByName[name]; ok && own.User != "" && k.User == own.User {
+		return k.Key, true
+	}
+	// Keys of other users aren't told apart from keys which don't exist
+	s.writeError(w, req, http.StatusNotFound, "no API key of the same user is named "+strconv.Quote(name))
+	return "", false
+}
+
+func (s *service) handleHistoryJSONReq(w http.ResponseWriter, req *http.Request) {
+	key, ok := s.historyKey(w, req)
+	if !ok {
+		return
+	}
+	entries, err := s.history.History(key)
+	if err != nil {
+		slog.Error("failed to read history", slog.Any("error", err))
+		s.writeError(w, req, http.StatusInternalServerError, "failed to read history")
+		return
+	}
+	changes, err := s.history.Changes(key)
+	if err != nil {
+		slog.Error("failed to read history", slog.Any("error", err))
+		s.writeError(w, req, http.StatusInternalServerError, "failed to read history")
+		return
+	}
+	if entries == nil {
+		entries = []HistoryEntry{}
+	}
+	if changes == nil {
+		changes = []HistoryChange{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]any{"history": entries, "changes": changes})
+}
+
+func (s *service) handleHistoryCSVReq(w http.ResponseWriter, req *http.Request) {
+	key, ok := s.historyKey(w, req)
+	if !ok {
+		return
+	}
+	changes, err := s.history.Changes(key)
+	if err != nil {
+		slog.Error("failed to read history", slog.Any("error", err))
+		s.writeError(w, req, http.StatusInternalServerError, "failed to read history")
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="history.csv"`)
+	w.Header().Set("Cache-Control", "no-store")
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"time", "ip"})
+	for _, c := range changes {
+		_ = out.Write([]string{c.Time.Format(time.RFC3339Nano), c.IP})
+	}
+	out.Flush()
+}
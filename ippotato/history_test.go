@@ -0,0 +1,444 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestHistory(t *testing.T, retention time.Duration, maxEntries int) *HistoryStore {
+	t.Helper()
+	store, err := OpenHistoryStore(filepath.Join(t.TempDir(), "history.db"), retention, maxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func record(t *testing.T, store *HistoryStore, key, ip string, at time.Time) {
+	t.Helper()
+	if err := store.Record(key, netip.MustParseAddr(ip), at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func historyIPs(t *testing.T, store *HistoryStore, key string) []string {
+	t.Helper()
+	entries, err := store.History(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := []string{}
+	for _, e := range entries {
+		ips = append(ips, e.IP)
+	}
+	return ips
+}
+
+var historyStart = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+func TestHistoryRecord(t *testing.T) {
+	store := openTestHistory(t, 0, 0)
+	record(t, store, "key-a", "192.0.2.10", historyStart)
+	record(t, store, "key-a", "2001:db8::1", historyStart.Add(time.Hour))
+	record(t, store, "key-a", "192.0.2.10", historyStart.Add(2*time.Hour))
+	// Within the resolution of last seen, so not written
+	record(t, store, "key-a", "192.0.2.10", historyStart.Add(2*time.Hour+time.Second))
+	record(t, store, "key-b", "198.51.100.1", historyStart)
+
+	entries, err := store.History("key-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []HistoryEntry{
+		{IP: "192.0.2.10", FirstSeen: historyStart, LastSeen: historyStart.Add(2 * time.Hour)},
+		{IP: "2001:db8::1", FirstSeen: historyStart.Add(time.Hour), LastSeen: historyStart.Add(time.Hour)},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v, want %+v", entries, want)
+	}
+	if got := historyIPs(t, store, "key-b"); !reflect.DeepEqual(got, []string{"198.51.100.1"}) {
+		t.Errorf("got %v for another key, want only its own address", got)
+	}
+	if got := historyIPs(t, store, "unknown"); len(got) != 0 {
+		t.Errorf("got %v for an unknown key, want nothing", got)
+	}
+}
+
+func TestHistoryMaxEntries(t *testing.T) {
+	store := openTestHistory(t, 0, 2)
+	record(t, store, "key", "192.0.2.1", historyStart)
+	record(t, store, "key", "192.0.2.2", historyStart.Add(time.Hour))
+	record(t, store, "key", "192.0.2.1", historyStart.Add(2*time.Hour))
+	record(t, store, "key", "192.0.2.3", historyStart.Add(3*time.Hour))
+
+	if got, want := historyIPs(t, store, "key"), []string{"192.0.2.3", "192.0.2.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v with the least recently seen dropped", got, want)
+	}
+}
+
+func TestHistoryPrune(t *testing.T) {
+	store := openTestHistory(t, 24*time.Hour, 0)
+	record(t, store, "key-a", "192.0.2.1", historyStart)
+	record(t, store, "key-a", "192.0.2.2", historyStart.Add(12*time.Hour))
+	record(t, store, "key-b", "192.0.2.3", historyStart)
+
+	removed, err := store.Prune(historyStart.Add(30 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both expired entries, but not the change to 192.0.2.1 which was still the address at the
+	// cutoff
+	if removed != 2 {
+		t.Errorf("removed %d entries and changes, want 2", removed)
+	}
+	want := []HistoryChange{{IP: "192.0.2.2", Time: historyStart.Add(12 * time.Hour)}, {IP: "192.0.2.1", Time: historyStart}}
+	if got := historyChanges(t, store, "key-a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got changes %+v, want %+v", got, want)
+	}
+	if got, want := historyIPs(t, store, "key-a"), []string{"192.0.2.2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := historyIPs(t, store, "key-b"); len(got) != 0 {
+		t.Errorf("got %v, want the expired history to be gone", got)
+	}
+}
+
+func historyChanges(t *testing.T, store *HistoryStore, key string) []HistoryChange {
+	t.Helper()
+	changes, err := store.Changes(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changes
+}
+
+func TestHistoryChanges(t *testing.T) {
+	store := openTestHistory(t, 0, 0)
+	record(t, store, "key", "192.0.2.1", historyStart)
+	record(t, store, "key", "192.0.2.2", historyStart.Add(2*time.Minute))
+	// Being seen again from the same address isn't a change
+	record(t, store, "key", "192.0.2.2", historyStart.Add(time.Hour))
+	record(t, store, "key", "192.0.2.1", historyStart.Add(2*time.Hour))
+	// A change within a minute of the previous one replaces it, changing back undoes it
+	record(t, store, "key", "192.0.2.3", historyStart.Add(3*time.Hour))
+	record(t, store, "key", "192.0.2.4", historyStart.Add(3*time.Hour+10*time.Second))
+	record(t, store, "key", "192.0.2.1", historyStart.Add(3*time.Hour+20*time.Second))
+
+	want := []HistoryChange{
+		{IP: "192.0.2.1", Time: historyStart.Add(2 * time.Hour)},
+		{IP: "192.0.2.2", Time: historyStart.Add(2 * time.Minute)},
+		{IP: "192.0.2.1", Time: historyStart},
+	}
+	if got := historyChanges(t, store, "key"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := historyChanges(t, store, "unknown"); len(got) != 0 {
+		t.Errorf("got %+v for an unknown key, want nothing", got)
+	}
+}
+
+// A dual-stack client alternating between its addresses on every request adds at most a
+// change a minute, and no more than the maximum number of entries.
+func TestHistoryAlternatingAddresses(t *testing.T) {
+	store := openTestHistory(t, 0, 50)
+	at := historyStart
+	for i := range 60 {
+		record(t, store, "key", []string{"192.0.2.1", "2001:db8::1"}[i%2], at)
+		at = at.Add(10 * time.Second)
+	}
+	if n := len(historyChanges(t, store, "key")); n > 10 {
+		t.Errorf("recorded %d changes in 10 minutes, want at most one a minute", n)
+	}
+	for i := range 1000 {
+		record(t, store, "key", []string{"192.0.2.1", "2001:db8::1"}[i%2], at)
+		at = at.Add(2 * time.Minute)
+	}
+	changes := historyChanges(t, store, "key")
+	if len(changes) != 50 {
+		t.Errorf("kept %d changes, want the maximum of 50", len(changes))
+	}
+	if !changes[0].Time.Equal(at.Add(-2 * time.Minute)) {
+		t.Errorf("the most recent change is %+v, want the oldest to be dropped", changes[0])
+	}
+}
+
+func TestHistoryDownsample(t *testing.T) {
+	day := func(days, hour int) time.Time {
+		return historyStart.Truncate(24*time.Hour).AddDate(0, 0, days).Add(time.Duration(hour) * time.Hour)
+	}
+	changes := []struct {
+		at time.Time
+		ip string
+	}{
+		{day(-40, 8), "192.0.2.1"},
+		{day(-40, 12), "192.0.2.2"},
+		{day(-40, 20), "192.0.2.3"},
+		{day(-35, 10), "192.0.2.4"},
+		{day(-10, 9), "192.0.2.5"},
+		{day(-10, 10), "192.0.2.6"},
+	}
+	tests := []struct {
+		name      string
+		retention time.Duration
+		want      []string
+	}{
+		{name: "forever", want: []string{"192.0.2.6", "192.0.2.5", "192.0.2.4", "192.0.2.3"}},
+		// 192.0.2.4 is the address at the cutoff, the changes before it are dropped
+		{name: "retention", retention: 20 * 24 * time.Hour, want: []string{"192.0.2.6", "192.0.2.5", "192.0.2.4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openTestHistory(t, tt.retention, 0)
+			for _, c := range changes {
+				record(t, store, "key", c.ip, c.at)
+			}
+			if _, err := store.Prune(historyStart); err != nil {
+				t.Fatal(err)
+			}
+			var ips []string
+			for _, c := range historyChanges(t, store, "key") {
+				ips = append(ips, c.IP)
+			}
+			if !reflect.DeepEqual(ips, tt.want) {
+				t.Errorf("got changes %v, want %v", ips, tt.want)
+			}
+		})
+	}
+
+	// Snapshots of days which ended on the address of the day before aren't changes either
+	store := openTestHistory(t, 0, 0)
+	for _, c := range []struct {
+		at time.Time
+		ip string
+	}{
+		{day(-40, 8), "192.0.2.1"},
+		{day(-40, 12), "192.0.2.2"},
+		{day(-40, 20), "192.0.2.1"},
+		{day(-39, 10), "192.0.2.2"},
+		{day(-39, 20), "192.0.2.1"},
+		{day(-35, 10), "192.0.2.3"},
+	} {
+		record(t, store, "key", c.ip, c.at)
+	}
+	if _, err := store.Prune(historyStart); err != nil {
+		t.Fatal(err)
+	}
+	want := []HistoryChange{{IP: "192.0.2.3", Time: day(-35, 10)}, {IP: "192.0.2.1", Time: day(-40, 20)}}
+	if got := historyChanges(t, store, "key"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// The most recent change is the current address, however old it is
+	store = openTestHistory(t, 20*24*time.Hour, 0)
+	record(t, store, "key", "192.0.2.1", day(-45, 8))
+	record(t, store, "key", "192.0.2.2", day(-40, 8))
+	record(t, store, "key", "192.0.2.2", day(-1, 8))
+	if _, err := store.Prune(historyStart); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := historyChanges(t, store, "key"), []HistoryChange{{IP: "192.0.2.2", Time: day(-40, 8)}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestHistorySchemaVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	store, err := OpenHistoryStore(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, store, "key", "192.0.2.1", historyStart)
+	store.Close()
+
+	// Reopening keeps the recorded history
+	if store, err = OpenHistoryStore(path, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := historyIPs(t, store, "key"); !reflect.DeepEqual(got, []string{"192.0.2.1"}) {
+		t.Errorf("got %v after reopening, want the recorded address", got)
+	}
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyMetaBucket).Put(historySchemaKey, []byte("99"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	if _, err := OpenHistoryStore(path, 0, 0); err == nil || !strings.Contains(err.Error(), "unsupported schema version 99") {
+		t.Errorf("got error %v, want the unknown schema version to be refused", err)
+	}
+}
+
+// A database of version 1 is upgraded, keeping its addresses and recording changes from then on.
+func TestHistorySchemaUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	store, err := OpenHistoryStore(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(t, store, "key", "192.0.2.1", historyStart)
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(historyChangesBucket); err != nil {
+			return err
+		}
+		return tx.Bucket(historyMetaBucket).Put(historySchemaKey, []byte("1"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	if store, err = OpenHistoryStore(path, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got := historyIPs(t, store, "key"); !reflect.DeepEqual(got, []string{"192.0.2.1"}) {
+		t.Errorf("got %v after upgrading, want the recorded address", got)
+	}
+	record(t, store, "key", "192.0.2.2", historyStart.Add(time.Hour))
+	if got, want := historyChanges(t, store, "key"), []HistoryChange{{IP: "192.0.2.2", Time: historyStart.Add(time.Hour)}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v after upgrading, want %+v", got, want)
+	}
+	_ = store.db.View(func(tx *bolt.Tx) error {
+		if schema := tx.Bucket(historyMetaBucket).Get(historySchemaKey); string(schema) != historySchema {
+			t.Errorf("schema version is %s after upgrading, want %s", schema, historySchema)
+		}
+		return nil
+	})
+}
+
+func TestHandleHistory(t *testing.T) {
+	store := openTestHistory(t, 0, 0)
+	if s := newService(Options{History: store}); s.history != nil {
+		t.Fatal("the history is enabled without API keys")
+	}
+	h := Handler(Options{History: store, APIKeys: []APIKey{{Name: "a", Key: "secret"}, {Name: "b", Key: "other"}}})
+	accept := "application/json"
+	request := func(remoteAddr, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/history", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Accept", accept)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request("192.0.2.10:51234", ""); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("got status %d without a key, want %d with a challenge", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := request("192.0.2.10:51234", "Basic dTpw"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d with basic auth, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	changedAt := time.Now().Add(-time.Hour).UTC()
+	record(t, store, "secret", "198.51.100.1", changedAt)
+	rec := request("192.0.2.10:51234", "Bearer secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+	}
+	var resp struct {
+		History []HistoryEntry  `json:"history"`
+		Changes []HistoryChange `json:"changes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	var ips []string
+	for _, e := range resp.History {
+		ips = append(ips, e.IP)
+	}
+	if want := []string{"192.0.2.10", "198.51.100.1"}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("got %v, want %v including the address of the request itself", ips, want)
+	}
+	if len(resp.Changes) != 2 || resp.Changes[0].IP != "192.0.2.10" || resp.Changes[1].IP != "198.51.100.1" {
+		t.Errorf("got changes %+v, want the change to the address of the request first", resp.Changes)
+	}
+
+	accept = "text/csv"
+	rec = request("192.0.2.10:51234", "Bearer secret")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("got status %d with Content-Type %q, want CSV", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+	if len(lines) != 3 || lines[0] != "time,ip" || !strings.HasSuffix(lines[1], ",192.0.2.10") {
+		t.Errorf("got CSV %q", rec.Body)
+	}
+	if want := changedAt.Format(time.RFC3339Nano) + ",198.51.100.1"; len(lines) == 3 && lines[2] != want {
+		t.Errorf("got CSV row %q, want %q", lines[2], want)
+	}
+	accept = "application/json"
+
+	if rec := request("192.0.2.10:51234", "Bearer made-up"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d with an unknown key, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if got := historyIPs(t, store, "made-up"); len(got) != 0 {
+		t.Errorf("got %v for an unknown key, want it not to be recorded", got)
+	}
+
+	// Requests to other routes are recorded too, by the address of the connection rather than
+	// the one claimed in X-Forwarded-For, and the key is never stored in the clear
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.5:51234"
+	req.Header.Set("Authorization", "bearer other")
+	req.Header.Set("X-Forwarded-For", "198.51.100.99")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got := historyIPs(t, store, "other"); !reflect.DeepEqual(got, []string{"203.0.113.5"}) {
+		t.Errorf("got %v, want the address of the connection of the request to /", got)
+	}
+	_ = store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyKeysBucket).ForEachBucket(func(k []byte) error {
+			if strings.Contains(string(k), "other") || strings.Contains(string(k), "secret") {
+				t.Errorf("history is stored under the plain key %q", k)
+			}
+			return nil
+		})
+	})
+}
+
+// The keys of a user can read the history of each other, but not of the keys of others.
+func TestHandleHistoryOfUser(t *testing.T) {
+	store := openTestHistory(t, 0, 0)
+	h := Handler(Options{History: store, APIKeys: []APIKey{
+		{Name: "laptop", Key: "key-l", User: "alice"},
+		{Name: "router", Key: "key-r", User: "alice"},
+		{Name: "nas", Key: "key-n", User: "bob"},
+		{Name: "ci", Key: "key-c"},
+	}})
+	record(t, store, "key-r", "198.51.100.1", historyStart)
+	record(t, store, "key-n", "198.51.100.2", historyStart)
+	request := func(key, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/history"+query, nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("Accept", "text/csv")
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("key-l", "?key=router")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), ",198.51.100.1\n") || strings.Contains(rec.Body.String(), "192.0.2.10") {
+		t.Errorf("got status %d with %q, want the history of the other key of the user", rec.Code, rec.Body)
+	}
+	for _, tt := range []struct{ key, query string }{
+		{"key-l", "?key=nas"},
+		{"key-l", "?key=missing"},
+		{"key-c", "?key=router"},
+	} {
+		if rec := request(tt.key, tt.query); rec.Code != http.StatusNotFound || strings.Contains(rec.Body.String(), "198.51.100") {
+			t.Errorf("got status %d with %q for %s%s, want %d", rec.Code, rec.Body, tt.key, tt.query, http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package ippotato
+
+import (
+	"embed"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed translations/*.json
+var translationFiles embed.FS
+
+// The language pages fall back to, which every other translation falls back to for labels
+// it doesn't have.
+const defaultLanguage = "en"
+
+// The labels of the HTML pages by language, each complete thanks to the fallback.
+var translations = loadTranslations()
+
+func loadTranslations() map[string]map[string]string {
+	files, err := translationFiles.ReadDir("translations")
+	if err != nil {
+		panic(err)
+	}
+	all := map[string]map[string]string{}
+	for _, f := range files {
+		contents, err := translationFiles.ReadFile("translations/" + f.Name())
+		if err != nil {
+			panic(err)
+		}
+		labels := map[string]string{}
+		if err := json.Unmarshal(contents, &labels); err != nil {
+			panic("translations/" + f.Name() + ": " + err.Error())
+		}
+		all[strings.TrimSuffix(f.Name(), path.Ext(f.Name()))] = labels
+	}
+	for lang, labels := range all {
+		for key, label := range all[defaultLanguage] {
+			if _, ok := labels[key]; !ok {
+				all[lang][key] = label
+			}
+		}
+	}
+	return all
+}
+
+// Picks the language of the page: the lang query parameter if there is a translation for it,
+// otherwise the most preferred language of the Accept-Language header there is one for,
+// matching regional variants such as de-AT by their base language.
+func negotiateLanguage(req *http.Request) string {
+	if lang := strings.ToLower(req.URL.Query().Get("lang")); translations[lang] != nil {
+		return lang
+	}
+	type preference struct {
+		lang string
+		q    float64
+	}
+	var preferences []preference
+	for _, part := range strings.Split(req.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if tag != "" && q > 0 {
+			preferences = append(preferences, preference{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(preferences, func(i, j int) bool { return preferences[i].q > preferences[j].q })
+	for _, p := range preferences {
+		base, _, _ := strings.Cut(p.lang, "-")
+		if translations[p.lang] != nil {
+			return p.lang
+		}
+		if translations[base] != nil {
+			return base
+		}
+	}
+	return defaultLanguage
+}
+
+// Renders the page template in the language of the request. Templates find the labels under
+// t and the language under lang.
+func (s *service) renderPage(w http.ResponseWriter, req *http.Request, name string, data map[string]any) {
+	s.renderPageStatus(w, req, http.StatusOK, name, data)
+}
+
+func (s *service) renderPageStatus(w http.ResponseWriter, req *http.Request, status int, name string, data map[string]any) {
+	lang := negotiateLanguage(req)
+	data["lang"], data["t"] = lang, translations[lang]
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := s.templates.execute(w, name, data); err != nil {
+		slog.Error("failed to render html template", slog.Any("error", err))
+	}
+}
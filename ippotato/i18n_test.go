@@ -0,0 +1,56 @@
+package ippotato
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	tests := []struct {
+		query, acceptLanguage, want string
+	}{
+		{"", "", "en"},
+		{"", "de", "de"},
+		{"", "de-AT,en;q=0.5", "de"},
+		{"", "ja,fr;q=0.8,de;q=0.9", "de"},
+		{"", "ja, *;q=0.5", "en"},
+		{"", "fr;q=0,es", "es"},
+		{"?lang=FR", "de", "fr"},
+		{"?lang=xx", "es", "es"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/"+tt.query, nil)
+		req.Header.Set("Accept-Language", tt.acceptLanguage)
+		if got := negotiateLanguage(req); got != tt.want {
+			t.Errorf("got %s for %q with Accept-Language %q, want %s", got, tt.query, tt.acceptLanguage, tt.want)
+		}
+	}
+}
+
+func TestTranslationsAreComplete(t *testing.T) {
+	for lang, labels := range translations {
+		if len(labels) != len(translations[defaultLanguage]) {
+			t.Errorf("%s has %d labels, want the %d of %s", lang, len(labels), len(translations[defaultLanguage]), defaultLanguage)
+		}
+	}
+}
+
+func TestLocalizedPage(t *testing.T) {
+	h := Handler(Options{})
+	req := httptest.NewRequest(http.MethodGet, "/hints", nil)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Accept-Language", "de-DE")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	for _, want := range []string{`<html lang="de">`, "Deine IP-Adresse", "Dein Browser hat keine Client Hints gesendet."} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the page doesn't contain %q:\n%s", want, body)
+		}
+	}
+	if got := rec.Header().Get("Content-Language"); got != "de" {
+		t.Errorf("got Content-Language %q, want de", got)
+	}
+}
@@ -0,0 +1,459 @@
+// Package ippotato serves clients their own IP address and what is known about it, as
+// HTML, JSON or plain text depending on what they accept. It is the library behind
+// https://ip-potato.com and can be mounted in any Go http server:
+//
+//	http.Handle("/", ippotato.Handler(ippotato.Options{}))
+//
+// Details which describe the connection rather than the request, such as whether it was
+// reused or the TLS fingerprint of the client, additionally need the server's ConnContext
+// set to ConnContext and, for fingerprints, a listener wrapped with NewListener. The SYN
+// details of /conn need the listener to be created with ListenConfig.
+package ippotato
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"embed"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+//go:embed templates/*.html
+var htmlTemplates embed.FS
+
+//go:embed static/*
+var staticFS embed.FS
+
+// Options configures the handler returned by Handler. The zero value serves the address of
+// the client and the details of the request, every lookup which needs a data source or
+// makes network requests is disabled.
+type Options struct {
+	// Base URL of a RIPEstat compatible looking glass API, e.g. https://stat.ripe.net. Enables
+	// /bgp and the routing fields of /json.
+	BGPAPI string
+	// Attribution included with routing information from the looking glass API.
+	BGPAttribution string
+	// Timeout for requests to the looking glass API, 3s if zero.
+	BGPTimeout time.Duration
+	// How long routing information is cached, not at all if zero.
+	BGPCacheTTL time.Duration
+
+	// Base URL of an RDAP bootstrap service such as https://rdap.org, enables /whois.
+	RDAPURL string
+	// Timeout for RDAP lookups, including redirects to the registry, 3s if zero.
+	RDAPTimeout time.Duration
+	// How long registrations are cached, not at all if zero.
+	RDAPCacheTTL time.Duration
+
+	// Enables /asn and the AS fields of /json.
+	ASNDB *ASNDB
+
+	// Enables /hostname and the hostname field of /json.
+	ReverseDNS bool
+	// Timeout for reverse DNS lookups, 500ms if zero.
+	RDNSTimeout time.Duration
+	// How long hostnames and addresses without a PTR record are cached, not at all if zero.
+	RDNSCacheTTL    time.Duration
+	RDNSNegativeTTL time.Duration
+	// Used for all DNS lookups, the system resolver if nil.
+	Resolver Resolver
+
+	// Enables /blacklist, which checks the client address against these DNSBL zones, e.g.
+	// zen.spamhaus.org.
+	DNSBLZones []string
+	// Timeout for checking every zone, 2s if zero.
+	DNSBLTimeout time.Duration
+	// How long the results of an address are cached, not at all if zero.
+	DNSBLCacheTTL time.Duration
+
+	// Headers whose values echo endpoints such as /headers redact, Authorization and Cookie
+	// if nil.
+	EchoRedactHeaders []string
+	// Header values longer than this are truncated by echo endpoints, 1024 if zero.
+	EchoMaxValueBytes int
+	// Maximum number of headers reflected by echo endpoints, 64 if zero.
+	EchoMaxHeaders int
+	// Request bodies longer than this are truncated by /echo, 64KiB if zero.
+	EchoMaxBodyBytes int64
+
+	// Parse the User-Agent into browser, OS and device fields in the JSON form of /ua.
+	ParseUserAgent bool
+
+	// The TLS configuration of the server the handler is mounted in, if it serves TLS.
+	// Enables /fingerprint and, if client certificates are requested, /cert.
+	TLSConfig *tls.Config
+
+	// Defaults of plain text responses, which requests can override with the eol, bom and
+	// newline query parameters.
+	TextCRLF              bool
+	TextBOM               bool
+	TextNoTrailingNewline bool
+
+	// How long the details looked up for an address are reused by following requests, not
+	// at all if zero.
+	MicroCacheTTL time.Duration
+
+	// The proxies in front of the server, whose X-Real-IP and X-Forwarded-For headers name the
+	// client. Rate limits, port checks, the lookups of /asn, /bgp, /blacklist, /hostname, /json
+	// and /whois, the history and signed responses only ever use the address of the connection
+	// otherwise, since any client can send those headers.
+	TrustedProxies []netip.Prefix
+
+	// Requests per second each client may make to the browser API, /api/v1/ip and /both
+	// together, with up to APIBurst requests in a burst. Unlimited if zero.
+	APIRate  float64
+	APIBurst int
+
+	// Enables /portcheck, which connects back to the client to tell whether a port is
+	// reachable, for the ports in these ranges. Checks always need one of the APIKeys, so
+	// /portcheck isn't served without them.
+	PortCheckPorts []PortRange
+	// Timeout for connecting back to the client, 3s if zero.
+	PortCheckTimeout time.Duration
+	// Checks per second each client may request, with up to PortCheckBurst checks in a burst.
+	// Unlimited if zero.
+	PortCheckRate  float64
+	PortCheckBurst int
+
+	// Enables the bandwidth tests /speed/down and /speed/up, which transfer up to this many
+	// bytes per request.
+	SpeedMaxBytes int64
+	// Bandwidth tests per second each client may run, with up to SpeedBurst tests in a burst.
+	// Unlimited if zero.
+	SpeedRate  float64
+	SpeedBurst int
+
+	// Records the addresses requests with one of the APIKeys come from and enables /history,
+	// where they and the changes between them can be listed or exported as CSV with the same
+	// key or another key of the same user. Ignored without APIKeys.
+	History *HistoryStore
+
+	// Once set, the routes which are costly to serve or reveal more than the address itself,
+	// /bgp, /asn, /hostname, /whois, /blacklist, /portcheck and /history, need one of these
+	// keys as a bearer token, and /json only includes the details those routes look up with
+	// one. Only requests with one of them are recorded in the history, and /whois can only
+	// look up addresses other than the client's with a key.
+	APIKeys []APIKey
+	// The users owning APIKeys and their quotas. Keys can name users which aren't listed here,
+	// who have the DefaultQuota.
+	Users []User
+	// The quota of API keys and users which don't have their own. Each key can check its quota at
+	// /usage, responses to requests with a key describe it in RateLimit headers.
+	DefaultQuota Quota
+
+	// Base URLs of hostnames which only resolve to the IPv4 and only to the IPv6 addresses of
+	// the server, e.g. https://ipv4.example.com. Once both are set, the HTML page shows the
+	// address of the client in both families, fetched from /both on each hostname.
+	IPv4URL string
+	IPv6URL string
+
+	// The templates of the HTML pages, the embedded ones if nil.
+	Templates *Templates
+	// A directory whose files are served under /static/ in place of the embedded ones of the
+	// same name. Files are read on every request, so edits take effect immediately.
+	StaticDir string
+
+	// Counts the clients of every request in these estimates of unique clients per hour and
+	// day, which AdminHandler serves at /stats and in the metrics. Disabled if nil.
+	ClientStats *ClientStats
+
+	// Signs the JSON responses of / and /json and enables /pubkey, which serves the public key
+	// to verify them with. Only addresses of the connection or forwarded by TrustedProxies are
+	// signed.
+	SigningKey ed25519.PrivateKey
+
+	// Wraps every route, in order, the first outermost. It runs after requests are counted in
+	// the metrics, so responses written by the middleware itself are counted too.
+	Middleware []Middleware
+}
+
+// The state of a handler: its options turned into the subsystems they enable. Subsystems
+// which are disabled are nil.
+type service struct {
+	bgp             *bgpClient
+	rdap            *rdapClient
+	asns            *ASNDB
+	rdns            *reverseDNS
+	dnsbl           *dnsblChecker
+	echo            echoPolicy
+	text            textOptions
+	parseUserAgents bool
+	details         *microCache
+	apiLimiter      *rateLimiter
+	portCheck       *portChecker
+	speed           *speedTest
+	signer          *responseSigner
+	history         *HistoryStore
+	apiKeys         apiKeySet
+	keysByName      map[string]APIKey
+	quotas          *quotas
+	clientStats     *ClientStats
+	dualStack       dualStackURLs
+	templates       *Templates
+	proxies         trustedProxies
+}
+
+// Returns the handler serving every route enabled by the options. Other paths, including
+// those of routes which aren't enabled, are answered with 404 Not Found, and methods a route
+// doesn't serve with 405 Method Not Allowed, in the media type the client asked for.
+func Handler(opts Options) http.Handler {
+	s := newService(opts)
+
+	subFS, err := fs.Sub(staticFS, "static")
+	if err != nil {
+		panic(err)
+	}
+	if opts.StaticDir != "" {
+		subFS = overlayFS{primary: os.DirFS(opts.StaticDir), fallback: subFS}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServerFS(subFS)))
+	if s.bgp != nil {
+		mux.HandleFunc("GET /bgp", s.requireAPIKey(s.handleBGPReq))
+	}
+	if s.rdap != nil {
+		mux.HandleFunc("GET /whois", s.requireAPIKey(s.handleWhoisReq))
+	}
+	if s.asns != nil {
+		mux.HandleFunc("GET /asn", s.requireAPIKey(s.handleASNReq))
+	}
+	if s.rdns != nil {
+		mux.HandleFunc("GET /hostname", s.requireAPIKey(s.handleHostnameReq))
+	}
+	if s.dnsbl != nil {
+		mux.HandleFunc("GET /blacklist", s.requireAPIKey(s.dnsblHandler()))
+	}
+	mux.HandleFunc("GET /headers", s.headersHandler())
+	mux.HandleFunc("/echo", s.echoHandler())
+	mux.HandleFunc("GET /port", s.portHandler())
+	mux.HandleFunc("GET /ua", s.userAgentHandler())
+	if opts.TLSConfig != nil && opts.TLSConfig.ClientAuth != tls.NoClientCert {
+		mux.HandleFunc("GET /cert", s.certHandler())
+	}
+	if opts.TLSConfig != nil {
+		mux.HandleFunc("GET /fingerprint", s.fingerprintHandler())
+	}
+	mux.HandleFunc("GET /proto", s.protoHandler())
+	if tcpInfoSupported {
+		mux.HandleFunc("GET /conn", s.connHandler())
+	}
+	mux.HandleFunc("GET /hints", s.hintsHandler())
+	mux.HandleFunc("GET /latency", s.latencyHandler())
+	mux.Handle("GET /api/v1/ip", Chain(http.HandlerFunc(s.handleAPIIPReq), s.apiMiddleware("/api/v1/ip")...))
+	mux.Handle("OPTIONS /api/v1/ip", Chain(http.HandlerFunc(handleAPIPreflightReq), apiHeaders))
+	if s.dualStack.enabled() {
+		mux.Handle("GET /both", Chain(http.HandlerFunc(s.handleBothReq), s.apiMiddleware("/both")...))
+		mux.Handle("OPTIONS /both", Chain(http.HandlerFunc(handleAPIPreflightReq), apiHeaders))
+	}
+	if s.portCheck != nil {
+		mux.HandleFunc("GET /portcheck", s.portCheckHandler())
+	}
+	if s.speed != nil {
+		mux.Handle("GET /speed/down", s.speedTestMiddleware("/speed/down", s.handleSpeedDownReq))
+		mux.Handle("POST /speed/up", s.speedTestMiddleware("/speed/up", s.speedUpHandler()))
+	}
+	if s.history != nil {
+		mux.HandleFunc("GET /history", s.requireAPIKey(s.handleHistoryReq))
+	}
+	if s.quotas != nil {
+		mux.HandleFunc("GET /usage", s.requireAPIKey(s.handleUsageReq))
+	}
+	if s.signer != nil {
+		mux.HandleFunc("GET /pubkey", s.pubkeyHandler())
+	}
+	mux.HandleFunc("GET /json", s.handleExtendedReq)
+	mux.HandleFunc("GET /{$}", s.handler())
+
+	// Panics of the routes are answered inside the middleware, so the metrics and access logs
+	// see the 500, and any of the middleware itself outside of it
+	h := Chain(s.recoverPanics(s.negotiateMuxErrors(mux)), append(s.builtinMiddleware(mux), opts.Middleware...)...)
+	return s.recoverPanics(h)
+}
+
+func newService(opts Options) *service {
+	if opts.BGPTimeout == 0 {
+		opts.BGPTimeout = 3 * time.Second
+	}
+	if opts.RDAPTimeout == 0 {
+		opts.RDAPTimeout = 3 * time.Second
+	}
+	if opts.RDNSTimeout == 0 {
+		opts.RDNSTimeout = 500 * time.Millisecond
+	}
+	if opts.DNSBLTimeout == 0 {
+		opts.DNSBLTimeout = 2 * time.Second
+	}
+	if opts.PortCheckTimeout == 0 {
+		opts.PortCheckTimeout = 3 * time.Second
+	}
+	if opts.Resolver == nil {
+		opts.Resolver = net.DefaultResolver
+	}
+	if opts.EchoRedactHeaders == nil {
+		opts.EchoRedactHeaders = []string{"Authorization", "Cookie"}
+	}
+	if opts.EchoMaxValueBytes == 0 {
+		opts.EchoMaxValueBytes = 1024
+	}
+	if opts.EchoMaxHeaders == 0 {
+		opts.EchoMaxHeaders = 64
+	}
+	if opts.EchoMaxBodyBytes == 0 {
+		opts.EchoMaxBodyBytes = 64 << 10
+	}
+
+	s := &service{
+		asns:            opts.ASNDB,
+		echo:            newEchoPolicy(opts.EchoRedactHeaders, opts.EchoMaxValueBytes, opts.EchoMaxHeaders, opts.EchoMaxBodyBytes),
+		text:            textOptions{crlf: opts.TextCRLF, bom: opts.TextBOM, trailingNewline: !opts.TextNoTrailingNewline},
+		parseUserAgents: opts.ParseUserAgent,
+		clientStats:     opts.ClientStats,
+		dualStack:       newDualStackURLs(opts.IPv4URL, opts.IPv6URL),
+		templates:       opts.Templates,
+		proxies:         opts.TrustedProxies,
+	}
+	if s.templates == nil {
+		s.templates = embeddedTemplates
+	}
+	if len(opts.APIKeys) > 0 {
+		s.apiKeys = newAPIKeySet(opts.APIKeys)
+		s.keysByName = make(map[string]APIKey, len(opts.APIKeys))
+		for _, k := range opts.APIKeys {
+			s.keysByName[k.Name] = k
+		}
+		s.quotas = newQuotas(opts.APIKeys, opts.Users, opts.DefaultQuota)
+		s.history = opts.History
+	}
+	if opts.BGPAPI != "" {
+		s.bgp = newBGPClient(opts.BGPAPI, opts.BGPAttribution, opts.BGPTimeout, opts.BGPCacheTTL)
+	}
+	if opts.RDAPURL != "" {
+		s.rdap = newRDAPClient(opts.RDAPURL, opts.Resolver, opts.RDAPTimeout, opts.RDAPCacheTTL)
+	}
+	if opts.ASNDB != nil {
+		datasets.register(opts.ASNDB.info)
+	}
+	if opts.ReverseDNS {
+		s.rdns = newReverseDNS(opts.Resolver, opts.RDNSTimeout, opts.RDNSCacheTTL, opts.RDNSNegativeTTL)
+	}
+	if len(opts.DNSBLZones) > 0 {
+		s.dnsbl = newDNSBLChecker(opts.DNSBLZones, opts.Resolver, opts.DNSBLTimeout, opts.DNSBLCacheTTL)
+	}
+	s.details = newMicroCache(opts.MicroCacheTTL, s.lookupDetails)
+	if opts.APIRate > 0 {
+		s.apiLimiter = newRateLimiter(opts.APIRate, opts.APIBurst)
+	}
+	if len(opts.PortCheckPorts) > 0 && s.apiKeys != nil {
+		s.portCheck = newPortChecker(opts.PortCheckPorts, opts.PortCheckTimeout, opts.PortCheckRate, opts.PortCheckBurst)
+	}
+	if opts.SigningKey != nil {
+		s.signer = newResponseSigner(opts.SigningKey)
+	}
+	if opts.SpeedMaxBytes > 0 {
+		s.speed = newSpeedTest(opts.SpeedMaxBytes, opts.SpeedRate, opts.SpeedBurst)
+	}
+	return s
+}
+
+func (s *service) handler() http.HandlerFunc {
+	return Negotiate(map[string]http.HandlerFunc{
+		"text/html":        s.handleHTTPReq,
+		"application/json": s.handleJSONReq,
+	}, s.handleTextReq)
+}
+
+// Negotiate dispatches each request to the handler of the first media type in its Accept
+// header which has one, or to the fallback if none match.
+func Negotiate(acceptedMediaTypes map[string]http.HandlerFunc, fallback http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		accept := req.Header.Get("Accept")
+		requestedMediaTypes := strings.Split(strings.Split(accept, ";")[0], ",")
+		for _, mediaType := range requestedMediaTypes {
+			if mediaTypeHandler, isMapped := acceptedMediaTypes[strings.TrimSpace(mediaType)]; isMapped {
+				mediaTypeHandler(w, req)
+				return
+			}
+		}
+		fallback(w, req)
+	}
+}
+
+func (s *service) handleHTTPReq(w http.ResponseWriter, req *http.Request) {
+	advertiseClientHints(w)
+	s.renderPage(w, req, "index.html", map[string]any{
+		"ip":          RealIP(req),
+		"ipv4BothURL": s.dualStack.ipv4,
+		"ipv6BothURL": s.dualStack.ipv6,
+	})
+}
+
+func (s *service) handleJSONReq(w http.ResponseWriter, req *http.Request) {
+	s.writeVersionedJSON(w, req, map[string]string{
+		"ip": RealIP(req),
+	})
+}
+
+func (s *service) handleTextReq(w http.ResponseWriter, req *http.Request) {
+	s.writeText(w, req, RealIP(req))
+}
+
+// RealIP returns the address of the client, preferring the X-Real-IP and X-Forwarded-For
+// headers set by proxies over the remote address of the connection. It returns an empty
+// string if the address isn't a valid IP.
+//
+// https://github.com/go-chi/chi/blob/master/middleware/realip.go
+func RealIP(r *http.Request) string {
+	var ip string
+
+	if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
+		ip = xrip
+	} else if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		i := strings.Index(xff, ",")
+		if i == -1 {
+			i = len(xff)
+		}
+		ip = xff[:i]
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	if ip == "" || net.ParseIP(ip) == nil {
+		return ""
+	}
+	return ip
+}
+
+// NewListener wraps a listener for a server serving Handler. With proxyProtocol, every
+// connection must start with a PROXY protocol header identifying the client. With
+// fingerprintTLS the ClientHello of every connection is captured for /fingerprint, this
+// must wrap the listener below the TLS layer.
+func NewListener(ln net.Listener, proxyProtocol, fingerprintTLS bool) net.Listener {
+	if proxyProtocol {
+		ln = &proxyProtoListener{Listener: ln}
+	}
+	if fingerprintTLS {
+		ln = &helloListener{Listener: ln}
+	}
+	return ln
+}
+
+// AdminHandler serves operational endpoints, /metrics, /datasets and, with client statistics,
+// /stats, which should not be reachable publicly. The metrics include the estimates of the
+// statistics, if any.
+func AdminHandler(stats *ClientStats) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, stats)
+	})
+	mux.HandleFunc("GET /datasets", handleDatasetsReq)
+	if stats != nil {
+		mux.HandleFunc("GET /stats", stats.handleStatsReq)
+	}
+	return mux
+}
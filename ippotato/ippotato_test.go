@@ -0,0 +1,601 @@
+package ippotato_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jault3/ip-potato/ippotato"
+)
+
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandlerNegotiatesIndex(t *testing.T) {
+	h := ippotato.Handler(ippotato.Options{})
+	tests := []struct {
+		accept          string
+		wantContentType string
+		wantBody        string
+	}{
+		{"", "text/plain; charset=utf-8", "192.0.2.10\n"},
+		{"text/plain", "text/plain; charset=utf-8", "192.0.2.10\n"},
+		{"application/json", "application/json", `{"ip":"192.0.2.10"}` + "\n"},
+		{"text/html,application/xhtml+xml", "text/html; charset=utf-8", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.0.2.10:51234"
+			req.Header.Set("Accept", tt.accept)
+			rec := serve(h, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", rec.Code, http.StatusOK)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("got Content-Type %q, want %q", got, tt.wantContentType)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("got body %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			if tt.wantBody == "" && !strings.Contains(rec.Body.String(), "192.0.2.10") {
+				t.Errorf("html response does not contain the client address: %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+// Importing the package must not register anything on http.DefaultServeMux, which programs
+// embedding it serve publicly.
+func TestDefaultServeMuxUntouched(t *testing.T) {
+	for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+		if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodGet, path, nil)); pattern != "" {
+			t.Errorf("%s is served by http.DefaultServeMux with pattern %q", path, pattern)
+		}
+	}
+}
+
+func TestHandlerTextOptions(t *testing.T) {
+	tests := []struct {
+		opts  ippotato.Options
+		query string
+		want  string
+	}{
+		{ippotato.Options{}, "", "192.0.2.10\n"},
+		{ippotato.Options{TextCRLF: true, TextBOM: true}, "", "\ufeff192.0.2.10\r\n"},
+		{ippotato.Options{TextNoTrailingNewline: true}, "", "192.0.2.10"},
+		{ippotato.Options{TextNoTrailingNewline: true}, "?newline=1&eol=crlf", "192.0.2.10\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%+v%s", tt.opts, tt.query), func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+tt.query, nil)
+			req.RemoteAddr = "192.0.2.10:51234"
+			if got := serve(ippotato.Handler(tt.opts), req).Body.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Routes of lookups which aren't configured aren't served.
+func TestHandlerOptionalRoutes(t *testing.T) {
+	h := ippotato.Handler(ippotato.Options{})
+	for _, path := range []string{"/bgp", "/asn", "/hostname", "/cert", "/fingerprint", "/whois", "/blacklist", "/portcheck", "/speed/down", "/pubkey", "/both"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		if rec := serve(h, req); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestHandlerDualStack(t *testing.T) {
+	h := ippotato.Handler(ippotato.Options{IPv4URL: "https://ipv4.example.com/", IPv6URL: "https://ipv6.example.com"})
+	for remoteAddr, want := range map[string]string{
+		"192.0.2.10:51234":    `{"ipv4":"192.0.2.10","ipv4_url":"https://ipv4.example.com/both","ipv6_url":"https://ipv6.example.com/both"}`,
+		"[2001:db8::1]:51234": `{"ipv6":"2001:db8::1","ipv4_url":"https://ipv4.example.com/both","ipv6_url":"https://ipv6.example.com/both"}`,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/both", nil)
+		req.RemoteAddr = remoteAddr
+		rec := serve(h, req)
+		if got := strings.TrimSpace(rec.Body.String()); got != want {
+			t.Errorf("got %s from %s, want %s", got, remoteAddr, want)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+			t.Errorf("got Access-Control-Allow-Origin %q, want pages on the other hostnames to be allowed", got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "text/html")
+	if body := serve(h, req).Body.String(); !strings.Contains(body, `"https://ipv6.example.com/both"`) {
+		t.Errorf("the page doesn't fetch the IPv6 address:\n%s", body)
+	}
+}
+
+func TestHandlerEchoOptions(t *testing.T) {
+	h := ippotato.Handler(ippotato.Options{EchoRedactHeaders: []string{"X-Secret"}, EchoMaxValueBytes: 4})
+	req := httptest.NewRequest(http.MethodGet, "/headers", nil)
+	req.Header.Set("X-Secret", "hunter2")
+	req.Header.Set("X-Long", "abcdefgh")
+	req.Header.Set("Authorization", "abc")
+	body := serve(h, req).Body.String()
+	for _, want := range []string{"X-Secret: [redacted]", "X-Long: abcd...[truncated]", "Authorization: abc"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestHandlerBrowserAPI(t *testing.T) {
+	h := ippotato.Handler(ippotato.Options{APIRate: 0.001, APIBurst: 2})
+	request := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/ip", nil)
+		req.RemoteAddr = ip + ":51234"
+		req.Header.Set("Origin", "https://example.com")
+		return serve(h, req)
+	}
+	for i := 0; i < 2; i++ {
+		rec := request("192.0.2.10")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want %d", i, rec.Code, http.StatusOK)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+			t.Errorf("got Access-Control-Allow-Origin %q, want *", got)
+		}
+		if rec.Header().Get("Access-Control-Allow-Credentials") != "" || rec.Header().Get("Set-Cookie") != "" {
+			t.Error("the browser API must not allow credentials or set cookies")
+		}
+	}
+	rec := request("192.0.2.10")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d once the burst is used up, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("rate limited response has no Retry-After header")
+	}
+	if rec := request("192.0.2.11"); rec.Code != http.StatusOK {
+		t.Errorf("got status %d for another client, want %d", rec.Code, http.StatusOK)
+	}
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/v1/ip", nil)
+	if rec := serve(h, req); rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Methods") != "GET" {
+		t.Errorf("got preflight status %d with methods %q", rec.Code, rec.Header().Get("Access-Control-Allow-Methods"))
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"remote address", "192.0.2.10:51234", nil, "192.0.2.10"},
+		{"ipv6 remote address", "[2001:db8::1]:51234", nil, "2001:db8::1"},
+		{"x-real-ip", "198.51.100.1:80", map[string]string{"X-Real-IP": "192.0.2.10"}, "192.0.2.10"},
+		{"first of x-forwarded-for", "198.51.100.1:80", map[string]string{"X-Forwarded-For": "192.0.2.10, 198.51.100.2"}, "192.0.2.10"},
+		{"x-real-ip before x-forwarded-for", "198.51.100.1:80", map[string]string{"X-Real-IP": "192.0.2.10", "X-Forwarded-For": "192.0.2.11"}, "192.0.2.10"},
+		{"invalid header", "198.51.100.1:80", map[string]string{"X-Real-IP": "not-an-ip"}, ""},
+		{"invalid remote address", "pipe", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			if got := ippotato.RealIP(req); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	respond := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, body) }
+	}
+	h := ippotato.Negotiate(map[string]http.HandlerFunc{
+		"text/html":        respond("html"),
+		"application/json": respond("json"),
+	}, respond("fallback"))
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "fallback"},
+		{"*/*", "fallback"},
+		{"application/json", "json"},
+		{"text/html, application/json", "html"},
+		{"image/png,application/json", "json"},
+		{"application/xml", "fallback"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept", tt.accept)
+			if got := serve(h, req).Body.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// A server set up as documented reports the client from the PROXY protocol header and the
+// port and reuse of its connection.
+func TestNewListenerProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: ippotato.Handler(ippotato.Options{}), ConnContext: ippotato.ConnContext}
+	go server.Serve(ippotato.NewListener(ln, true, false))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "PROXY TCP4 192.0.2.10 198.51.100.1 51234 80\r\n")
+	r := bufio.NewReader(conn)
+	for i, want := range []string{`"connection_reused":false`, `"connection_reused":true`} {
+		req := httptest.NewRequest(http.MethodGet, "/json", nil)
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body strings.Builder
+		_, _ = bufio.NewReader(resp.Body).WriteTo(&body)
+		resp.Body.Close()
+		for _, field := range []string{`"ip":"192.0.2.10"`, `"port":51234`, want} {
+			if !strings.Contains(body.String(), field) {
+				t.Errorf("request %d: response does not contain %s: %s", i+1, field, body.String())
+			}
+		}
+	}
+}
+
+func TestNewListenerProxyProtocolV2(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: ippotato.Handler(ippotato.Options{}), ConnContext: ippotato.ConnContext}
+	go server.Serve(ippotato.NewListener(ln, true, false))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// PROXY, TCP over IPv6 from [2001:db8::10]:51234 to [2001:db8::1]:443, followed by an
+	// ALPN TLV which must be skipped
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x29")
+	header = append(header, net.ParseIP("2001:db8::10")...)
+	header = append(header, net.ParseIP("2001:db8::1")...)
+	header = append(header, 0xc8, 0x22, 0x01, 0xbb)
+	header = append(header, 0x01, 0x00, 0x02, 'h', '2')
+	if _, err := conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/json", nil)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IP   string `json:"ip"`
+		Port int    `json:"port"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.IP != "2001:db8::10" || body.Port != 51234 {
+		t.Errorf("reported the client as [%s]:%d, want [2001:db8::10]:51234", body.IP, body.Port)
+	}
+}
+
+func ExampleHandler() {
+	h := ippotato.Handler(ippotato.Options{})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.10:51234"
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	fmt.Print(rec.Body.String())
+	// Output: {"ip":"192.0.2.10"}
+}
+
+func TestHandlerMiddleware(t *testing.T) {
+	var order []string
+	trace := func(name string) ippotato.Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, req)
+			})
+		}
+	}
+	deny := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/denied" {
+				http.Error(w, "denied", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+	h := ippotato.Handler(ippotato.Options{Middleware: []ippotato.Middleware{trace("first"), deny, trace("second")}})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.10:51234"
+	if got := serve(h, req).Body.String(); got != "192.0.2.10\n" {
+		t.Errorf("got %q, want the index", got)
+	}
+	if strings.Join(order, ",") != "first,second" {
+		t.Errorf("middleware ran in order %v, want [first second]", order)
+	}
+
+	order = nil
+	if rec := serve(h, httptest.NewRequest(http.MethodGet, "/denied", nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if strings.Join(order, ",") != "first" {
+		t.Errorf("middleware after the one rejecting the request ran: %v", order)
+	}
+}
+
+func TestHandlerAPIKeys(t *testing.T) {
+	keys, err := ippotato.ParseAPIKeys("alice=key-a, bob=key-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	identify := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			names = append(names, ippotato.APIKeyName(req))
+			next.ServeHTTP(w, req)
+		})
+	}
+	db, err := ippotato.LoadASNDB("testdata/asn.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := ippotato.Handler(ippotato.Options{APIKeys: keys, ASNDB: db, Middleware: []ippotato.Middleware{identify}})
+	tests := []struct {
+		path          string
+		authorization string
+		wantStatus    int
+		wantName      string
+	}{
+		{"/", "", http.StatusOK, ""},
+		{"/json", "Bearer wrong", http.StatusOK, ""},
+		{"/asn", "", http.StatusUnauthorized, ""},
+		{"/asn", "Bearer wrong", http.StatusUnauthorized, ""},
+		{"/asn", "Bearer key-b", http.StatusOK, "bob"},
+		{"/", "Bearer key-a", http.StatusOK, "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+" "+tt.authorization, func(t *testing.T) {
+			names = nil
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = "192.0.2.10:51234"
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if rec := serve(h, req); rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if len(names) != 1 || names[0] != tt.wantName {
+				t.Errorf("middleware saw API key %q, want %q", names, tt.wantName)
+			}
+		})
+	}
+
+	// /json only runs the lookups of the protected routes with a key
+	for _, authorization := range []string{"", "Bearer key-a"} {
+		req := httptest.NewRequest(http.MethodGet, "/json", nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("Accept", "application/json")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		var info map[string]any
+		if err := json.Unmarshal(serve(h, req).Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := info["asn"]; ok != (authorization != "") {
+			t.Errorf("/json with authorization %q reported ASN %v", authorization, info["asn"])
+		}
+	}
+
+	if _, err := ippotato.ParseAPIKeys("alice"); err == nil {
+		t.Error("a key without a name was accepted")
+	}
+	if err := ippotato.CheckAPIKeys([]ippotato.APIKey{{Name: "alice", Key: "key-a"}, {Name: "bob", Key: "key-a"}}); err == nil {
+		t.Error("two names of the same key were accepted")
+	}
+}
+
+func TestHandlerQuota(t *testing.T) {
+	h := ippotato.Handler(ippotato.Options{
+		APIKeys: []ippotato.APIKey{
+			{Name: "daily", Key: "key-d", Quota: &ippotato.Quota{Daily: 2}},
+			{Name: "burst", Key: "key-b"},
+		},
+		DefaultQuota: ippotato.Quota{Rate: 0.001, Burst: 1},
+	})
+	request := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("Authorization", "Bearer "+key)
+		return serve(h, req)
+	}
+
+	for i, wantRemaining := range []string{"1", "0"} {
+		rec := request("/", "key-d")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want %d", i+1, rec.Code, http.StatusOK)
+		}
+		if got := rec.Header().Get("RateLimit-Remaining"); got != wantRemaining {
+			t.Errorf("request %d: got RateLimit-Remaining %q, want %q", i+1, got, wantRemaining)
+		}
+		if got := rec.Header().Get("RateLimit-Limit"); got != "2" {
+			t.Errorf("request %d: got RateLimit-Limit %q, want 2", i+1, got)
+		}
+		if got := rec.Header().Get("RateLimit-Policy"); got != "2;w=86400" {
+			t.Errorf("request %d: got RateLimit-Policy %q, want 2;w=86400", i+1, got)
+		}
+	}
+	if rec := request("/", "key-d"); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("got status %d once the daily quota is used up, want %d with Retry-After", rec.Code, http.StatusTooManyRequests)
+	}
+
+	// The usage can still be checked, without counting against the quota
+	rec := request("/usage", "key-d")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d for /usage, want %d", rec.Code, http.StatusOK)
+	}
+	var usage map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage["key"] != "daily" || usage["used_today"] != 2.0 || usage["remaining_today"] != 0.0 || usage["daily_limit"] != 2.0 {
+		t.Errorf("got usage %v", usage)
+	}
+
+	if rec := request("/", "key-b"); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "1" || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("got status %d with RateLimit-Limit %q and RateLimit-Remaining %q for the default quota", rec.Code, rec.Header().Get("RateLimit-Limit"), rec.Header().Get("RateLimit-Remaining"))
+	}
+	if rec := request("/", "key-b"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d once the burst is used up, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	// Keys without a daily quota are counted all the same, but not for rejected requests
+	rec = request("/usage", "key-b")
+	usage = nil
+	if err := json.Unmarshal(rec.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := usage["daily_limit"]; usage["key"] != "burst" || usage["used_today"] != 1.0 || ok {
+		t.Errorf("got usage %v for a key without a daily quota", usage)
+	}
+
+	// Requests without a key aren't limited
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if rec := serve(h, req); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("got status %d with RateLimit-Limit %q without a key", rec.Code, rec.Header().Get("RateLimit-Limit"))
+	}
+	if rec := serve(h, httptest.NewRequest(http.MethodGet, "/usage", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for /usage without a key, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// The keys of a user share its quota, keys of users which aren't configured have the default.
+func TestHandlerUserQuota(t *testing.T) {
+	keys, err := ippotato.LoadAPIKeys(writeConfigFile(t, "keys", `# name key options
+laptop key-l user=alice
+router key-r user=alice
+nas    key-n user=bob
+ci     key-c daily=1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := ippotato.LoadUsers(writeConfigFile(t, "users", "alice daily=3\n# bob has the default quota\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := ippotato.Handler(ippotato.Options{APIKeys: keys, Users: users, DefaultQuota: ippotato.Quota{Daily: 1}})
+	request := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("Authorization", "Bearer "+key)
+		return serve(h, req)
+	}
+
+	for i, key := range []string{"key-l", "key-r", "key-l"} {
+		if rec := request("/", key); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: got status %d, want %d", i+1, rec.Code, http.StatusOK)
+		}
+	}
+	if rec := request("/", "key-r"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d once the keys of the user used up its quota, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	rec := request("/usage", "key-r")
+	var usage map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage["key"] != "router" || usage["user"] != "alice" || usage["used_today"] != 3.0 || usage["daily_limit"] != 3.0 {
+		t.Errorf("got usage %v", usage)
+	}
+
+	// Neither the user without a configured quota nor the key of no user share it
+	for _, key := range []string{"key-n", "key-c"} {
+		if rec := request("/", key); rec.Code != http.StatusOK {
+			t.Errorf("got status %d for %s, want %d", rec.Code, key, http.StatusOK)
+		}
+		if rec := request("/", key); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("got status %d for %s once its quota is used up, want %d", rec.Code, key, http.StatusTooManyRequests)
+		}
+	}
+}
+
+func TestLoadAPIKeysAndUsers(t *testing.T) {
+	tests := []struct {
+		keys, users string
+		wantErr     string
+	}{
+		{keys: "laptop key-l user=alice daily=3\n", wantErr: "keys:1: a key owned by a user has the quota of the user"},
+		{keys: "laptop key-l user=\n", wantErr: "keys:1: expected a user ID"},
+		{keys: "\nlaptop\n", wantErr: "keys:2: expected a name and a key"},
+		{keys: "laptop key-l user=alice\nlaptop key-x user=bob\n", wantErr: `keys:2: duplicate API key name "laptop"`},
+		{keys: "laptop key-l user=alice\nrouter key-l\n", wantErr: `keys:2: API key "router" is the same as "laptop"`},
+		{users: "alice monthly=3\n", wantErr: `users:1: unknown quota option "monthly=3"`},
+		{users: "alice daily=3\nbob\nalice daily=100\n", wantErr: `users:3: duplicate user "alice"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantErr, func(t *testing.T) {
+			var err error
+			if tt.keys != "" {
+				_, err = ippotato.LoadAPIKeys(writeConfigFile(t, "keys", tt.keys))
+			} else {
+				_, err = ippotato.LoadUsers(writeConfigFile(t, "users", tt.users))
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package ippotato
+
+import "net/netip"
+
+// Address ranges with a special purpose, by the ip_type they are reported as. The first match
+// wins, so more specific ranges come first.
+var ipTypeRanges = []struct {
+	prefix netip.Prefix
+	ipType string
+}{
+	{netip.MustParsePrefix("10.0.0.0/8"), "private"},
+	{netip.MustParsePrefix("172.16.0.0/12"), "private"},
+	{netip.MustParsePrefix("192.168.0.0/16"), "private"},
+	{netip.MustParsePrefix("100.64.0.0/10"), "cgnat"},
+	{netip.MustParsePrefix("192.0.2.0/24"), "documentation"},
+	{netip.MustParsePrefix("198.51.100.0/24"), "documentation"},
+	{netip.MustParsePrefix("203.0.113.0/24"), "documentation"},
+	{netip.MustParsePrefix("2001:db8::/32"), "documentation"},
+	{netip.MustParsePrefix("3fff::/20"), "documentation"},
+	{netip.MustParsePrefix("2001::/32"), "teredo"},
+	{netip.MustParsePrefix("2002::/16"), "6to4"},
+	{netip.MustParsePrefix("fc00::/7"), "unique-local"},
+}
+
+// Classifies the address as public or by the special purpose range it belongs to: private
+// (RFC 1918), cgnat (RFC 6598 shared address space), link-local, loopback, unique-local,
+// 6to4, teredo, documentation, multicast or unspecified. Returns an empty string for invalid
+// addresses.
+//
+// The address is the one the server sees, so a client behind a carrier-grade NAT is only told
+// so if the server can be reached from inside the carrier's network.
+func classifyIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	switch {
+	case addr.IsUnspecified():
+		return "unspecified"
+	case addr.IsLoopback():
+		return "loopback"
+	case addr.IsLinkLocalUnicast():
+		return "link-local"
+	case addr.IsMulticast():
+		return "multicast"
+	}
+	for _, r := range ipTypeRanges {
+		if r.prefix.Contains(addr) {
+			return r.ipType
+		}
+	}
+	return "public"
+}
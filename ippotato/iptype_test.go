@@ -0,0 +1,37 @@
+package ippotato
+
+import "testing"
+
+func TestClassifyIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"8.8.8.8", "public"},
+		{"2606:4700::1111", "public"},
+		{"10.1.2.3", "private"},
+		{"172.31.255.255", "private"},
+		{"172.32.0.1", "public"},
+		{"192.168.1.1", "private"},
+		{"::ffff:192.168.1.1", "private"},
+		{"100.64.0.1", "cgnat"},
+		{"100.127.255.255", "cgnat"},
+		{"100.128.0.1", "public"},
+		{"169.254.1.1", "link-local"},
+		{"fe80::1", "link-local"},
+		{"127.0.0.1", "loopback"},
+		{"::1", "loopback"},
+		{"fd12:3456::1", "unique-local"},
+		{"2002:c000:204::1", "6to4"},
+		{"2001:0:4136:e378::1", "teredo"},
+		{"2001:db8::1", "documentation"},
+		{"198.51.100.7", "documentation"},
+		{"0.0.0.0", "unspecified"},
+		{"not-an-ip", ""},
+	}
+	for _, tt := range tests {
+		if got := classifyIP(tt.ip); got != tt.want {
+			t.Errorf("classifyIP(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
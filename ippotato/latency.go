@@ -0,0 +1,52 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Round trips the latency page measures, unless the samples query parameter asks for another
+// number up to maxLatencySamples.
+const (
+	defaultLatencySamples = 10
+	maxLatencySamples     = 50
+)
+
+// The latency page measures round trips to the server from the browser, every other client
+// gets a response as small as possible to time requests against itself.
+func (s *service) latencyHandler() http.HandlerFunc {
+	h := Negotiate(map[string]http.HandlerFunc{
+		"text/html":        s.handleLatencyHTTPReq,
+		"application/json": s.handleLatencyJSONReq,
+	}, s.handleLatencyTextReq)
+	return func(w http.ResponseWriter, req *http.Request) {
+		// A cached response would measure the distance to the cache rather than the server
+		w.Header().Set("Cache-Control", "no-store")
+		h(w, req)
+	}
+}
+
+func (s *service) handleLatencyHTTPReq(w http.ResponseWriter, req *http.Request) {
+	samples, err := strconv.Atoi(req.URL.Query().Get("samples"))
+	if err != nil || samples < 1 {
+		samples = defaultLatencySamples
+	}
+	s.renderPage(w, req, "latency.html", map[string]any{
+		"ip":      RealIP(req),
+		"samples": min(samples, maxLatencySamples),
+	})
+}
+
+func (s *service) handleLatencyJSONReq(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ip":          RealIP(req),
+		"server_time": time.Now().UnixMilli(),
+	})
+}
+
+func (s *service) handleLatencyTextReq(w http.ResponseWriter, req *http.Request) {
+	s.writeText(w, req, RealIP(req))
+}
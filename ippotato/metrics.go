@@ -0,0 +1,247 @@
+package ippotato
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A metric which can write itself in the Prometheus text exposition format.
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+type registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+var metrics = &registry{}
+
+func (r *registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *registry) writeTo(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		m.writeTo(w)
+	}
+}
+
+// A set of counters sharing a name, partitioned by label values.
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labelNames ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labelNames: labelNames, values: map[string]float64{}}
+	metrics.register(c)
+	return c
+}
+
+// Label values must be given in the same order as the label names of the counter.
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := formatLabels(c.labelNames, labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatValue(c.values[key]))
+	}
+}
+
+// A gauge whose value is computed whenever the metrics are collected.
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	metrics.register(g)
+	return g
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatValue(g.fn()))
+}
+
+// A set of gauges sharing a name, partitioned by the value of a single label, which are all
+// computed whenever the metrics are collected.
+type gaugeVecFunc struct {
+	name      string
+	help      string
+	labelName string
+	fn        func() map[string]float64
+}
+
+func newGaugeVecFunc(name, help, labelName string, fn func() map[string]float64) *gaugeVecFunc {
+	g := &gaugeVecFunc{name: name, help: help, labelName: labelName, fn: fn}
+	metrics.register(g)
+	return g
+}
+
+func (g *gaugeVecFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	values := g.fn()
+	labels := make([]string, 0, len(values))
+	for label := range values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels([]string{g.labelName}, []string{label}), formatValue(values[label]))
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + "=" + strconv.Quote(value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	startTime    = time.Now()
+	httpRequests = newCounterVec("ippotato_http_requests_total", "Number of http requests handled, by route and status code.", "route", "code")
+)
+
+func init() {
+	newGaugeFunc("ippotato_process_start_time_seconds", "Start time of the process since the unix epoch in seconds.", func() float64 {
+		return float64(startTime.Unix())
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Allows http.ResponseController to reach the original writer, e.g. to flush.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Counts requests by the pattern they match in mux, so unknown paths can't blow up the
+// number of series.
+func instrument(mux *http.ServeMux) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, route := mux.Handler(req)
+			if route == "" {
+				route = "unmatched"
+			}
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, req)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			httpRequests.Inc(route, strconv.Itoa(rec.status))
+			if name := APIKeyName(req); name != "" {
+				apiKeyRequests.Inc(name, strconv.Itoa(rec.status))
+			}
+		})
+	}
+}
+
+// PushMetrics periodically pushes all metrics to a Prometheus Pushgateway until the context
+// expires, for nodes which can't be scraped. The metrics are grouped by job and instance,
+// replacing the previous push of the same group. The metrics include the estimates of the
+// client statistics, if any.
+func PushMetrics(ctx context.Context, gatewayURL, job, instance string, interval time.Duration, stats *ClientStats) {
+	target := strings.TrimSuffix(gatewayURL, "/") + "/metrics/job/" + url.PathEscape(job) + "/instance/" + url.PathEscape(instance)
+	client := &http.Client{Timeout: interval}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := pushOnce(ctx, client, target, stats); err != nil && ctx.Err() == nil {
+			slog.Warn("failed to push metrics", slog.String("url", target), slog.Any("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func pushOnce(ctx context.Context, client *http.Client, target string, stats *ClientStats) error {
+	var body bytes.Buffer
+	writeMetrics(&body, stats)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pushgateway returned status %d", resp.StatusCode)
+	}
+	return nil
+}
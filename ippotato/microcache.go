@@ -0,0 +1,72 @@
+package ippotato
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A micro-cache in front of the lookups of address details. Clients polling from behind the same NAT or CDN
+// tend to arrive in bursts, so identical lookups which are in flight are coalesced into one
+// and their result is kept for a (typically sub-second) ttl. Only the details of the address
+// are cached, fields which describe the request such as the port or TLS fingerprint are
+// filled in afterwards, so the cache is keyed by address alone regardless of the format the
+// response is rendered in.
+type microCache struct {
+	lookup   func(ctx context.Context, ip string) ipDetails
+	cache    *ttlCache[string, ipDetails]
+	mu       sync.Mutex
+	inflight map[string]*lookupCall
+}
+
+type lookupCall struct {
+	done    chan struct{}
+	details ipDetails
+}
+
+var microCacheRequests = newCounterVec("ippotato_micro_cache_requests_total", "Number of lookups of address details by micro-cache result: hit, miss or coalesced.", "result")
+
+// Lookups are passed through unless a ttl has been configured.
+func newMicroCache(ttl time.Duration, lookup func(ctx context.Context, ip string) ipDetails) *microCache {
+	return &microCache{
+		lookup:   lookup,
+		cache:    newTTLCache[string, ipDetails](ttl, 10000),
+		inflight: map[string]*lookupCall{},
+	}
+}
+
+func (c *microCache) Lookup(ctx context.Context, ip string) ipDetails {
+	if c.cache.ttl <= 0 {
+		return c.lookup(ctx, ip)
+	}
+	if details, ok := c.cache.Get(ip); ok {
+		microCacheRequests.Inc("hit")
+		return details
+	}
+
+	c.mu.Lock()
+	if call, ok := c.inflight[ip]; ok {
+		c.mu.Unlock()
+		microCacheRequests.Inc("coalesced")
+		select {
+		case <-call.done:
+			return call.details
+		case <-ctx.Done():
+			return ipDetails{}
+		}
+	}
+	call := &lookupCall{done: make(chan struct{})}
+	c.inflight[ip] = call
+	c.mu.Unlock()
+	microCacheRequests.Inc("miss")
+
+	// Other requests are waiting on this lookup, so it must not be cancelled with the request
+	// which happened to start it
+	call.details = c.lookup(context.WithoutCancel(ctx), ip)
+	c.cache.Set(ip, call.details)
+	c.mu.Lock()
+	delete(c.inflight, ip)
+	c.mu.Unlock()
+	close(call.done)
+	return call.details
+}
@@ -0,0 +1,190 @@
+package ippotato
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func counterValue(c *counterVec, labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[formatLabels(c.labelNames, labelValues)]
+}
+
+// Reports how the micro-cache counters changed since it was created.
+type microCacheCounts struct {
+	hit, miss, coalesced float64
+}
+
+func newMicroCacheCounts() *microCacheCounts {
+	return &microCacheCounts{
+		hit:       counterValue(microCacheRequests, "hit"),
+		miss:      counterValue(microCacheRequests, "miss"),
+		coalesced: counterValue(microCacheRequests, "coalesced"),
+	}
+}
+
+func (c *microCacheCounts) since() microCacheCounts {
+	return microCacheCounts{
+		hit:       counterValue(microCacheRequests, "hit") - c.hit,
+		miss:      counterValue(microCacheRequests, "miss") - c.miss,
+		coalesced: counterValue(microCacheRequests, "coalesced") - c.coalesced,
+	}
+}
+
+func TestMicroCacheCoalescesLookups(t *testing.T) {
+	counts := newMicroCacheCounts()
+	var lookups atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	cache := newMicroCache(time.Minute, func(ctx context.Context, ip string) ipDetails {
+		if lookups.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return ipDetails{Hostname: "host-" + ip}
+	})
+
+	const waiters = 10
+	var wg sync.WaitGroup
+	results := make([]ipDetails, waiters+1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0] = cache.Lookup(context.Background(), "192.0.2.1")
+	}()
+	<-started
+	for i := 1; i <= waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = cache.Lookup(context.Background(), "192.0.2.1")
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); counts.since().coalesced < waiters; {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %v lookups were coalesced", counts.since().coalesced)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("looked up the address %d times, want once", n)
+	}
+	for i, details := range results {
+		if details.Hostname != "host-192.0.2.1" {
+			t.Errorf("lookup %d returned %+v", i, details)
+		}
+	}
+	if got := counts.since(); got != (microCacheCounts{miss: 1, coalesced: waiters}) {
+		t.Errorf("counted %+v", got)
+	}
+
+	// The first lookup finished, so the next ones are answered from the cache
+	cache.Lookup(context.Background(), "192.0.2.1")
+	cache.Lookup(context.Background(), "192.0.2.2")
+	if got := counts.since(); got != (microCacheCounts{hit: 1, miss: 2, coalesced: waiters}) {
+		t.Errorf("counted %+v", got)
+	}
+}
+
+// A waiting request which is cancelled gives up without cancelling the lookup others wait on.
+func TestMicroCacheCancelledWaiter(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	cache := newMicroCache(time.Minute, func(ctx context.Context, ip string) ipDetails {
+		close(started)
+		<-release
+		if ctx.Err() != nil {
+			return ipDetails{}
+		}
+		return ipDetails{Hostname: "host"}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan ipDetails)
+	go func() { first <- cache.Lookup(ctx, "192.0.2.1") }()
+	<-started
+
+	waiter, cancelWaiter := context.WithCancel(context.Background())
+	cancelWaiter()
+	if details := cache.Lookup(waiter, "192.0.2.1"); details.Hostname != "" {
+		t.Errorf("a cancelled waiter got %+v", details)
+	}
+	cancel()
+	close(release)
+	if details := <-first; details.Hostname != "host" {
+		t.Errorf("the lookup was cancelled with the request starting it: %+v", details)
+	}
+}
+
+func TestMicroCacheExpires(t *testing.T) {
+	var lookups atomic.Int32
+	cache := newMicroCache(50*time.Millisecond, func(ctx context.Context, ip string) ipDetails {
+		lookups.Add(1)
+		return ipDetails{}
+	})
+	cache.Lookup(context.Background(), "192.0.2.1")
+	cache.Lookup(context.Background(), "192.0.2.1")
+	if n := lookups.Load(); n != 1 {
+		t.Fatalf("looked up %d times within the ttl, want once", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cache.Lookup(context.Background(), "192.0.2.1")
+	if n := lookups.Load(); n != 2 {
+		t.Errorf("looked up %d times after the ttl, want twice", n)
+	}
+}
+
+func TestMicroCacheDisabled(t *testing.T) {
+	counts := newMicroCacheCounts()
+	var lookups atomic.Int32
+	cache := newMicroCache(0, func(ctx context.Context, ip string) ipDetails {
+		lookups.Add(1)
+		return ipDetails{}
+	})
+	cache.Lookup(context.Background(), "192.0.2.1")
+	cache.Lookup(context.Background(), "192.0.2.1")
+	if n := lookups.Load(); n != 2 {
+		t.Errorf("looked up %d times without a ttl, want every time", n)
+	}
+	if got := counts.since(); got != (microCacheCounts{}) {
+		t.Errorf("counted %+v without a ttl", got)
+	}
+}
+
+// Only the details of the address are cached, not the fields describing the request.
+func TestMicroCacheExcludesRequestFields(t *testing.T) {
+	db, err := LoadASNDB("testdata/asn.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(Options{ASNDB: db, MicroCacheTTL: time.Minute})
+	counts := newMicroCacheCounts()
+	for i, port := range []int{40001, 40002} {
+		req := httptest.NewRequest(http.MethodGet, "/json", nil)
+		req.RemoteAddr = "192.0.2.1:" + strconv.Itoa(port)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var info extendedInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatalf("request %d: %v: %s", i+1, err, rec.Body)
+		}
+		if info.Port != port {
+			t.Errorf("request %d: reported port %d, want %d", i+1, info.Port, port)
+		}
+		if info.ASN == nil || info.ASN.Number != 64496 {
+			t.Errorf("request %d: reported ASN %+v", i+1, info.ASN)
+		}
+	}
+	if got := counts.since(); got != (microCacheCounts{hit: 1, miss: 1}) {
+		t.Errorf("counted %+v", got)
+	}
+}
@@ -0,0 +1,96 @@
+package ippotato
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A Middleware wraps a handler to act on requests before or after it, e.g. to log,
+// authenticate or limit them.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps the handler in the middleware, the first outermost, so it is the first to see
+// each request and the last to see its response.
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// The middleware every request passes through before the middleware of the options:
+// numbering requests on their connection and identifying their API key, then counting them
+// in the metrics, so requests rejected by later middleware are counted as well, then
+// enforcing the quotas of API keys and recording their history.
+func (s *service) builtinMiddleware(mux *http.ServeMux) []Middleware {
+	middleware := []Middleware{countConnRequests}
+	if s.apiKeys != nil {
+		middleware = append(middleware, s.identifyAPIKey)
+	}
+	middleware = append(middleware, instrument(mux))
+	if s.clientStats != nil {
+		middleware = append(middleware, s.countUniqueClients)
+	}
+	if s.quotas != nil {
+		middleware = append(middleware, s.enforceQuota)
+	}
+	if s.history != nil {
+		middleware = append(middleware, s.recordHistory)
+	}
+	return middleware
+}
+
+// AccessLog logs every request once it has been answered, with the address of the client,
+// the name of its API key, the status and size of the response and how long it took.
+func AccessLog(logger *slog.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, req)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			attrs := []slog.Attr{
+				slog.String("ip", RealIP(req)),
+				slog.String("method", req.Method),
+				slog.String("path", req.URL.Path),
+				slog.String("proto", req.Proto),
+				slog.Int("status", rec.status),
+				slog.Int64("bytes", rec.bytes),
+				slog.Duration("duration", time.Since(start)),
+				slog.String("user_agent", req.UserAgent()),
+			}
+			if name := APIKeyName(req); name != "" {
+				attrs = append(attrs, slog.String("api_key", name))
+			}
+			logger.LogAttrs(req.Context(), slog.LevelInfo, "request", attrs...)
+		})
+	}
+}
+
+// Rejects clients which exceed the limit with 429 Too Many Requests, telling them when to
+// retry. Clients are told apart by the address of their connection or trusted proxy, never by
+// headers they could vary to get a new bucket with every request. Rejections are counted by
+// route in the rate limited metric.
+func rateLimit(limiter *rateLimiter, proxies trustedProxies, route string, reject func(w http.ResponseWriter, req *http.Request, retryAfter time.Duration)) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if ok, retryAfter := limiter.Allow(rateLimitKey(proxies.clientIP(req))); !ok {
+				apiRateLimited.Inc(route)
+				reject(w, req, retryAfter)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// Answers 429 Too Many Requests with writeError, telling the client when to retry.
+func (s *service) rejectRateLimited(w http.ResponseWriter, req *http.Request, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(retryAfter.Seconds())), 1)))
+	s.writeError(w, req, http.StatusTooManyRequests, message)
+}
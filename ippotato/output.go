@@ -0,0 +1,54 @@
+package ippotato
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Formatting of plain text responses. Some consumers, mostly legacy Windows tooling, need
+// CRLF line endings or a byte order mark to read the text endpoints correctly.
+type textOptions struct {
+	crlf            bool
+	bom             bool
+	trailingNewline bool
+}
+
+// Applies the overrides of the request to the defaults of the handler.
+func (s *service) textOptionsFor(req *http.Request) textOptions {
+	opts := s.text
+	query := req.URL.Query()
+	switch strings.ToLower(query.Get("eol")) {
+	case "crlf":
+		opts.crlf = true
+	case "lf":
+		opts.crlf = false
+	}
+	if bom, err := strconv.ParseBool(query.Get("bom")); err == nil {
+		opts.bom = bom
+	}
+	if newline, err := strconv.ParseBool(query.Get("newline")); err == nil {
+		opts.trailingNewline = newline
+	}
+	return opts
+}
+
+// Writes the lines as a plain text response formatted according to the options of the
+// request.
+func (s *service) writeText(w http.ResponseWriter, req *http.Request, lines ...string) {
+	opts := s.textOptionsFor(req)
+	eol := "\n"
+	if opts.crlf {
+		eol = "\r\n"
+	}
+	var sb strings.Builder
+	if opts.bom {
+		sb.WriteString("\ufeff")
+	}
+	sb.WriteString(strings.Join(lines, eol))
+	if opts.trailingNewline {
+		sb.WriteString(eol)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(sb.String()))
+}
@@ -0,0 +1,46 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Returns the TCP source port of the client, or 0 if it isn't known. Once the address came
+// from a forwarding header, the port of the connection belongs to the proxy rather than the
+// client, so it isn't reported. Use PROXY protocol to preserve it through load balancers.
+func clientPort(req *http.Request) int {
+	if req.Header.Get("X-Real-IP") != "" || req.Header.Get("X-Forwarded-For") != "" {
+		return 0
+	}
+	_, portStr, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return port
+}
+
+func (s *service) portHandler() http.HandlerFunc {
+	return Negotiate(map[string]http.HandlerFunc{
+		"application/json": s.handlePortJSONReq,
+	}, s.handlePortTextReq)
+}
+
+func (s *service) handlePortJSONReq(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ip":   RealIP(req),
+		"port": clientPort(req),
+	})
+}
+
+func (s *service) handlePortTextReq(w http.ResponseWriter, req *http.Request) {
+	port := clientPort(req)
+	if port == 0 {
+		s.writeError(w, req, http.StatusNotFound, "the client port is not known")
+		return
+	}
+	s.writeText(w, req, strconv.Itoa(port))
+}
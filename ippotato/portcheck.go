@@ -0,0 +1,242 @@
+package ippotato
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var portChecks = newCounterVec("ippotato_portchecks_total", "Number of connect-back port checks, by result.", "status")
+
+// Connect-back checks running at once, beyond which requests are turned away rather than
+// queued, since every check may hold a connection attempt open for the whole timeout.
+const maxConcurrentPortChecks = 64
+
+// PortRange is an inclusive range of TCP ports.
+type PortRange struct {
+	From, To uint16
+}
+
+// ParsePortRanges parses a comma separated list of ports and ranges, e.g. "22,80,1024-65535".
+func ParsePortRanges(s string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		fromStr, toStr, isRange := strings.Cut(part, "-")
+		from, err := parsePort(fromStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port range %q: %w", part, err)
+		}
+		to := from
+		if isRange {
+			if to, err = parsePort(toStr); err != nil {
+				return nil, fmt.Errorf("invalid port range %q: %w", part, err)
+			}
+			if to < from {
+				return nil, fmt.Errorf("invalid port range %q: the end is below the start", part)
+			}
+		}
+		ranges = append(ranges, PortRange{From: from, To: to})
+	}
+	return ranges, nil
+}
+
+// Networks port checks never connect to, whatever classifyIP makes of them: besides private,
+// shared, loopback, link local, documentation and multicast space, those which route or
+// translate to other networks, such as NAT64 and 6to4, which can reach private IPv4 space,
+// benchmarking and reserved space, and the networks of protocol assignments.
+var outboundDenyList = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/127"),
+	netip.MustParsePrefix("::ffff:0:0/96"),
+	netip.MustParsePrefix("::/96"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("3fff::/20"),
+	netip.MustParsePrefix("5f00::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// Whether port checks may connect to the address.
+func dialAllowed(ip netip.Addr) bool {
+	if !ip.IsValid() || ip.Zone() != "" {
+		return false
+	}
+	for _, prefix := range outboundDenyList {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err == nil && port == 0 {
+		err = errors.New("port 0 can't be checked")
+	}
+	return uint16(port), err
+}
+
+// Connects back to clients to tell whether a port is reachable from the internet.
+type portChecker struct {
+	ports   []PortRange
+	timeout time.Duration
+	limiter *rateLimiter
+	running chan struct{}
+	dial    func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func newPortChecker(ports []PortRange, timeout time.Duration, rate float64, burst int) *portChecker {
+	c := &portChecker{
+		ports:   ports,
+		timeout: timeout,
+		running: make(chan struct{}, maxConcurrentPortChecks),
+		dial:    (&net.Dialer{Control: denyOutbound}).DialContext,
+	}
+	if rate > 0 {
+		c.limiter = newRateLimiter(rate, burst)
+	}
+	return c
+}
+
+// Refuses to connect to anything on the deny list in the dialer itself, so no address can
+// slip past the checks of the handler.
+func denyOutbound(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !dialAllowed(addrPort.Addr().Unmap()) {
+		return fmt.Errorf("connecting to %s is not allowed", addrPort.Addr())
+	}
+	return nil
+}
+
+func (c *portChecker) allowed(port uint16) bool {
+	for _, r := range c.ports {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// Connects to the port of the address. It is open if the connection is accepted and closed if
+// it is refused, anything else, mostly silence until the timeout, means it is filtered.
+func (c *portChecker) Check(ctx context.Context, ip netip.Addr, port uint16) string {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	conn, err := c.dial(ctx, "tcp", netip.AddrPortFrom(ip, port).String())
+	switch {
+	case err == nil:
+		conn.Close()
+		return "open"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "closed"
+	default:
+		return "filtered"
+	}
+}
+
+func (s *service) portCheckHandler() http.HandlerFunc {
+	h := Negotiate(map[string]http.HandlerFunc{
+		"application/json": s.handlePortCheckJSONReq,
+	}, s.handlePortCheckTextReq)
+	if s.portCheck.limiter != nil {
+		h = rateLimit(s.portCheck.limiter, s.proxies, "/portcheck", s.rejectAPIReq)(h).ServeHTTP
+	}
+	return s.requireAPIKey(h)
+}
+
+// Checks the port of the port query parameter on the client address. Only the peer of the
+// connection or the client a trusted proxy forwards is ever connected to, so the server can't
+// be pointed at other hosts with X-Forwarded-For. Returns false after responding with an
+// error if the check can't be made.
+func (s *service) checkPort(w http.ResponseWriter, req *http.Request) (netip.Addr, uint16, string, bool) {
+	ip, err := netip.ParseAddr(s.proxies.clientIP(req))
+	if err != nil {
+		s.writeError(w, req, http.StatusBadRequest, "unable to determine client ip")
+		return ip, 0, "", false
+	}
+	ip = ip.Unmap()
+	port, err := parsePort(req.URL.Query().Get("port"))
+	if err != nil {
+		s.writeError(w, req, http.StatusBadRequest, "the port query parameter must be a port between 1 and 65535")
+		return ip, 0, "", false
+	}
+	if !s.portCheck.allowed(port) {
+		s.writeError(w, req, http.StatusForbidden, fmt.Sprintf("port %d can't be checked on this server", port))
+		return ip, 0, "", false
+	}
+	// Only ever connect out to the internet, never to the networks of the server itself
+	if !dialAllowed(ip) {
+		s.writeError(w, req, http.StatusUnprocessableEntity, "ports of "+ip.String()+" can't be checked")
+		return ip, 0, "", false
+	}
+	select {
+	case s.portCheck.running <- struct{}{}:
+		defer func() { <-s.portCheck.running }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		s.writeError(w, req, http.StatusServiceUnavailable, "too many port checks are running, try again shortly")
+		return ip, 0, "", false
+	}
+	status := s.portCheck.Check(req.Context(), ip, port)
+	portChecks.Inc(status)
+	return ip, port, status, true
+}
+
+func (s *service) handlePortCheckJSONReq(w http.ResponseWriter, req *http.Request) {
+	ip, port, status, ok := s.checkPort(w, req)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ip":     ip.String(),
+		"port":   port,
+		"status": status,
+	})
+}
+
+func (s *service) handlePortCheckTextReq(w http.ResponseWriter, req *http.Request) {
+	_, _, status, ok := s.checkPort(w, req)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	s.writeText(w, req, status)
+}
@@ -0,0 +1,150 @@
+package ippotato
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	got, err := ParsePortRanges("22, 80,1024-65535")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []PortRange{{22, 22}, {80, 80}, {1024, 65535}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, invalid := range []string{"0", "65536", "http", "100-10", "1-"} {
+		if _, err := ParsePortRanges(invalid); err == nil {
+			t.Errorf("parsed %q, want an error", invalid)
+		}
+	}
+}
+
+func TestPortCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	openPort := uint16(l.Addr().(*net.TCPAddr).Port)
+	// Nothing listens once the listener is closed, so connections to it are refused
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := uint16(closed.Addr().(*net.TCPAddr).Port)
+	closed.Close()
+	defer l.Close()
+
+	checker := newPortChecker([]PortRange{{1, 65535}}, time.Second, 0, 0)
+	loopback := netip.MustParseAddr("127.0.0.1")
+	if got := checker.Check(context.Background(), loopback, openPort); got != "filtered" {
+		t.Errorf("got %s for loopback with the default dialer, want it to refuse to connect", got)
+	}
+	checker.dial = (&net.Dialer{}).DialContext
+	if got := checker.Check(context.Background(), loopback, openPort); got != "open" {
+		t.Errorf("got %s for a listening port, want open", got)
+	}
+	if got := checker.Check(context.Background(), loopback, closedPort); got != "closed" {
+		t.Errorf("got %s for a port nobody listens on, want closed", got)
+	}
+	checker.timeout = 10 * time.Millisecond
+	checker.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if got := checker.Check(context.Background(), loopback, openPort); got != "filtered" {
+		t.Errorf("got %s for a port without an answer, want filtered", got)
+	}
+}
+
+func TestDialAllowed(t *testing.T) {
+	for _, denied := range []string{
+		"0.1.2.3", "10.0.0.1", "100.64.0.1", "127.0.0.1", "169.254.169.254", "172.16.0.1", "192.0.0.8",
+		"192.168.1.1", "198.18.0.1", "198.19.255.255", "224.0.0.1", "240.0.0.1", "255.255.255.255",
+		"::", "::1", "64:ff9b::a00:1", "64:ff9b:1::1", "2001::1", "2001:db8::1", "2002:a00:1::1",
+		"fc00::1", "fe80::1", "ff02::1",
+	} {
+		if dialAllowed(netip.MustParseAddr(denied)) {
+			t.Errorf("connecting to %s is allowed", denied)
+		}
+	}
+	for _, allowed := range []string{"193.0.6.139", "8.8.8.8", "2001:67c:2e8::1", "2a00:1450::1"} {
+		if !dialAllowed(netip.MustParseAddr(allowed)) {
+			t.Errorf("connecting to %s is denied", allowed)
+		}
+	}
+}
+
+func TestHandlePortCheck(t *testing.T) {
+	if s := newService(Options{PortCheckPorts: []PortRange{{443, 443}}}); s.portCheck != nil {
+		t.Fatal("port checks are enabled without API keys")
+	}
+
+	var dialed []string
+	s := newService(Options{
+		PortCheckPorts: []PortRange{{443, 443}},
+		PortCheckRate:  1,
+		PortCheckBurst: 3,
+		APIKeys:        []APIKey{{Name: "ops", Key: "key-o"}},
+	})
+	s.portCheck.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	h := Chain(s.portCheckHandler(), s.identifyAPIKey)
+	request := func(remoteAddr, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Authorization", "Bearer key-o")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/portcheck?port=443", nil)
+	req.RemoteAddr = "193.0.6.139:51234"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d without an API key, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	rec = request("[2001:db8::1]:51234", "/portcheck?port=443")
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for a documentation address, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+	// The address claimed in X-Forwarded-For is ignored, only the peer is connected to
+	req = httptest.NewRequest(http.MethodGet, "/portcheck?port=443", nil)
+	req.RemoteAddr = "193.0.6.139:51234"
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer key-o")
+	req.Header.Set("X-Forwarded-For", "8.8.8.8")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if want := `{"ip":"193.0.6.139","port":443,"status":"open"}` + "\n"; rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("got status %d and %q, want %q", rec.Code, rec.Body, want)
+	}
+	if want := []string{"193.0.6.139:443"}; !reflect.DeepEqual(dialed, want) {
+		t.Errorf("dialed %v, want %v", dialed, want)
+	}
+	if rec := request("193.0.6.139:51234", "/portcheck?port=22"); rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d for a port outside the ranges, want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := request("193.0.6.139:51234", "/portcheck?port=x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid port, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	// The burst of 3 is used up by the requests from the address so far
+	if rec := request("193.0.6.139:51234", "/portcheck?port=443"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d once the burst is used up, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+}
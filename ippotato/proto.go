@@ -0,0 +1,44 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// How the request arrived at the server. Behind a proxy this describes the hop between the
+// proxy and the server.
+type protoInfo struct {
+	HTTPVersion      string `json:"http_version"`
+	ConnectionReused bool   `json:"connection_reused"`
+	TLS              bool   `json:"tls"`
+	ALPN             string `json:"alpn,omitempty"`
+}
+
+func requestProto(req *http.Request) protoInfo {
+	info := protoInfo{
+		HTTPVersion:      req.Proto,
+		ConnectionReused: connRequestNumber(req) > 1,
+		TLS:              req.TLS != nil,
+	}
+	if req.TLS != nil {
+		info.ALPN = req.TLS.NegotiatedProtocol
+	}
+	return info
+}
+
+func (s *service) protoHandler() http.HandlerFunc {
+	return Negotiate(map[string]http.HandlerFunc{
+		"application/json": s.handleProtoJSONReq,
+	}, s.handleProtoTextReq)
+}
+
+func (s *service) handleProtoJSONReq(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(requestProto(req))
+}
+
+func (s *service) handleProtoTextReq(w http.ResponseWriter, req *http.Request) {
+	info := requestProto(req)
+	s.writeText(w, req, info.HTTPVersion, "connection reused: "+strconv.FormatBool(info.ConnectionReused))
+}
@@ -0,0 +1,151 @@
+package ippotato
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Wraps a listener whose connections start with a PROXY protocol v1 or v2 header
+// (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt), as sent by load balancers
+// such as HAProxy or AWS NLB. The connections report the original client as their remote
+// address, including its source port.
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// The header is parsed lazily on first use so a slow client can't block the accept loop.
+type proxyProtoConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		c.remoteAddr, c.err = readProxyHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			slog.Warn("invalid PROXY protocol header", slog.String("peer", c.Conn.RemoteAddr().String()), slog.Any("error", c.err))
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remoteAddr
+}
+
+// Returns a nil address for headers which don't carry one, e.g. health checks sent by the
+// proxy itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	return readProxyHeaderV1(r)
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest valid v1 header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	header, found := strings.CutSuffix(string(line), "\r\n")
+	if !found {
+		return nil, errors.New("v1 header is not terminated by CRLF")
+	}
+	fields := strings.Split(header, " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errors.New("missing PROXY header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("malformed v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("malformed source address in v1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL connections are established by the proxy itself
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("truncated IPv4 addresses in v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("truncated IPv6 addresses in v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
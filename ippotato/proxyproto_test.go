@@ -0,0 +1,139 @@
+package ippotato
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Builds a v2 header with the version and command byte, the family and transport byte and
+// the payload of addresses and TLVs.
+func proxyV2Header(command, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func proxyV2Addresses(src, dst string, srcPort, dstPort uint16) []byte {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if v4 := srcIP.To4(); v4 != nil {
+		srcIP, dstIP = v4, dstIP.To4()
+	}
+	payload := append(append([]byte{}, srcIP...), dstIP...)
+	payload = binary.BigEndian.AppendUint16(payload, srcPort)
+	return binary.BigEndian.AppendUint16(payload, dstPort)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	// PP2_TYPE_ALPN "h2" and PP2_TYPE_AUTHORITY "example.com"
+	tlvs := []byte{0x01, 0x00, 0x02, 'h', '2', 0x02, 0x00, 0x0b}
+	tlvs = append(tlvs, "example.com"...)
+	tests := []struct {
+		name string
+		data []byte
+		// Empty if the header carries no address.
+		want string
+	}{
+		{name: "v1 TCP4", data: []byte("PROXY TCP4 192.0.2.10 198.51.100.1 51234 80\r\n"), want: "192.0.2.10:51234"},
+		{name: "v1 TCP6", data: []byte("PROXY TCP6 2001:db8::10 2001:db8::1 51234 443\r\n"), want: "[2001:db8::10]:51234"},
+		{name: "v1 UNKNOWN", data: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v2 TCP over IPv4", data: proxyV2Header(0x21, 0x11, proxyV2Addresses("192.0.2.10", "198.51.100.1", 51234, 80)), want: "192.0.2.10:51234"},
+		{name: "v2 TCP over IPv6", data: proxyV2Header(0x21, 0x21, proxyV2Addresses("2001:db8::10", "2001:db8::1", 51234, 443)), want: "[2001:db8::10]:51234"},
+		{name: "v2 with TLVs", data: proxyV2Header(0x21, 0x21, append(proxyV2Addresses("2001:db8::10", "2001:db8::1", 51234, 443), tlvs...)), want: "[2001:db8::10]:51234"},
+		{name: "v2 LOCAL", data: proxyV2Header(0x20, 0x11, proxyV2Addresses("192.0.2.10", "198.51.100.1", 51234, 80))},
+		{name: "v2 LOCAL without addresses", data: proxyV2Header(0x20, 0x00, nil)},
+		{name: "v2 UNIX socket", data: proxyV2Header(0x21, 0x31, make([]byte, 216))},
+		{name: "v2 UDP over IPv4", data: proxyV2Header(0x21, 0x12, proxyV2Addresses("192.0.2.10", "198.51.100.1", 51234, 53))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The data following the header must be left to be read by the server
+			r := bufio.NewReader(bytes.NewReader(append(tt.data, "GET / HTTP/1.1\r\n"...)))
+			addr, err := readProxyHeader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("read the address %q, want %q", got, tt.want)
+			}
+			if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("left %q after the header", rest)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderRejectsMalformedHeaders(t *testing.T) {
+	ipv4 := proxyV2Addresses("192.0.2.10", "198.51.100.1", 51234, 80)
+	ipv6 := proxyV2Addresses("2001:db8::10", "2001:db8::1", 51234, 443)
+	truncatedLength := proxyV2Header(0x21, 0x21, ipv6)
+	binary.BigEndian.PutUint16(truncatedLength[14:16], 100)
+	tests := map[string][]byte{
+		"no header":                   []byte("GET / HTTP/1.1\r\n"),
+		"v1 without CRLF":             []byte("PROXY TCP4 192.0.2.10 198.51.100.1 51234 80\n"),
+		"v1 too long":                 append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 120)...),
+		"v1 unknown protocol":         []byte("PROXY UDP4 192.0.2.10 198.51.100.1 51234 80\r\n"),
+		"v1 missing port":             []byte("PROXY TCP4 192.0.2.10 198.51.100.1 51234\r\n"),
+		"v1 invalid address":          []byte("PROXY TCP4 192.0.2 198.51.100.1 51234 80\r\n"),
+		"v1 invalid port":             []byte("PROXY TCP4 192.0.2.10 198.51.100.1 65536 80\r\n"),
+		"v2 truncated header":         proxyV2Header(0x21, 0x11, ipv4)[:14],
+		"v2 truncated payload":        truncatedLength,
+		"v2 unsupported version":      proxyV2Header(0x11, 0x11, ipv4),
+		"v2 truncated IPv4 addresses": proxyV2Header(0x21, 0x11, ipv4[:10]),
+		"v2 truncated IPv6 addresses": proxyV2Header(0x21, 0x21, ipv6[:34]),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			if addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(data))); err == nil {
+				t.Errorf("accepted the header with address %v", addr)
+			}
+		})
+	}
+}
+
+// A connection whose header doesn't carry an address, like a health check of the proxy,
+// reports the proxy itself.
+func TestProxyProtoConnRemoteAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pln := &proxyProtoListener{Listener: ln}
+	for _, tt := range []struct {
+		header []byte
+		want   string
+	}{
+		{header: proxyV2Header(0x21, 0x11, proxyV2Addresses("192.0.2.10", "198.51.100.1", 51234, 80)), want: "192.0.2.10:51234"},
+		{header: proxyV2Header(0x20, 0x00, nil), want: "127.0.0.1:"},
+	} {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(append(tt.header, "ping"...)); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := pln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.RemoteAddr().String(); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("reported %s, want %s", got, tt.want)
+		}
+		buf := make([]byte, 4)
+		if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "ping" {
+			t.Errorf("read %q, %v after the header", buf[:n], err)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
@@ -0,0 +1,246 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var apiKeyRateLimited = newCounterVec("ippotato_api_key_rate_limited_total", "Number of requests rejected because their API key exceeded its quota, by key name and the limit exceeded.", "key", "limit")
+
+// Quota limits how many requests can be made with an API key. Zero values are unlimited.
+type Quota struct {
+	// Requests per day, the day starting at midnight UTC.
+	Daily int
+	// Requests per second, with up to Burst requests in a burst.
+	Rate  float64
+	Burst int
+}
+
+func parseQuota(options []string) (Quota, error) {
+	var q Quota
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		var err error
+		switch name {
+		case "daily":
+			q.Daily, err = strconv.Atoi(value)
+		case "rate":
+			q.Rate, err = strconv.ParseFloat(value, 64)
+		case "burst":
+			q.Burst, err = strconv.Atoi(value)
+		default:
+			return q, fmt.Errorf("unknown quota option %q, expected daily, rate or burst", option)
+		}
+		if err != nil {
+			return q, fmt.Errorf("invalid quota option %q: %w", option, err)
+		}
+	}
+	return q, nil
+}
+
+// Counts the requests of each API key or user on the current day. Counts are kept in memory, a
+// restart starts every key with its full daily quota.
+type quotaTracker struct {
+	mu    sync.Mutex
+	usage map[string]dailyUsage
+}
+
+type dailyUsage struct {
+	day  string
+	used int
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{usage: map[string]dailyUsage{}}
+}
+
+// Counts a request of the key, unless it has already made limit requests today. A limit of
+// zero is unlimited, the request is only counted.
+func (t *quotaTracker) take(name string, limit int, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.current(name, now)
+	if limit > 0 && u.used >= limit {
+		return false
+	}
+	u.used++
+	t.usage[name] = u
+	return true
+}
+
+func (t *quotaTracker) used(name string, now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current(name, now).used
+}
+
+func (t *quotaTracker) current(name string, now time.Time) dailyUsage {
+	day := now.UTC().Format(time.DateOnly)
+	if u := t.usage[name]; u.day == day {
+		return u
+	}
+	return dailyUsage{day: day}
+}
+
+// When the daily quota of every key is restored.
+func nextQuotaReset(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// The limits of every key and user, and the state to enforce them. Keys owned by a user are
+// limited and counted as their user, every other key on its own.
+type quotas struct {
+	owners    map[string]string
+	byAccount map[string]Quota
+	limiters  map[string]*rateLimiter
+	tracker   *quotaTracker
+}
+
+func newQuotas(keys []APIKey, users []User, defaultQuota Quota) *quotas {
+	q := &quotas{owners: map[string]string{}, byAccount: map[string]Quota{}, limiters: map[string]*rateLimiter{}, tracker: newQuotaTracker()}
+	add := func(account string, quota *Quota) {
+		if quota == nil {
+			quota = &defaultQuota
+		}
+		q.byAccount[account] = *quota
+		if quota.Rate > 0 {
+			q.limiters[account] = newRateLimiter(quota.Rate, quota.Burst)
+		}
+	}
+	for _, u := range users {
+		add(userAccount(u.ID), u.Quota)
+	}
+	for _, k := range keys {
+		if k.User == "" {
+			add(keyAccount(k.Name), k.Quota)
+			continue
+		}
+		q.owners[k.Name] = k.User
+		// Users which aren't configured have the default quota
+		if _, ok := q.byAccount[userAccount(k.User)]; !ok {
+			add(userAccount(k.User), nil)
+		}
+	}
+	return q
+}
+
+// Keys and users are counted apart, so a user can't share the quota of a key named like it.
+func keyAccount(name string) string { return "key/" + name }
+func userAccount(id string) string  { return "user/" + id }
+
+// The account whose quota the key uses.
+func (q *quotas) account(name string) string {
+	if user := q.owners[name]; user != "" {
+		return userAccount(user)
+	}
+	return keyAccount(name)
+}
+
+// The usage of an API key, as reported by /usage and summarised in the RateLimit headers. For
+// keys owned by a user it is the usage of the quota they share with the other keys of the
+// user.
+type quotaUsage struct {
+	Key  string `json:"key"`
+	User string `json:"user,omitempty"`
+
+	DailyLimit     int        `json:"daily_limit,omitempty"`
+	UsedToday      int        `json:"used_today"`
+	RemainingToday *int       `json:"remaining_today,omitempty"`
+	ResetsAt       *time.Time `json:"resets_at,omitempty"`
+
+	Rate           float64 `json:"rate,omitempty"`
+	Burst          int     `json:"burst,omitempty"`
+	BurstRemaining *int    `json:"burst_remaining,omitempty"`
+}
+
+func (q *quotas) usage(name string, now time.Time) quotaUsage {
+	account := q.account(name)
+	quota := q.byAccount[account]
+	u := quotaUsage{Key: name, User: q.owners[name], UsedToday: q.tracker.used(account, now)}
+	if quota.Daily > 0 {
+		remaining := max(quota.Daily-u.UsedToday, 0)
+		reset := nextQuotaReset(now)
+		u.DailyLimit, u.RemainingToday, u.ResetsAt = quota.Daily, &remaining, &reset
+	}
+	if limiter := q.limiters[account]; limiter != nil {
+		remaining := limiter.Remaining(account)
+		u.Rate, u.Burst, u.BurstRemaining = quota.Rate, int(limiter.burst), &remaining
+	}
+	return u
+}
+
+// Sets the RateLimit headers of draft-ietf-httpapi-ratelimit-headers. They describe the daily
+// quota if the key has one and the burst otherwise, the policy header lists both.
+func setRateLimitHeaders(w http.ResponseWriter, u quotaUsage, now time.Time) {
+	var policies []string
+	if u.DailyLimit > 0 {
+		policies = append(policies, fmt.Sprintf("%d;w=86400", u.DailyLimit))
+	}
+	if u.Rate > 0 {
+		policies = append(policies, fmt.Sprintf("%d;w=%d", u.Burst, int(math.Ceil(float64(u.Burst)/u.Rate))))
+	}
+	h := w.Header()
+	switch {
+	case u.DailyLimit > 0:
+		h.Set("RateLimit-Limit", strconv.Itoa(u.DailyLimit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(*u.RemainingToday))
+		h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(u.ResetsAt.Sub(now).Seconds()))))
+	case u.Rate > 0:
+		h.Set("RateLimit-Limit", strconv.Itoa(u.Burst))
+		h.Set("RateLimit-Remaining", strconv.Itoa(*u.BurstRemaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(float64(u.Burst-*u.BurstRemaining)/u.Rate))))
+	default:
+		return
+	}
+	h.Set("RateLimit-Policy", strings.Join(policies, ", "))
+}
+
+// Enforces the quota of requests made with an API key and describes it in the RateLimit
+// headers of the response. Requests for /usage don't count against the quota, so it can be
+// checked once it is used up.
+func (s *service) enforceQuota(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := APIKeyName(req)
+		if name == "" || req.URL.Path == "/usage" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		account, now := s.quotas.account(name), time.Now()
+		quota := s.quotas.byAccount[account]
+		if limiter := s.quotas.limiters[account]; limiter != nil {
+			if ok, retryAfter := limiter.Allow(account); !ok {
+				apiKeyRateLimited.Inc(name, "rate")
+				setRateLimitHeaders(w, s.quotas.usage(name, now), now)
+				s.rejectRateLimited(w, req, retryAfter, "rate limit exceeded")
+				return
+			}
+		}
+		// Requests are counted for /usage even if the key has no daily quota
+		if !s.quotas.tracker.take(account, quota.Daily, now) {
+			apiKeyRateLimited.Inc(name, "daily")
+			setRateLimitHeaders(w, s.quotas.usage(name, now), now)
+			s.rejectRateLimited(w, req, nextQuotaReset(now).Sub(now), "daily quota exceeded")
+			return
+		}
+		setRateLimitHeaders(w, s.quotas.usage(name, now), now)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Reports the quota of the API key of the request and how much of it has been used, by all
+// keys of its user if it has one.
+func (s *service) handleUsageReq(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	u := s.quotas.usage(APIKeyName(req), now)
+	setRateLimitHeaders(w, u, now)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(u)
+}
@@ -0,0 +1,99 @@
+package ippotato
+
+import (
+	"math"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// A token bucket rate limiter keyed by client. Every key starts with a full bucket of burst
+// tokens which refills at rate tokens per second. Buckets which have refilled completely are
+// indistinguishable from new ones, so they are dropped once maxKeys is reached.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	maxKeys int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		maxKeys: 100000,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// Takes a token from the bucket of the key. If there is none, it returns how long until the
+// next one is available.
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= l.maxKeys {
+			l.sweep(now)
+		}
+		b = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		wait := time.Duration(math.Ceil((1 - b.tokens) / l.rate * float64(time.Second)))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Returns how many tokens the bucket of the key holds, without taking any.
+func (l *rateLimiter) Remaining(key string) int {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		return int(l.burst)
+	}
+	l.refill(b, now)
+	return int(b.tokens)
+}
+
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// The key clients are rate limited by. IPv6 clients are usually given a whole /64, so they are
+// limited by that prefix rather than by the address they happen to use.
+func rateLimitKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.String()
+	}
+	return addr.String()
+}
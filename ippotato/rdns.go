@@ -0,0 +1,78 @@
+package ippotato
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Resolves the PTR record of client addresses. Lookups are bounded by a strict timeout so a
+// slow resolver can't hold up responses, and addresses without a PTR record are cached
+// separately so they aren't looked up again on every request.
+type reverseDNS struct {
+	resolver    Resolver
+	timeout     time.Duration
+	negativeTTL time.Duration
+	cache       *ttlCache[string, string]
+}
+
+func newReverseDNS(resolver Resolver, timeout, cacheTTL, negativeTTL time.Duration) *reverseDNS {
+	return &reverseDNS{
+		resolver:    resolver,
+		timeout:     timeout,
+		negativeTTL: negativeTTL,
+		cache:       newTTLCache[string, string](cacheTTL, 10000),
+	}
+}
+
+// Returns an empty hostname without an error if the address has no PTR record.
+func (r *reverseDNS) Lookup(ctx context.Context, ip string) (string, error) {
+	if hostname, ok := r.cache.Get(ip); ok {
+		return hostname, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	names, err := r.resolver.LookupAddr(ctx, ip)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		r.cache.SetWithTTL(ip, "", r.negativeTTL)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		r.cache.SetWithTTL(ip, "", r.negativeTTL)
+		return "", nil
+	}
+	hostname := strings.TrimSuffix(names[0], ".")
+	r.cache.Set(ip, hostname)
+	return hostname, nil
+}
+
+func (s *service) handleHostnameReq(w http.ResponseWriter, req *http.Request) {
+	ip := s.proxies.clientIP(req)
+	hostname, err := s.rdns.Lookup(req.Context(), ip)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			slog.Warn("failed to look up hostname", slog.String("ip", ip), slog.Any("error", err))
+		}
+		s.writeError(w, req, http.StatusBadGateway, "reverse DNS lookup failed")
+		return
+	}
+	if hostname == "" {
+		s.writeError(w, req, http.StatusNotFound, "no hostname found for "+ip)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"ip":       ip,
+		"hostname": hostname,
+	})
+}
@@ -0,0 +1,306 @@
+package ippotato
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// A Resolver performs every DNS lookup the service makes on behalf of clients, such as
+// reverse DNS. It is satisfied by *net.Resolver. Errors for names which don't exist must be
+// a *net.DNSError with IsNotFound set, like those of the system resolver.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Upper bound of a query to a DoT or DoH upstream, for callers without a deadline of their own.
+const upstreamTimeout = 5 * time.Second
+
+// NewResolver creates the resolver described by spec: "system", a DNS over TLS upstream as
+// tls://host[:port] or a DNS over HTTPS endpoint as https://host/path. Answers are cached
+// for cacheTTL unless it is zero.
+func NewResolver(spec string, cacheTTL time.Duration) (Resolver, error) {
+	var r Resolver
+	switch {
+	case spec == "" || spec == "system":
+		r = net.DefaultResolver
+	case strings.HasPrefix(spec, "tls://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolver: %w", err)
+		}
+		r = newDoTResolver(u)
+	case strings.HasPrefix(spec, "https://"):
+		if _, err := url.Parse(spec); err != nil {
+			return nil, fmt.Errorf("invalid resolver: %w", err)
+		}
+		r = &dohResolver{url: spec, client: &http.Client{Timeout: upstreamTimeout}}
+	default:
+		return nil, fmt.Errorf("invalid resolver %q, expected system, tls://host[:port] or https://host/path", spec)
+	}
+	if cacheTTL > 0 {
+		r = newCachingResolver(r, cacheTTL)
+	}
+	return r, nil
+}
+
+// DNS over TLS (RFC 7858) needs nothing but a dialer: the pure Go resolver speaks DNS over
+// TCP to any connection which isn't a net.PacketConn, which is the framing DoT uses.
+func newDoTResolver(u *url.URL) *net.Resolver {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "853")
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: upstreamTimeout},
+		Config:    &tls.Config{ServerName: u.Hostname()},
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		},
+	}
+}
+
+// A DNS over HTTPS (RFC 8484) client, sending each query as a POST of the wire format.
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+func (r *dohResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+	answers, err := r.query(ctx, reverseName(ip.Unmap()), dnsmessage.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, a := range answers {
+		if ptr, ok := a.Body.(*dnsmessage.PTRResource); ok {
+			names = append(names, ptr.PTR.String())
+		}
+	}
+	return names, nil
+}
+
+func (r *dohResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	var addrs []string
+	var errs []error
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, err := r.query(ctx, host, typ)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, a := range answers {
+			switch body := a.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, netip.AddrFrom4(body.A).String())
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, netip.AddrFrom16(body.AAAA).String())
+			}
+		}
+	}
+	if len(addrs) == 0 && len(errs) > 0 {
+		return nil, errs[0]
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *dohResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	answers, err := r.query(ctx, name, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var txts []string
+	for _, a := range answers {
+		if txt, ok := a.Body.(*dnsmessage.TXTResource); ok {
+			txts = append(txts, strings.Join(txt.TXT, ""))
+		}
+	}
+	return txts, nil
+}
+
+// Returns the answers of the requested type, following nothing: CNAMEs are resolved by the
+// upstream, which is recursive.
+func (r *dohResolver) query(ctx context.Context, name string, typ dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+	// The ID is zero as recommended for DoH, since HTTP already matches responses to queries
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, Server: r.url, IsTimeout: errors.Is(err, context.DeadlineExceeded)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &net.DNSError{Err: "upstream returned status " + strconv.Itoa(resp.StatusCode), Name: name, Server: r.url}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name, Server: r.url}
+	}
+	var answer dnsmessage.Message
+	if err := answer.Unpack(body); err != nil {
+		return nil, &net.DNSError{Err: "malformed response: " + err.Error(), Name: name, Server: r.url}
+	}
+	switch answer.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: r.url, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: "upstream returned " + answer.RCode.String(), Name: name, Server: r.url}
+	}
+	var answers []dnsmessage.Resource
+	for _, a := range answer.Answers {
+		if a.Header.Type == typ {
+			answers = append(answers, a)
+		}
+	}
+	return answers, nil
+}
+
+// The name of the PTR record of an address, in in-addr.arpa or ip6.arpa.
+func reverseName(ip netip.Addr) string {
+	if ip.Is4() {
+		return reverseLabels(ip) + "in-addr.arpa."
+	}
+	return reverseLabels(ip) + "ip6.arpa."
+}
+
+// The octets of an IPv4 address or the nibbles of an IPv6 address in reverse order, each
+// followed by a dot, as used by reverse DNS and DNSBLs.
+func reverseLabels(ip netip.Addr) string {
+	var b strings.Builder
+	if ip.Is4() {
+		a := ip.As4()
+		for i := len(a) - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(a[i])) + ".")
+		}
+		return b.String()
+	}
+	const digits = "0123456789abcdef"
+	a := ip.As16()
+	for i := len(a) - 1; i >= 0; i-- {
+		b.WriteByte(digits[a[i]&0x0f])
+		b.WriteByte('.')
+		b.WriteByte(digits[a[i]>>4])
+		b.WriteByte('.')
+	}
+	return b.String()
+}
+
+// Caches the answers of another resolver, including names which don't exist. Other errors
+// are not cached so a flaky upstream recovers as soon as it can.
+type cachingResolver struct {
+	Resolver
+	cache *ttlCache[string, cachedAnswer]
+}
+
+type cachedAnswer struct {
+	values []string
+	err    error
+}
+
+func newCachingResolver(r Resolver, ttl time.Duration) *cachingResolver {
+	return &cachingResolver{Resolver: r, cache: newTTLCache[string, cachedAnswer](ttl, 10000)}
+}
+
+func (c *cachingResolver) lookup(key string, fn func() ([]string, error)) ([]string, error) {
+	if answer, ok := c.cache.Get(key); ok {
+		return answer.values, answer.err
+	}
+	values, err := fn()
+	var dnsErr *net.DNSError
+	if err == nil || errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		c.cache.Set(key, cachedAnswer{values: values, err: err})
+	}
+	return values, err
+}
+
+func (c *cachingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return c.lookup("PTR "+addr, func() ([]string, error) { return c.Resolver.LookupAddr(ctx, addr) })
+}
+
+func (c *cachingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return c.lookup("HOST "+host, func() ([]string, error) { return c.Resolver.LookupHost(ctx, host) })
+}
+
+func (c *cachingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return c.lookup("TXT "+name, func() ([]string, error) { return c.Resolver.LookupTXT(ctx, name) })
+}
+
+// Returns a DialContext which resolves host names with the resolver rather than the system's,
+// trying each address in turn, so clients of other services follow the same DNS as lookups.
+func resolvingDialer(resolver Resolver, dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := netip.ParseAddr(host); err == nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+		addrs, err := resolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, addr := range addrs {
+			ip, err := netip.ParseAddr(addr)
+			if err != nil || (network == "tcp4" && !ip.Unmap().Is4()) || (network == "tcp6" && ip.Unmap().Is4()) {
+				continue
+			}
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr == nil {
+			firstErr = &net.DNSError{Err: "no suitable address", Name: host}
+		}
+		return nil, firstErr
+	}
+}
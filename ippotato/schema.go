@@ -0,0 +1,182 @@
+package ippotato
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// A version of the JSON schema shared by the IP responses of / and /json. Each version lists
+// the fields it added, using dotted paths for fields of nested objects, and a client pinned to
+// a version with ?schema= only receives the fields of that version and its predecessors.
+//
+// Fields must be registered here before they are served: anything the encoder doesn't know
+// about is dropped, even for unpinned clients. New fields belong in the latest version, or in a
+// new one appended to the end once the latest has been released.
+type schemaVersion struct {
+	name   string
+	fields []string
+}
+
+var schemaVersions = []schemaVersion{
+	{
+		name:   "2024-01",
+		fields: []string{"ip"},
+	},
+	{
+		name: "2026-10",
+		fields: []string{
+			"port",
+			"hostname",
+			"prefix",
+			"origin_asn",
+			"route_attribution",
+			"asn.number", "asn.organization", "asn.network",
+			"http_version",
+			"connection_reused",
+			"tls_fingerprint.ja3", "tls_fingerprint.ja3_hash", "tls_fingerprint.ja4",
+			"warnings.source", "warnings.fields", "warnings.message",
+			"ip_type",
+		},
+	},
+}
+
+// The set of fields in a version, by dotted path. Parents of nested fields map to true too,
+// so filtering knows to descend into them.
+type schemaFields map[string]bool
+
+// Returns nil fields if there is no version with the given name. An empty name selects the
+// latest version.
+func lookupSchema(name string) (string, schemaFields) {
+	if name == "" {
+		name = schemaVersions[len(schemaVersions)-1].name
+	}
+	fields := schemaFields{}
+	for _, version := range schemaVersions {
+		for _, field := range version.fields {
+			for i := range field {
+				if field[i] == '.' {
+					fields[field[:i]] = true
+				}
+			}
+			fields[field] = true
+		}
+		if version.name == name {
+			return name, fields
+		}
+	}
+	return "", nil
+}
+
+// Drops every member of the JSON object which isn't part of the schema, applying the same to
+// each element of arrays. Other values are returned unchanged.
+func (f schemaFields) filter(raw json.RawMessage, prefix string) (json.RawMessage, error) {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(raw, &elems); err == nil {
+		for i, elem := range elems {
+			filtered, err := f.filter(elem, prefix)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = filtered
+		}
+		return json.Marshal(elems)
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return raw, nil
+	}
+	for key, value := range obj {
+		path := prefix + key
+		if !f[path] {
+			delete(obj, key)
+			continue
+		}
+		if f.hasChildren(path) {
+			filtered, err := f.filter(value, path+".")
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = filtered
+		}
+	}
+	return json.Marshal(obj)
+}
+
+// Restricts the fields to those selected with ?fields=, which may name nested fields by their
+// dotted path. Selecting an object selects all of its fields. Selected fields which aren't
+// part of the schema are ignored, so the response just doesn't have them.
+func (f schemaFields) selectFields(selected []string) schemaFields {
+	subset := schemaFields{}
+	for field := range f {
+		for _, s := range selected {
+			if field == s || strings.HasPrefix(field, s+".") || strings.HasPrefix(s, field+".") {
+				subset[field] = true
+				break
+			}
+		}
+	}
+	return subset
+}
+
+func (f schemaFields) hasChildren(path string) bool {
+	for field := range f {
+		if strings.HasPrefix(field, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Encodes v as the JSON response of the request, restricted to the schema version the client
+// pinned and to the comma separated fields it selected, and indented if it asked for ?pretty=1.
+// The selected version is reported in the Schema-Version header. The body is signed if a
+// signing key is configured and the address it reports is the one the connection vouches for.
+func (s *service) writeVersionedJSON(w http.ResponseWriter, req *http.Request, v any) {
+	query := req.URL.Query()
+	name, fields := lookupSchema(query.Get("schema"))
+	if fields == nil {
+		names := make([]string, len(schemaVersions))
+		for i, version := range schemaVersions {
+			names[i] = version.name
+		}
+		s.writeError(w, req, http.StatusBadRequest, "unknown schema version, expected one of "+strings.Join(names, ", "))
+		return
+	}
+	if selected := query.Get("fields"); selected != "" {
+		fields = fields.selectFields(strings.Split(strings.ReplaceAll(selected, " ", ""), ","))
+	}
+	body, err := encodeVersioned(v, fields)
+	if err != nil {
+		s.writeError(w, req, http.StatusInternalServerError, "failed to encode response")
+		return
+	}
+	if pretty, _ := strconv.ParseBool(query.Get("pretty")); pretty {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, body, "", "  "); err != nil {
+			s.writeError(w, req, http.StatusInternalServerError, "failed to encode response")
+			return
+		}
+		body = indented.Bytes()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Schema-Version", name)
+	if s.signer != nil && s.attested(req) {
+		s.signer.sign(w, body)
+	}
+	w.Write(body)
+}
+
+func encodeVersioned(v any, fields schemaFields) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	filtered, err := fields.filter(raw, "")
+	if err != nil {
+		return nil, err
+	}
+	return append(filtered, '\n'), nil
+}
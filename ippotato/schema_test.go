@@ -0,0 +1,176 @@
+package ippotato
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "Rewrite golden files with the current output")
+
+// An extended response with every field populated, so the golden files show exactly which
+// fields each schema version serves.
+func fullExtendedInfo() extendedInfo {
+	return extendedInfo{
+		IP:     "192.0.2.10",
+		Port:   51234,
+		IPType: "documentation",
+		ipDetails: ipDetails{
+			Hostname:         "host.example.com",
+			Prefix:           "192.0.2.0/24",
+			OriginASN:        64496,
+			RouteAttribution: "data via RIPEstat",
+			ASN: &asnInfo{
+				Number:       64496,
+				Organization: "EXAMPLE-AS",
+				Network:      "192.0.2.0/24",
+			},
+			Warnings: []lookupWarning{
+				{Source: "rdns", Fields: []string{"hostname"}, Message: "lookup timed out"},
+			},
+		},
+		HTTPVersion:      "HTTP/2.0",
+		ConnectionReused: true,
+		TLSFingerprint: &tlsFingerprint{
+			JA3:     "771,4865-4866-4867,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-21,29-23-24,0",
+			JA3Hash: "cd08e31494f9531f560d64c695473da9",
+			JA4:     "t13d1516h2_8daaf6152771_e5627efa2ab1",
+		},
+	}
+}
+
+func TestSchemaGolden(t *testing.T) {
+	for _, version := range schemaVersions {
+		t.Run(version.name, func(t *testing.T) {
+			_, fields := lookupSchema(version.name)
+			got, err := encodeVersioned(fullExtendedInfo(), fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", "schema", version.name+".json")
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("output of schema %s changed\ngot:  %s\nwant: %s", version.name, got, want)
+			}
+		})
+	}
+}
+
+// Fails when a field is added to the response without registering it in a schema version,
+// which would otherwise silently drop it from every response.
+func TestSchemaRegistersAllFields(t *testing.T) {
+	_, fields := lookupSchema("")
+	for _, path := range jsonPaths(reflect.TypeOf(extendedInfo{}), "") {
+		if !fields[path] {
+			t.Errorf("field %q is not registered in any schema version", path)
+		}
+	}
+}
+
+func TestSchemaVersionsAreUnique(t *testing.T) {
+	seen := map[string]bool{}
+	for _, version := range schemaVersions {
+		if seen[version.name] {
+			t.Errorf("schema version %s is defined twice", version.name)
+		}
+		seen[version.name] = true
+		for _, field := range version.fields {
+			if seen["field:"+field] {
+				t.Errorf("field %q is registered in more than one version", field)
+			}
+			seen["field:"+field] = true
+		}
+	}
+}
+
+func TestWriteVersionedJSON(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantStatus int
+		wantSchema string
+		wantBody   string
+	}{
+		{"", http.StatusOK, "2026-10", `{"connection_reused":false,"hostname":"host.example.com","ip":"192.0.2.10","port":51234}`},
+		{"?schema=2024-01", http.StatusOK, "2024-01", `{"ip":"192.0.2.10"}`},
+		{"?schema=1999-01", http.StatusBadRequest, "", ""},
+		{"?fields=ip,%20hostname,country", http.StatusOK, "2026-10", `{"hostname":"host.example.com","ip":"192.0.2.10"}`},
+		{"?schema=2024-01&fields=hostname", http.StatusOK, "2024-01", `{}`},
+		{"?fields=ip&pretty=1", http.StatusOK, "2026-10", "{\n  \"ip\": \"192.0.2.10\"\n}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/json"+tt.query, nil)
+			(&service{}).writeVersionedJSON(rec, req, extendedInfo{IP: "192.0.2.10", Port: 51234, ipDetails: ipDetails{Hostname: "host.example.com"}})
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Schema-Version"); got != tt.wantSchema {
+				t.Errorf("got Schema-Version %q, want %q", got, tt.wantSchema)
+			}
+			if tt.wantBody != "" && strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+				t.Errorf("got body %s, want %s", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	_, fields := lookupSchema("")
+	got, err := encodeVersioned(fullExtendedInfo(), fields.selectFields([]string{"ip", "asn.number", "tls_fingerprint"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"asn":{"number":64496},"ip":"192.0.2.10","tls_fingerprint":{"ja3":"771,4865-4866-4867,0-23-65281-10-11-35-16-5-13-18-51-45-43-27-21,29-23-24,0","ja3_hash":"cd08e31494f9531f560d64c695473da9","ja4":"t13d1516h2_8daaf6152771_e5627efa2ab1"}}`
+	if strings.TrimSpace(string(got)) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// Returns the dotted paths of all leaf fields in the JSON encoding of the type.
+func jsonPaths(typ reflect.Type, prefix string) []string {
+	for typ.Kind() == reflect.Pointer || typ.Kind() == reflect.Slice {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct || typ == reflect.TypeOf(time.Time{}) {
+		return nil
+	}
+	var paths []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			paths = append(paths, jsonPaths(field.Type, prefix)...)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if children := jsonPaths(field.Type, prefix+name+"."); len(children) > 0 {
+			paths = append(paths, children...)
+		} else {
+			paths = append(paths, prefix+name)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,105 @@
+package ippotato
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// LoadSigningKey reads an Ed25519 private key from a PEM encoded PKCS #8 file, as written by
+// openssl genpkey -algorithm ed25519.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: expected a PEM encoded PRIVATE KEY", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected an Ed25519 key, got %T", path, key)
+	}
+	return signingKey, nil
+}
+
+// Signs JSON responses so the client can prove to a third party which address it connected
+// from and when, without the third party having to trust the connection it was fetched over.
+//
+// The signature is a detached Ed25519 signature of the timestamp, a dot and the body, the
+// timestamp and the signature are sent in the X-IP-Potato-Timestamp and X-IP-Potato-Signature
+// headers. The public key to verify them with is served at /pubkey, X-IP-Potato-Key-Id tells
+// which one signed a response when keys are rotated. Responses reporting an address taken
+// from forwarding headers which no trusted proxy set aren't signed.
+type responseSigner struct {
+	key   ed25519.PrivateKey
+	keyID string
+	now   func() time.Time
+}
+
+func newResponseSigner(key ed25519.PrivateKey) *responseSigner {
+	return &responseSigner{key: key, keyID: signingKeyID(key.Public().(ed25519.PublicKey)), now: time.Now}
+}
+
+// The first 16 hex digits of the sha256 of the public key.
+func signingKeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func signedMessage(timestamp string, body []byte) []byte {
+	return append([]byte(timestamp+"."), body...)
+}
+
+// Sets the signature headers of the body, which must be written unchanged.
+func (s *responseSigner) sign(w http.ResponseWriter, body []byte) {
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+	signature := ed25519.Sign(s.key, signedMessage(timestamp, body))
+	h := w.Header()
+	h.Set("X-IP-Potato-Timestamp", timestamp)
+	h.Set("X-IP-Potato-Key-Id", s.keyID)
+	h.Set("X-IP-Potato-Signature", "ed25519="+base64.StdEncoding.EncodeToString(signature))
+	// A signature vouches for one response, caches must not hand it to anyone else
+	h.Set("Cache-Control", "private, no-store")
+}
+
+// Whether the address responses report for the request, as RealIP, can be signed. Only the
+// peer of the connection or what a trusted proxy forwards is: otherwise anyone could have
+// any address signed with a forged X-Forwarded-For.
+func (s *service) attested(req *http.Request) bool {
+	ip := RealIP(req)
+	return ip != "" && ip == s.proxies.clientIP(req)
+}
+
+func (s *service) pubkeyHandler() http.HandlerFunc {
+	return Negotiate(map[string]http.HandlerFunc{
+		"application/json": s.handlePubkeyJSONReq,
+	}, s.handlePubkeyTextReq)
+}
+
+func (s *service) handlePubkeyJSONReq(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"algorithm":  "ed25519",
+		"key_id":     s.signer.keyID,
+		"public_key": base64.StdEncoding.EncodeToString(s.signer.key.Public().(ed25519.PublicKey)),
+	})
+}
+
+func (s *service) handlePubkeyTextReq(w http.ResponseWriter, req *http.Request) {
+	s.writeText(w, req, base64.StdEncoding.EncodeToString(s.signer.key.Public().(ed25519.PublicKey)))
+}
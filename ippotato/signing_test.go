@@ -0,0 +1,111 @@
+package ippotato
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadSigningKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSigningKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(key) {
+		t.Error("loaded another key than the one written")
+	}
+
+	if err := os.WriteFile(path, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSigningKey(path); err == nil {
+		t.Error("loaded a file without a key, want an error")
+	}
+}
+
+func TestSignedResponses(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(Options{SigningKey: key})
+	request := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, target := range []string{"/", "/json"} {
+		rec := request(target)
+		encoded, ok := strings.CutPrefix(rec.Header().Get("X-IP-Potato-Signature"), "ed25519=")
+		if !ok {
+			t.Fatalf("got no signature for %s", target)
+		}
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := rec.Header().Get("X-IP-Potato-Timestamp") + "." + rec.Body.String()
+		if !ed25519.Verify(public, []byte(message), signature) {
+			t.Errorf("the signature of %s doesn't verify", target)
+		}
+		if ed25519.Verify(public, []byte("0."+rec.Body.String()), signature) {
+			t.Errorf("the signature of %s verifies with another timestamp", target)
+		}
+		if got, want := rec.Header().Get("X-IP-Potato-Key-Id"), signingKeyID(public); got != want {
+			t.Errorf("got key id %q, want %q", got, want)
+		}
+	}
+
+	var pubkey struct {
+		KeyID     string `json:"key_id"`
+		PublicKey string `json:"public_key"`
+	}
+	if err := json.Unmarshal(request("/pubkey").Body.Bytes(), &pubkey); err != nil {
+		t.Fatal(err)
+	}
+	if pubkey.PublicKey != base64.StdEncoding.EncodeToString(public) || pubkey.KeyID != signingKeyID(public) {
+		t.Errorf("got %+v, want the public key and its id", pubkey)
+	}
+
+	// Anyone can claim any address in X-Forwarded-For, it must not be attested
+	req := httptest.NewRequest(http.MethodGet, "/json", nil)
+	req.RemoteAddr = "192.0.2.10:51234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if signature := rec.Header().Get("X-IP-Potato-Signature"); signature != "" {
+		t.Errorf("got signature %q for %s claimed in X-Forwarded-For, want none", signature, rec.Body)
+	}
+
+	h = Handler(Options{SigningKey: key, TrustedProxies: []netip.Prefix{netip.MustParsePrefix("192.0.2.10/32")}})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Header().Get("X-IP-Potato-Signature") == "" {
+		t.Errorf("got no signature for %s forwarded by a trusted proxy", rec.Body)
+	}
+}
@@ -0,0 +1,131 @@
+package ippotato
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var speedBytes = newCounterVec("ippotato_speed_test_bytes_total", "Number of bytes transferred by bandwidth tests, by direction.", "direction")
+
+// Downloads are written in chunks of this size, repeating one block of random data. Large
+// writes of a body with a known length go straight to the socket without chunked encoding.
+const speedChunkBytes = 256 << 10
+
+// Downloads without a bytes query parameter, unless the limit is lower.
+const defaultSpeedBytes = 10 << 20
+
+// Serves bandwidth tests: downloads of random data and uploads which are thrown away.
+type speedTest struct {
+	maxBytes int64
+	limiter  *rateLimiter
+	// Random so compression along the way can't inflate the measured throughput.
+	chunk []byte
+}
+
+func newSpeedTest(maxBytes int64, rate float64, burst int) *speedTest {
+	t := &speedTest{maxBytes: maxBytes, chunk: make([]byte, speedChunkBytes)}
+	_, _ = rand.Read(t.chunk)
+	if rate > 0 {
+		t.limiter = newRateLimiter(rate, burst)
+	}
+	return t
+}
+
+// Rate limits the requests of each client to both routes together.
+func (s *service) speedTestMiddleware(route string, h http.HandlerFunc) http.Handler {
+	if s.speed.limiter == nil {
+		return h
+	}
+	return rateLimit(s.speed.limiter, s.proxies, route, s.rejectAPIReq)(h)
+}
+
+// Streams the number of bytes of the bytes query parameter, up to the limit of the server.
+func (s *service) handleSpeedDownReq(w http.ResponseWriter, req *http.Request) {
+	n := min(int64(defaultSpeedBytes), s.speed.maxBytes)
+	if v := req.URL.Query().Get("bytes"); v != "" {
+		var err error
+		if n, err = strconv.ParseInt(v, 10, 64); err != nil || n < 0 {
+			s.writeError(w, req, http.StatusBadRequest, "the bytes query parameter must be a positive number")
+			return
+		}
+		if n > s.speed.maxBytes {
+			s.writeError(w, req, http.StatusRequestEntityTooLarge, fmt.Sprintf("downloads are limited to %d bytes", s.speed.maxBytes))
+			return
+		}
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.FormatInt(n, 10))
+	h.Set("Cache-Control", "no-store")
+	var written int64
+	defer func() { speedBytes.Add(float64(written), "down") }()
+	for written < n {
+		chunk := s.speed.chunk[:min(int64(len(s.speed.chunk)), n-written)]
+		m, err := w.Write(chunk)
+		written += int64(m)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// The result of an upload, timed from when the handler starts reading the body until it
+// has read all of it.
+type speedUpResult struct {
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	Mbps       float64 `json:"mbps"`
+}
+
+func (s *service) speedUpHandler() http.HandlerFunc {
+	return Negotiate(map[string]http.HandlerFunc{
+		"application/json": s.handleSpeedUpJSONReq,
+	}, s.handleSpeedUpTextReq)
+}
+
+// Reads and discards the body, up to the limit of the server. Returns false after responding
+// with an error if the upload failed.
+func (s *service) receiveUpload(w http.ResponseWriter, req *http.Request) (speedUpResult, bool) {
+	start := time.Now()
+	n, err := io.Copy(io.Discard, http.MaxBytesReader(w, req.Body, s.speed.maxBytes))
+	elapsed := time.Since(start)
+	speedBytes.Add(float64(n), "up")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		s.writeError(w, req, http.StatusRequestEntityTooLarge, fmt.Sprintf("uploads are limited to %d bytes", s.speed.maxBytes))
+		return speedUpResult{}, false
+	}
+	if err != nil {
+		s.writeError(w, req, http.StatusBadRequest, "failed to read the upload")
+		return speedUpResult{}, false
+	}
+	result := speedUpResult{Bytes: n, DurationMS: float64(elapsed.Microseconds()) / 1000}
+	if elapsed > 0 {
+		result.Mbps = float64(n) * 8 / elapsed.Seconds() / 1e6
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return result, true
+}
+
+func (s *service) handleSpeedUpJSONReq(w http.ResponseWriter, req *http.Request) {
+	result, ok := s.receiveUpload(w, req)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+func (s *service) handleSpeedUpTextReq(w http.ResponseWriter, req *http.Request) {
+	result, ok := s.receiveUpload(w, req)
+	if !ok {
+		return
+	}
+	s.writeText(w, req, fmt.Sprintf("%d bytes in %.1f ms (%.2f Mbit/s)", result.Bytes, result.DurationMS, result.Mbps))
+}
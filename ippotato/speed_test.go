@@ -0,0 +1,49 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleSpeed(t *testing.T) {
+	h := Handler(Options{SpeedMaxBytes: 1 << 20})
+
+	for target, want := range map[string]int{
+		"/speed/down?bytes=600000": 600000,
+		"/speed/down?bytes=0":      0,
+		"/speed/down":              1 << 20,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK || rec.Body.Len() != want {
+			t.Errorf("got status %d and %d bytes from %s, want %d bytes", rec.Code, rec.Body.Len(), target, want)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/speed/down?bytes=2000000", nil))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d for a download above the limit, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	upload := func(n int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/speed/up", strings.NewReader(strings.Repeat("x", n)))
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	rec = upload(300000)
+	var result speedUpResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || result.Bytes != 300000 {
+		t.Errorf("got status %d and %+v, want the 300000 bytes uploaded", rec.Code, result)
+	}
+	if rec := upload(2 << 20); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d for an upload above the limit, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
@@ -0,0 +1,179 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"hash/maphash"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Registers of each sketch are addressed by this many bits of the hash. 2^14 registers take
+// 16KiB and estimate with a standard error of about 0.8%.
+const hllPrecision = 14
+
+// A HyperLogLog sketch (Flajolet et al., with the small range correction of linear counting)
+// estimating the number of distinct hashes added to it.
+type hyperLogLog struct {
+	registers [1 << hllPrecision]uint8
+}
+
+func (h *hyperLogLog) add(hash uint64) {
+	index := hash >> (64 - hllPrecision)
+	// The bit set below the remaining bits bounds the rank if they are all zero
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() int {
+	m := float64(len(h.registers))
+	var sum float64
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(estimate))
+}
+
+// The number of unique clients seen in an hour or day starting at Start (UTC).
+type windowCount struct {
+	Start         time.Time `json:"start"`
+	UniqueClients int       `json:"unique_clients"`
+}
+
+type statsWindow struct {
+	start  time.Time
+	length time.Duration
+	sketch hyperLogLog
+	// Counts of the windows before, oldest first.
+	completed []windowCount
+	keep      int
+}
+
+// Moves on to the window containing now, keeping the count of the one which ended.
+func (w *statsWindow) advance(now time.Time) {
+	start := now.UTC().Truncate(w.length)
+	if start.Equal(w.start) {
+		return
+	}
+	if !w.start.IsZero() {
+		w.completed = append(w.completed, windowCount{Start: w.start, UniqueClients: w.sketch.estimate()})
+		if len(w.completed) > w.keep {
+			w.completed = w.completed[len(w.completed)-w.keep:]
+		}
+	}
+	w.start, w.sketch = start, hyperLogLog{}
+}
+
+// ClientStats estimates how many unique clients were seen per hour and per day, see
+// Options.ClientStats. Only sketches of hashes under a seed which is never stored are kept, so
+// no address can be recovered from them or checked against them once the process exits. IPv6
+// clients are counted by their /64, as privacy extensions would count every temporary address
+// of a client otherwise.
+type ClientStats struct {
+	mu   sync.Mutex
+	seed maphash.Seed
+	hour statsWindow
+	day  statsWindow
+	// The estimates as metrics, not registered with the metrics of the process, as they
+	// belong to whoever serves them.
+	gauge *gaugeVecFunc
+}
+
+// NewClientStats returns statistics keeping the counts of the last 24 hours and 7 days.
+func NewClientStats() *ClientStats {
+	s := &ClientStats{
+		seed: maphash.MakeSeed(),
+		hour: statsWindow{length: time.Hour, keep: 24},
+		day:  statsWindow{length: 24 * time.Hour, keep: 7},
+	}
+	s.gauge = &gaugeVecFunc{
+		name:      "ippotato_unique_clients",
+		help:      "Estimated number of unique clients in the current hour and day (UTC), and in the previous ones.",
+		labelName: "window",
+		fn:        s.counts,
+	}
+	return s
+}
+
+func (s *ClientStats) counts() map[string]float64 {
+	snapshot := s.snapshot(time.Now())
+	counts := map[string]float64{
+		"hour": float64(snapshot.Hour.UniqueClients),
+		"day":  float64(snapshot.Day.UniqueClients),
+	}
+	if n := len(snapshot.Hours); n > 0 {
+		counts["previous_hour"] = float64(snapshot.Hours[n-1].UniqueClients)
+	}
+	if n := len(snapshot.Days); n > 0 {
+		counts["previous_day"] = float64(snapshot.Days[n-1].UniqueClients)
+	}
+	return counts
+}
+
+// Writes the metrics of the process, followed by the estimates of the statistics if any.
+func writeMetrics(w io.Writer, stats *ClientStats) {
+	metrics.writeTo(w)
+	if stats != nil {
+		stats.gauge.writeTo(w)
+	}
+}
+
+func (s *ClientStats) record(ip string, now time.Time) {
+	hash := maphash.String(s.seed, rateLimitKey(ip))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hour.advance(now)
+	s.day.advance(now)
+	s.hour.sketch.add(hash)
+	s.day.sketch.add(hash)
+}
+
+// The counts served at the /stats admin endpoint. The current windows are still counting.
+type clientStatsSnapshot struct {
+	Hour  windowCount   `json:"hour"`
+	Day   windowCount   `json:"day"`
+	Hours []windowCount `json:"previous_hours"`
+	Days  []windowCount `json:"previous_days"`
+}
+
+func (s *ClientStats) snapshot(now time.Time) clientStatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hour.advance(now)
+	s.day.advance(now)
+	return clientStatsSnapshot{
+		Hour:  windowCount{Start: s.hour.start, UniqueClients: s.hour.sketch.estimate()},
+		Day:   windowCount{Start: s.day.start, UniqueClients: s.day.sketch.estimate()},
+		Hours: append([]windowCount{}, s.hour.completed...),
+		Days:  append([]windowCount{}, s.day.completed...),
+	}
+}
+
+// Counts the client of every request in the unique client statistics, by the address the
+// connection vouches for, so clients can't make up addresses to inflate the counts.
+func (s *service) countUniqueClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ip := s.proxies.clientIP(req); ip != "" {
+			s.clientStats.record(ip, time.Now())
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (s *ClientStats) handleStatsReq(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.snapshot(time.Now()))
+}
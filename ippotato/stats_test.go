@@ -0,0 +1,104 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	seed := maphash.MakeSeed()
+	for _, n := range []int{0, 100, 5000, 200000} {
+		var h hyperLogLog
+		for i := 0; i < n; i++ {
+			// Every address is added twice, duplicates must not count
+			ip := fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)
+			h.add(maphash.String(seed, ip))
+			h.add(maphash.String(seed, ip))
+		}
+		got := h.estimate()
+		if math.Abs(float64(got-n)) > math.Max(2, 0.04*float64(n)) {
+			t.Errorf("estimated %d unique values, want about %d", got, n)
+		}
+	}
+}
+
+func TestUniqueClientStatsWindows(t *testing.T) {
+	stats := NewClientStats()
+	stats.hour.keep = 2
+	start := time.Date(2026, 10, 1, 10, 15, 0, 0, time.UTC)
+	for hour, clients := range []int{3, 5, 2, 4} {
+		for i := 0; i < clients; i++ {
+			stats.record(fmt.Sprintf("192.0.2.%d", i), start.Add(time.Duration(hour)*time.Hour))
+		}
+	}
+	// The addresses of a /64 count as one client
+	stats.record("2001:db8::1", start.Add(3*time.Hour))
+	stats.record("2001:db8::2", start.Add(3*time.Hour))
+
+	s := stats.snapshot(start.Add(3 * time.Hour))
+	if want := (windowCount{Start: time.Date(2026, 10, 1, 13, 0, 0, 0, time.UTC), UniqueClients: 5}); s.Hour != want {
+		t.Errorf("got current hour %+v, want %+v", s.Hour, want)
+	}
+	wantHours := []windowCount{
+		{Start: time.Date(2026, 10, 1, 11, 0, 0, 0, time.UTC), UniqueClients: 5},
+		{Start: time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC), UniqueClients: 2},
+	}
+	if fmt.Sprint(s.Hours) != fmt.Sprint(wantHours) {
+		t.Errorf("got previous hours %+v, want the last two %+v", s.Hours, wantHours)
+	}
+	if s.Day.UniqueClients != 6 || len(s.Days) != 0 {
+		t.Errorf("got day %+v and previous days %+v, want 6 clients today and no previous days", s.Day, s.Days)
+	}
+
+	s = stats.snapshot(start.Add(24 * time.Hour))
+	if s.Hour.UniqueClients != 0 || len(s.Days) != 1 || s.Days[0].UniqueClients != 6 {
+		t.Errorf("got %+v the next day, want the count of the day before to be kept", s)
+	}
+}
+
+// Clients are counted by the address of the connection, not one they claim, and by the
+// statistics of their own handler only.
+func TestCountUniqueClients(t *testing.T) {
+	stats, other := NewClientStats(), NewClientStats()
+	h := Handler(Options{ClientStats: stats})
+	Handler(Options{ClientStats: other})
+	for i := range 5 {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	now := time.Now()
+	if got := stats.snapshot(now).Hour.UniqueClients; got != 1 {
+		t.Errorf("counted %d clients, want the one connection", got)
+	}
+	if got := other.snapshot(now).Hour.UniqueClients; got != 0 {
+		t.Errorf("the statistics of another handler counted %d clients", got)
+	}
+
+	admin := AdminHandler(stats)
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var snapshot clientStatsSnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &snapshot); err != nil || snapshot.Hour.UniqueClients != 1 {
+		t.Errorf("got %s from /stats, %v", rec.Body, err)
+	}
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `ippotato_unique_clients{window="hour"} 1`) {
+		t.Errorf("the metrics don't include the estimates:\n%s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	AdminHandler(nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d for /stats without statistics, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,142 @@
+package ippotato
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+)
+
+var (
+	stunRequests    = newCounterVec("ippotato_stun_requests_total", "Number of STUN Binding requests answered.", "family")
+	stunRateLimited = newCounterVec("ippotato_stun_rate_limited_total", "Number of STUN Binding requests dropped since their source exceeded its rate limit.", "family")
+)
+
+// STUNServer is a STUN server (RFC 5389) answering Binding requests with the address and
+// port the request came from, which is the public UDP mapping of a client behind NAT.
+// Authentication and every other method are not supported: anything but a Binding request is
+// ignored. Since UDP sources can be spoofed, answers to each address are rate limited so the
+// server can't be used to flood a third party.
+type STUNServer struct {
+	conn    net.PacketConn
+	limiter *rateLimiter
+}
+
+const (
+	stunMagicCookie     = 0x2112a442
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXORMappedAddress = 0x0020
+)
+
+// ListenSTUN binds the UDP address for a STUN server answering each source address with rate
+// responses per second after an initial burst. A rate of zero leaves answers unlimited.
+func ListenSTUN(addr string, rate float64, burst int) (*STUNServer, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &STUNServer{conn: conn}
+	if rate > 0 {
+		s.limiter = newRateLimiter(rate, burst)
+	}
+	return s, nil
+}
+
+// Addr returns the address the server is bound to.
+func (s *STUNServer) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+// Serve answers requests until the context expires.
+func (s *STUNServer) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.conn.Close()
+	}()
+	buf := make([]byte, 1500)
+	var retry retryDelay
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Errors such as ICMP port unreachable for an earlier answer only concern one
+			// datagram, the socket itself can still be read. Backing off keeps errors which
+			// persist from spinning.
+			wait := retry.next()
+			slog.Warn("failed to read STUN request", slog.Any("error", err), slog.Duration("retry_in", wait))
+			time.Sleep(wait)
+			continue
+		}
+		retry.reset()
+		source, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			continue
+		}
+		source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+		resp := stunBindingAnswer(buf[:n], source)
+		if resp == nil {
+			continue
+		}
+		family := "ipv4"
+		if source.Addr().Is6() {
+			family = "ipv6"
+		}
+		if s.limiter != nil {
+			if ok, _ := s.limiter.Allow(source.Addr().String()); !ok {
+				stunRateLimited.Inc(family)
+				continue
+			}
+		}
+		stunRequests.Inc(family)
+		_, _ = s.conn.WriteTo(resp, addr)
+	}
+}
+
+// Returns the response to a Binding request, or nil for anything else. Requests without the
+// magic cookie come from RFC 3489 clients, which only understand MAPPED-ADDRESS.
+func stunBindingAnswer(req []byte, source netip.AddrPort) []byte {
+	if len(req) < 20 || req[0]&0xc0 != 0 || binary.BigEndian.Uint16(req[0:2]) != stunBindingRequest {
+		return nil
+	}
+	if int(binary.BigEndian.Uint16(req[2:4])) != len(req)-20 {
+		return nil
+	}
+	classic := binary.BigEndian.Uint32(req[4:8]) != stunMagicCookie
+	transaction := req[4:20]
+
+	addr := source.Addr()
+	family, ip := byte(0x01), addr.AsSlice()
+	if addr.Is6() {
+		family = 0x02
+	}
+	port := source.Port()
+	attrType := uint16(stunAttrMappedAddress)
+	if !classic {
+		// XOR-MAPPED-ADDRESS obfuscates the address with the magic cookie and transaction ID,
+		// so NATs which rewrite addresses in payloads can't mangle it
+		attrType = stunAttrXORMappedAddress
+		port ^= stunMagicCookie >> 16
+		for i := range ip {
+			ip[i] ^= transaction[i]
+		}
+	}
+
+	value := []byte{0, family}
+	value = binary.BigEndian.AppendUint16(value, port)
+	value = append(value, ip...)
+
+	resp := binary.BigEndian.AppendUint16(nil, stunBindingResponse)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(4+len(value)))
+	resp = append(resp, transaction...)
+	resp = binary.BigEndian.AppendUint16(resp, attrType)
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(value)))
+	return append(resp, value...)
+}
@@ -0,0 +1,128 @@
+package ippotato
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// The transaction ID and XOR-MAPPED-ADDRESS attributes of the sample responses of RFC 5769
+// sections 2.2 and 2.3.
+const stunTestTransaction = "b7e7a701bc34d686fa87dfae"
+
+func stunTestRequest(cookie uint32, transaction string) []byte {
+	id, err := hex.DecodeString(transaction)
+	if err != nil {
+		panic(err)
+	}
+	req := binary.BigEndian.AppendUint16(nil, stunBindingRequest)
+	req = binary.BigEndian.AppendUint16(req, 0)
+	req = binary.BigEndian.AppendUint32(req, cookie)
+	return append(req, id...)
+}
+
+func TestSTUNBindingAnswer(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		cookie uint32
+		attr   string
+	}{
+		{name: "IPv4", source: "192.0.2.1:32853", cookie: stunMagicCookie, attr: "002000080001a147e112a643"},
+		{name: "IPv6", source: "[2001:db8:1234:5678:11:2233:4455:6677]:32853", cookie: stunMagicCookie, attr: "002000140002a1470113a9faa5d3f179bc25f4b5bed2b9d9"},
+		{name: "RFC 3489 client", source: "192.0.2.1:32853", cookie: 0x01020304, attr: "0001000800018055c0000201"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := stunTestRequest(tt.cookie, stunTestTransaction)
+			resp := stunBindingAnswer(req, netip.MustParseAddrPort(tt.source))
+			if resp == nil {
+				t.Fatal("no answer")
+			}
+			attr, _ := hex.DecodeString(tt.attr)
+			if got := binary.BigEndian.Uint16(resp[0:2]); got != stunBindingResponse {
+				t.Errorf("answered with message type %#04x", got)
+			}
+			if got := int(binary.BigEndian.Uint16(resp[2:4])); got != len(attr) || len(resp) != 20+len(attr) {
+				t.Errorf("answered with length %d and %d bytes, want %d", got, len(resp), 20+len(attr))
+			}
+			if !bytes.Equal(resp[4:20], req[4:20]) {
+				t.Errorf("answered with transaction %x, want %x", resp[4:20], req[4:20])
+			}
+			if !bytes.Equal(resp[20:], attr) {
+				t.Errorf("answered with attribute %x, want %x", resp[20:], attr)
+			}
+		})
+	}
+}
+
+func TestSTUNBindingAnswerIgnoresMalformedRequests(t *testing.T) {
+	valid := stunTestRequest(stunMagicCookie, stunTestTransaction)
+	tests := map[string][]byte{
+		"truncated header": valid[:19],
+		"binding response": append(binary.BigEndian.AppendUint16(nil, stunBindingResponse), valid[2:]...),
+		"other method":     append(binary.BigEndian.AppendUint16(nil, 0x0003), valid[2:]...),
+		// The two most significant bits of every STUN message are zero, which is what tells
+		// it apart from other protocols multiplexed on the same port
+		"not STUN":         append([]byte{0x40, 0x01}, valid[2:]...),
+		"length too long":  append(append([]byte{}, valid[:2]...), append([]byte{0, 4}, valid[4:]...)...),
+		"trailing garbage": append(append([]byte{}, valid...), 0, 0, 0, 0),
+	}
+	source := netip.MustParseAddrPort("192.0.2.1:32853")
+	for name, req := range tests {
+		t.Run(name, func(t *testing.T) {
+			if resp := stunBindingAnswer(req, source); resp != nil {
+				t.Errorf("answered %x", resp)
+			}
+		})
+	}
+}
+
+func TestSTUNServerRateLimit(t *testing.T) {
+	server, err := ListenSTUN("127.0.0.1:0", 0.001, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx)
+
+	conn, err := net.Dial("udp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	answered := 0
+	buf := make([]byte, 1500)
+	for range 4 {
+		if _, err := conn.Write(stunTestRequest(stunMagicCookie, stunTestTransaction)); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := conn.Read(buf); err == nil {
+			answered++
+		}
+	}
+	if answered != 2 {
+		t.Errorf("answered %d requests, want the burst of 2", answered)
+	}
+}
+
+func TestSTUNServerKeepsReading(t *testing.T) {
+	server, err := ListenSTUN("127.0.0.1:0", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.conn = &flakyPacketConn{PacketConn: server.conn, failures: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx)
+	if !udpTestExchange(t, server.Addr(), stunTestRequest(stunMagicCookie, stunTestTransaction)) {
+		t.Error("stopped answering after failing to read")
+	}
+}
@@ -0,0 +1,197 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Details of the TCP connection a request arrived on, as the kernel of the server sees them.
+type tcpConnInfo struct {
+	// Smoothed round trip time and its variance, and the lowest round trip seen.
+	RTTMS    float64 `json:"rtt_ms"`
+	RTTVarMS float64 `json:"rtt_var_ms"`
+	MinRTTMS float64 `json:"min_rtt_ms,omitempty"`
+	// The maximum segment sizes the connection sends and receives with, and the path MTU.
+	SendMSS     int `json:"send_mss"`
+	ReceiveMSS  int `json:"receive_mss"`
+	PathMTU     int `json:"path_mtu,omitempty"`
+	Retransmits int `json:"retransmits"`
+	// The SYN which opened the connection, if the listener saved it.
+	SYN *tcpSYNInfo `json:"syn,omitempty"`
+}
+
+// What the SYN of the client tells about its network stack and the path to the server. An
+// MSS lower than the MTU of ethernet allows points to a tunnel or MSS clamping on the way.
+type tcpSYNInfo struct {
+	TTL int `json:"ttl"`
+	// Routers on the way, guessed from how far the TTL is below the next common initial TTL.
+	Hops        int  `json:"estimated_hops"`
+	MSS         int  `json:"mss,omitempty"`
+	Window      int  `json:"window"`
+	WindowScale *int `json:"window_scale,omitempty"`
+	SACK        bool `json:"sack"`
+	Timestamps  bool `json:"timestamps"`
+}
+
+// ListenConfig returns the configuration to listen with for /conn to report everything it
+// can. On Linux it asks the kernel to keep the SYN of every connection.
+func ListenConfig() net.ListenConfig {
+	return net.ListenConfig{Control: listenControl}
+}
+
+// Returns the TCP connection a request arrived on. Connections which came through PROXY
+// protocol or a proxy setting forwarding headers are between the proxy and the server, so
+// they tell nothing about the client.
+func requestTCPConn(req *http.Request) (*net.TCPConn, error) {
+	if req.Header.Get("X-Real-IP") != "" || req.Header.Get("X-Forwarded-For") != "" {
+		return nil, errConnViaProxy
+	}
+	conn := requestNetConn(req)
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, nil
+		case *helloConn:
+			conn = c.Conn
+		case *proxyProtoConn:
+			return nil, errConnViaProxy
+		default:
+			return nil, errors.New("the request didn't arrive over TCP")
+		}
+	}
+}
+
+var errConnViaProxy = errors.New("the connection is from a proxy rather than the client")
+
+// Parses the IP and TCP headers of a SYN saved by the kernel.
+func parseSYN(packet []byte) (*tcpSYNInfo, error) {
+	if len(packet) == 0 {
+		return nil, errors.New("empty packet")
+	}
+	var syn tcpSYNInfo
+	var tcp []byte
+	switch packet[0] >> 4 {
+	case 4:
+		headerLen := int(packet[0]&0x0f) * 4
+		if len(packet) < 20 || headerLen < 20 || len(packet) < headerLen {
+			return nil, errors.New("truncated IPv4 header")
+		}
+		syn.TTL, tcp = int(packet[8]), packet[headerLen:]
+	case 6:
+		// Extension headers aren't followed, SYNs practically never carry them
+		if len(packet) < 40 || packet[6] != 6 {
+			return nil, errors.New("truncated IPv6 header")
+		}
+		syn.TTL, tcp = int(packet[7]), packet[40:]
+	default:
+		return nil, fmt.Errorf("unknown IP version %d", packet[0]>>4)
+	}
+	syn.Hops = estimateHops(syn.TTL)
+
+	if len(tcp) < 20 {
+		return nil, errors.New("truncated TCP header")
+	}
+	syn.Window = int(tcp[14])<<8 | int(tcp[15])
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || len(tcp) < dataOffset {
+		return nil, errors.New("truncated TCP options")
+	}
+	for options := tcp[20:dataOffset]; len(options) > 0; {
+		kind := options[0]
+		if kind == 0 {
+			break
+		}
+		if kind == 1 {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || int(options[1]) < 2 || len(options) < int(options[1]) {
+			return nil, errors.New("malformed TCP option")
+		}
+		value := options[2:options[1]]
+		switch {
+		case kind == 2 && len(value) == 2:
+			syn.MSS = int(value[0])<<8 | int(value[1])
+		case kind == 3 && len(value) == 1:
+			scale := int(value[0])
+			syn.WindowScale = &scale
+		case kind == 4:
+			syn.SACK = true
+		case kind == 8:
+			syn.Timestamps = true
+		}
+		options = options[options[1]:]
+	}
+	return &syn, nil
+}
+
+// Systems start with a TTL of 64 (Linux, macOS), 128 (Windows) or 255 (network equipment).
+func estimateHops(ttl int) int {
+	for _, initial := range []int{32, 64, 128, 255} {
+		if ttl <= initial {
+			return initial - ttl
+		}
+	}
+	return 0
+}
+
+func (s *service) connHandler() http.HandlerFunc {
+	return Negotiate(map[string]http.HandlerFunc{
+		"application/json": s.handleConnJSONReq,
+	}, s.handleConnTextReq)
+}
+
+// Reads the details of the connection of the request. Returns false after responding with an
+// error if they aren't available.
+func (s *service) requestConnInfo(w http.ResponseWriter, req *http.Request) (*tcpConnInfo, bool) {
+	conn, err := requestTCPConn(req)
+	if err != nil {
+		slog.Debug("connection details are not available", slog.Any("error", err))
+		s.writeError(w, req, http.StatusUnprocessableEntity, "connection details are not available for this connection")
+		return nil, false
+	}
+	info, err := readTCPConnInfo(conn, req)
+	if err != nil {
+		slog.Error("failed to read tcp connection details", slog.Any("error", err))
+		s.writeError(w, req, http.StatusInternalServerError, "connection details are not available")
+		return nil, false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return info, true
+}
+
+func (s *service) handleConnJSONReq(w http.ResponseWriter, req *http.Request) {
+	info, ok := s.requestConnInfo(w, req)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		IP string `json:"ip"`
+		*tcpConnInfo
+	}{RealIP(req), info})
+}
+
+func (s *service) handleConnTextReq(w http.ResponseWriter, req *http.Request) {
+	info, ok := s.requestConnInfo(w, req)
+	if !ok {
+		return
+	}
+	lines := []string{
+		fmt.Sprintf("rtt: %.3f ms (variance %.3f ms)", info.RTTMS, info.RTTVarMS),
+		"mss: " + strconv.Itoa(info.SendMSS) + " send, " + strconv.Itoa(info.ReceiveMSS) + " receive",
+	}
+	if info.PathMTU > 0 {
+		lines = append(lines, "path mtu: "+strconv.Itoa(info.PathMTU))
+	}
+	lines = append(lines, "retransmits: "+strconv.Itoa(info.Retransmits))
+	if syn := info.SYN; syn != nil {
+		lines = append(lines, fmt.Sprintf("syn: ttl %d (about %d hops), mss %d, window %d", syn.TTL, syn.Hops, syn.MSS, syn.Window))
+	}
+	s.writeText(w, req, lines...)
+}
@@ -0,0 +1,86 @@
+//go:build linux
+
+package ippotato
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const tcpInfoSupported = true
+
+// Sets TCP_SAVE_SYN on the listening socket, so the SYN of every accepted connection can be
+// read once with TCP_SAVED_SYN. Kernels without it (before 4.2) only lose the SYN details.
+func listenControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_SAVE_SYN, 1); err != nil {
+			slog.Warn("failed to save the SYN of connections", slog.String("address", address), slog.Any("error", err))
+		}
+	})
+}
+
+func readTCPConnInfo(conn *net.TCPConn, req *http.Request) (*tcpConnInfo, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var tcpInfo *unix.TCPInfo
+	controlErr := raw.Control(func(fd uintptr) {
+		tcpInfo, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if controlErr != nil {
+		return nil, controlErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tcpConnInfo{
+		RTTMS:       float64(tcpInfo.Rtt) / 1000,
+		RTTVarMS:    float64(tcpInfo.Rttvar) / 1000,
+		MinRTTMS:    float64(tcpInfo.Min_rtt) / 1000,
+		SendMSS:     int(tcpInfo.Snd_mss),
+		ReceiveMSS:  int(tcpInfo.Rcv_mss),
+		PathMTU:     int(tcpInfo.Pmtu),
+		Retransmits: int(tcpInfo.Total_retrans),
+		SYN:         savedSYN(req, raw),
+	}, nil
+}
+
+// The kernel hands out the saved SYN only once, so it is kept for the following requests on
+// the connection. Returns nil if the listener didn't save it.
+func savedSYN(req *http.Request, raw syscall.RawConn) *tcpSYNInfo {
+	state, ok := req.Context().Value(connContextKey{}).(*connState)
+	if !ok {
+		return nil
+	}
+	state.synOnce.Do(func() {
+		var packet []byte
+		var err error
+		if controlErr := raw.Control(func(fd uintptr) {
+			packet, err = getsockoptBytes(int(fd), unix.IPPROTO_TCP, unix.TCP_SAVED_SYN)
+		}); controlErr != nil || err != nil || len(packet) == 0 {
+			return
+		}
+		if state.syn, err = parseSYN(packet); err != nil {
+			slog.Warn("failed to parse the saved SYN", slog.Any("error", err))
+		}
+	})
+	return state.syn
+}
+
+// Like unix.GetsockoptString, but without cutting the value off at the first NUL byte, which
+// packet headers are full of.
+func getsockoptBytes(fd, level, opt int) ([]byte, error) {
+	buf := make([]byte, 512)
+	n := uint32(len(buf))
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt), uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return buf[:n], nil
+}
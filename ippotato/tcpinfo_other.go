@@ -0,0 +1,18 @@
+//go:build !linux
+
+package ippotato
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+const tcpInfoSupported = false
+
+var listenControl func(network, address string, c syscall.RawConn) error
+
+func readTCPConnInfo(conn *net.TCPConn, req *http.Request) (*tcpConnInfo, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,43 @@
+package ippotato
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSYN(t *testing.T) {
+	ipv4 := []byte{
+		0x45, 0x00, 0x00, 0x3c, 0x12, 0x34, 0x40, 0x00, 0x37, 0x06, 0x00, 0x00,
+		192, 0, 2, 1, 198, 51, 100, 1,
+	}
+	tcp := []byte{
+		0xc3, 0x50, 0x01, 0xbb, 0, 0, 0, 1, 0, 0, 0, 0, 0xa0, 0x02, 0xfa, 0xf0, 0, 0, 0, 0,
+		// MSS 1360, SACK permitted, timestamps, NOP, window scale 7
+		2, 4, 0x05, 0x50, 4, 2, 8, 10, 0, 0, 0, 1, 0, 0, 0, 0, 1, 3, 3, 7,
+	}
+	syn, err := parseSYN(append(ipv4, tcp...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scale := 7
+	want := &tcpSYNInfo{TTL: 55, Hops: 9, MSS: 1360, Window: 64240, WindowScale: &scale, SACK: true, Timestamps: true}
+	if !reflect.DeepEqual(syn, want) {
+		t.Errorf("got %+v, want %+v", syn, want)
+	}
+
+	ipv6 := make([]byte, 40)
+	ipv6[0], ipv6[6], ipv6[7] = 0x60, 6, 116
+	plain := []byte{0xc3, 0x50, 0x01, 0xbb, 0, 0, 0, 1, 0, 0, 0, 0, 0x50, 0x02, 0xff, 0xff, 0, 0, 0, 0}
+	if syn, err = parseSYN(append(ipv6, plain...)); err != nil {
+		t.Fatal(err)
+	}
+	if want := (&tcpSYNInfo{TTL: 116, Hops: 12, Window: 65535}); !reflect.DeepEqual(syn, want) {
+		t.Errorf("got %+v, want %+v", syn, want)
+	}
+
+	for _, truncated := range [][]byte{nil, ipv4, append(ipv4, tcp[:30]...), ipv6[:20]} {
+		if _, err := parseSYN(truncated); err == nil {
+			t.Errorf("parsed %x, want an error", truncated)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package ippotato
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+)
+
+var tcpConnections = newCounterVec("ippotato_tcp_connections_total", "Number of connections answered by the plain TCP server.")
+
+// TCPServer answers every connection with the address of the peer followed by a newline and
+// closes it, without speaking any protocol, so `nc host port` is enough to find out the
+// public address.
+type TCPServer struct {
+	ln net.Listener
+}
+
+// ListenTCP binds the address for a plain TCP server.
+func ListenTCP(addr string) (*TCPServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPServer{ln: ln}, nil
+}
+
+// Addr returns the address the server is bound to.
+func (s *TCPServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Serve answers connections until the context expires.
+func (s *TCPServer) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.ln.Close()
+	}()
+	var retry retryDelay
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			wait := retry.next()
+			slog.Error("failed to accept TCP connection", slog.Any("error", err), slog.Duration("retry_in", wait))
+			time.Sleep(wait)
+			continue
+		}
+		retry.reset()
+		go func() {
+			defer conn.Close()
+			tcpConnections.Inc()
+			_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			_, _ = conn.Write([]byte(addrOf(conn.RemoteAddr()).String() + "\n"))
+		}()
+	}
+}
+
+// Spaces out retries of a listener which fails to accept, like net/http.Server does: the delay
+// starts at 5ms and doubles up to a second. Errors such as running out of file descriptors
+// pass, so the listener keeps serving once they do rather than exiting or spinning.
+type retryDelay struct {
+	delay time.Duration
+}
+
+// Returns how long to wait before the next attempt.
+func (r *retryDelay) next() time.Duration {
+	r.delay = min(max(2*r.delay, 5*time.Millisecond), time.Second)
+	return r.delay
+}
+
+// Starts over after an attempt succeeded.
+func (r *retryDelay) reset() {
+	r.delay = 0
+}
@@ -0,0 +1,85 @@
+package ippotato
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTCPServer(t *testing.T) {
+	server, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx)
+
+	for range 2 {
+		conn, err := net.Dial("tcp", server.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(answer) != "127.0.0.1\n" {
+			t.Errorf("answered %q, want the peer's address", answer)
+		}
+	}
+}
+
+// Fails the first accepts like a process out of file descriptors would.
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestTCPServerRetriesAccept(t *testing.T) {
+	server, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ln = &flakyListener{Listener: server.ln, failures: 3}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx)
+
+	conn, err := net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if answer, err := io.ReadAll(conn); err != nil || string(answer) != "127.0.0.1\n" {
+		t.Errorf("answered %q (%v) after failing to accept, want the peer's address", answer, err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	var r retryDelay
+	var got []time.Duration
+	for range 10 {
+		got = append(got, r.next())
+	}
+	if got[0] != 5*time.Millisecond || got[1] != 10*time.Millisecond || got[9] != time.Second {
+		t.Errorf("got delays %v, want doubling from 5ms up to 1s", got)
+	}
+	r.reset()
+	if d := r.next(); d != 5*time.Millisecond {
+		t.Errorf("got %v after a reset, want 5ms", d)
+	}
+}
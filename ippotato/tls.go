@@ -0,0 +1,143 @@
+package ippotato
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+// NewTLSConfig builds the TLS configuration of a server serving Handler. The clientAuth mode
+// is one of none, request, require, verify-if-given or require-and-verify. Client
+// certificates are only verified against caFile for the verifying client auth modes, the
+// others accept any certificate so /cert can show what a misconfigured client actually sent.
+func NewTLSConfig(certFile, keyFile, clientAuth, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	authType, ok := clientAuthTypes[clientAuth]
+	if !ok {
+		return nil, fmt.Errorf("unknown client auth mode %q", clientAuth)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   authType,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	} else if authType == tls.VerifyClientCertIfGiven || authType == tls.RequireAndVerifyClientCert {
+		return nil, errors.New("verifying client certificates requires a client CA file")
+	}
+	return config, nil
+}
+
+type certSANs struct {
+	DNS   []string `json:"dns,omitempty"`
+	IP    []string `json:"ip,omitempty"`
+	Email []string `json:"email,omitempty"`
+	URI   []string `json:"uri,omitempty"`
+}
+
+// The client certificate presented during the TLS handshake.
+type clientCertInfo struct {
+	Subject           string    `json:"subject"`
+	Issuer            string    `json:"issuer"`
+	SerialNumber      string    `json:"serial_number"`
+	SANs              certSANs  `json:"sans"`
+	SHA256Fingerprint string    `json:"sha256_fingerprint"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+	Expired           bool      `json:"expired"`
+	Verified          bool      `json:"verified"`
+}
+
+// Returns nil if the request didn't arrive over TLS or no certificate was presented.
+func clientCertificate(req *http.Request) *clientCertInfo {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := req.TLS.PeerCertificates[0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	info := &clientCertInfo{
+		Subject:           cert.Subject.String(),
+		Issuer:            cert.Issuer.String(),
+		SerialNumber:      cert.SerialNumber.String(),
+		SANs:              certSANs{DNS: cert.DNSNames, Email: cert.EmailAddresses},
+		SHA256Fingerprint: hex.EncodeToString(fingerprint[:]),
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		Expired:           time.Now().After(cert.NotAfter),
+		Verified:          len(req.TLS.VerifiedChains) > 0,
+	}
+	for _, ip := range cert.IPAddresses {
+		info.SANs.IP = append(info.SANs.IP, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		info.SANs.URI = append(info.SANs.URI, uri.String())
+	}
+	return info
+}
+
+func (s *service) certHandler() http.HandlerFunc {
+	return Negotiate(map[string]http.HandlerFunc{
+		"application/json": s.handleCertJSONReq,
+	}, s.handleCertTextReq)
+}
+
+func (s *service) handleCertJSONReq(w http.ResponseWriter, req *http.Request) {
+	info := clientCertificate(req)
+	if info == nil {
+		s.writeError(w, req, http.StatusNotFound, "no client certificate was presented")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(info)
+}
+
+func (s *service) handleCertTextReq(w http.ResponseWriter, req *http.Request) {
+	info := clientCertificate(req)
+	if info == nil {
+		s.writeError(w, req, http.StatusNotFound, "no client certificate was presented")
+		return
+	}
+	var sans []string
+	for _, names := range [][]string{info.SANs.DNS, info.SANs.IP, info.SANs.Email, info.SANs.URI} {
+		sans = append(sans, names...)
+	}
+	s.writeText(w, req,
+		"Subject: "+info.Subject,
+		"Issuer: "+info.Issuer,
+		"Serial number: "+info.SerialNumber,
+		"SANs: "+strings.Join(sans, ", "),
+		"SHA-256 fingerprint: "+info.SHA256Fingerprint,
+		"Not before: "+info.NotBefore.Format(time.RFC3339),
+		"Not after: "+info.NotAfter.Format(time.RFC3339),
+		"Expired: "+strconv.FormatBool(info.Expired),
+		"Verified: "+strconv.FormatBool(info.Verified),
+	)
+}
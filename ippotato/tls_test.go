@@ -0,0 +1,213 @@
+package ippotato
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// Issues a certificate signed by parent, or a self-signed CA if parent is nil, and writes it
+// and its key as PEM files to dir.
+func issueTestCert(t *testing.T, dir, name string, parent *testCert, template *x509.Certificate) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, name+".pem"), keyFile: filepath.Join(dir, name+".key")}
+	if err := os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+type testPKI struct {
+	dir    string
+	ca     *testCert
+	server *testCert
+	client *testCert
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	dir := t.TempDir()
+	ca := issueTestCert(t, dir, "ca", nil, &x509.Certificate{SerialNumber: big.NewInt(1)})
+	return &testPKI{
+		dir: dir,
+		ca:  ca,
+		server: issueTestCert(t, dir, "server", ca, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}),
+		client: issueTestCert(t, dir, "client", ca, &x509.Certificate{
+			SerialNumber:   big.NewInt(3),
+			DNSNames:       []string{"client.example.com"},
+			EmailAddresses: []string{"client@example.com"},
+			ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}),
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	pki := newTestPKI(t)
+	notPEM := filepath.Join(pki.dir, "empty.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		clientAuth string
+		caFile     string
+		want       tls.ClientAuthType
+		wantErr    string
+	}{
+		{clientAuth: "none", want: tls.NoClientCert},
+		{clientAuth: "request", want: tls.RequestClientCert},
+		{clientAuth: "require", want: tls.RequireAnyClientCert},
+		{clientAuth: "verify-if-given", caFile: pki.ca.certFile, want: tls.VerifyClientCertIfGiven},
+		{clientAuth: "require-and-verify", caFile: pki.ca.certFile, want: tls.RequireAndVerifyClientCert},
+		{clientAuth: "require-and-verify", wantErr: "requires a client CA file"},
+		{clientAuth: "verify-if-given", caFile: notPEM, wantErr: "no certificates found"},
+		{clientAuth: "sometimes", wantErr: `unknown client auth mode "sometimes"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.clientAuth, func(t *testing.T) {
+			config, err := NewTLSConfig(pki.server.certFile, pki.server.keyFile, tt.clientAuth, tt.caFile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ClientAuth != tt.want || config.MinVersion != tls.VersionTLS12 || len(config.Certificates) != 1 {
+				t.Errorf("unexpected config %+v", config)
+			}
+			if (config.ClientCAs != nil) != (tt.caFile != "") {
+				t.Errorf("client CAs are %v with CA file %q", config.ClientCAs, tt.caFile)
+			}
+		})
+	}
+
+	if _, err := NewTLSConfig(pki.server.certFile, pki.client.keyFile, "none", ""); err == nil {
+		t.Error("expected a key which doesn't match the certificate to be refused")
+	}
+}
+
+// A TLS server set up as documented shows the client certificate at /cert.
+func TestCertRoute(t *testing.T) {
+	pki := newTestPKI(t)
+	config, err := NewTLSConfig(pki.server.certFile, pki.server.keyFile, "verify-if-given", pki.ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: Handler(Options{TLSConfig: config}), ConnContext: ConnContext}
+	go server.Serve(tls.NewListener(NewListener(ln, false, true), config))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pki.ca.cert)
+	get := func(accept string, certs ...tls.Certificate) (int, string) {
+		t.Helper()
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		}}}
+		defer c.CloseIdleConnections()
+		req, err := http.NewRequest(http.MethodGet, "https://"+ln.Addr().String()+"/cert", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(pki.client.certFile, pki.client.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, body := get("application/json", clientCert)
+	if status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, body)
+	}
+	var info clientCertInfo
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Subject != "CN=client" || info.Issuer != "CN=ca" || info.SerialNumber != "3" || !info.Verified || info.Expired {
+		t.Errorf("unexpected certificate %+v", info)
+	}
+	if len(info.SANs.DNS) != 1 || info.SANs.DNS[0] != "client.example.com" || len(info.SANs.Email) != 1 || info.SANs.Email[0] != "client@example.com" {
+		t.Errorf("unexpected SANs %+v", info.SANs)
+	}
+	if len(info.SHA256Fingerprint) != 64 {
+		t.Errorf("unexpected fingerprint %q", info.SHA256Fingerprint)
+	}
+
+	status, body = get("text/plain", clientCert)
+	if status != http.StatusOK || !strings.Contains(body, "Subject: CN=client\n") || !strings.Contains(body, "Verified: true\n") {
+		t.Errorf("status %d: %s", status, body)
+	}
+
+	if status, body := get("application/json"); status != http.StatusNotFound || !strings.Contains(body, "no client certificate was presented") {
+		t.Errorf("status %d without a certificate: %s", status, body)
+	}
+}
@@ -0,0 +1,83 @@
+package ippotato
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParseTrustedProxies parses a comma separated list of addresses and prefixes, e.g.
+// "10.0.0.0/8,2001:db8::1".
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			addr, err := netip.ParseAddr(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", part, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", part, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+type trustedProxies []netip.Prefix
+
+func (t trustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the address of the client as far as the server can vouch for it: the peer of the
+// connection, which PROXY protocol already replaced with the client it relayed, unless the
+// peer is a trusted proxy. Behind trusted proxies it is their X-Real-IP, or the last address
+// of X-Forwarded-For which wasn't added by one of them, as clients can prepend anything.
+//
+// Unlike RealIP, which shows clients what their proxies claim, it is what rate limits, port
+// checks, the lookups of /asn, /bgp, /blacklist, /hostname, /json and /whois, the history
+// and signatures rely on. It returns an empty string if the address isn't known.
+func (t trustedProxies) clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	if !t.contains(peer) {
+		return peer.Unmap().String()
+	}
+	if xrip, err := netip.ParseAddr(strings.TrimSpace(req.Header.Get("X-Real-IP"))); err == nil {
+		return xrip.Unmap().String()
+	}
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// Nothing left of a malformed entry can be trusted
+			break
+		}
+		if !t.contains(addr) {
+			return addr.Unmap().String()
+		}
+	}
+	return peer.Unmap().String()
+}
@@ -0,0 +1,129 @@
+package ippotato
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	prefixes, err := ParseTrustedProxies("10.0.0.0/8, 2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies := trustedProxies(prefixes)
+	tests := []struct {
+		remoteAddr, realIP, forwardedFor, want string
+	}{
+		{"192.0.2.10:51234", "198.51.100.1", "198.51.100.2", "192.0.2.10"},
+		{"10.1.2.3:51234", "198.51.100.1", "198.51.100.2", "198.51.100.1"},
+		{"10.1.2.3:51234", "", "203.0.113.9, 198.51.100.2, 10.0.0.7", "198.51.100.2"},
+		{"[2001:db8::1]:51234", "", "198.51.100.2", "198.51.100.2"},
+		{"10.1.2.3:51234", "", "198.51.100.2, bogus", "10.1.2.3"},
+		{"10.1.2.3:51234", "", "", "10.1.2.3"},
+		{"[::ffff:192.0.2.10]:51234", "", "198.51.100.2", "192.0.2.10"},
+		{"pipe", "", "198.51.100.2", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if tt.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		if got := proxies.clientIP(req); got != tt.want {
+			t.Errorf("got %q from %s with X-Real-IP %q and X-Forwarded-For %q, want %q", got, tt.remoteAddr, tt.realIP, tt.forwardedFor, tt.want)
+		}
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "proxy"} {
+		if _, err := ParseTrustedProxies(invalid); err == nil {
+			t.Errorf("parsed %q, want an error", invalid)
+		}
+	}
+}
+
+// A new X-Forwarded-For on every request must not get a client a new bucket.
+func TestRateLimitIgnoresForwardingHeaders(t *testing.T) {
+	h := Handler(Options{APIRate: 0.001, APIBurst: 2})
+	codes := make([]int, 3)
+	for i := range codes {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/ip", nil)
+		req.RemoteAddr = "192.0.2.10:51234"
+		req.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(i+1))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		codes[i] = rec.Code
+	}
+	if codes[2] != http.StatusTooManyRequests {
+		t.Errorf("got statuses %v, want the third request to be rate limited", codes)
+	}
+}
+
+// Lookups are of the address the connection vouches for, not one claimed in X-Forwarded-For.
+func TestLookupsIgnoreForwardingHeaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asn.tsv")
+	writeTestDataset(t, path, testDatasetGood, nil)
+	db, err := LoadASNDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(Options{ASNDB: db})
+	tests := []struct {
+		peer, forwardedFor string
+		want               int
+	}{
+		{"192.0.2.10", "198.51.100.1", http.StatusOK},
+		{"198.51.100.1", "192.0.2.10", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/asn", nil)
+		req.RemoteAddr = tt.peer + ":51234"
+		req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want || (tt.want == http.StatusOK && !strings.Contains(rec.Body.String(), `"ip":"`+tt.peer+`"`)) {
+			t.Errorf("got status %d and %q from %s claiming %s, want %d for the peer's address", rec.Code, rec.Body, tt.peer, tt.forwardedFor, tt.want)
+		}
+	}
+}
+
+// /json reports the address the client claims, but only looks up details of one vouched for.
+func TestExtendedLookupsIgnoreForwardingHeaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "asn.tsv")
+	writeTestDataset(t, path, testDatasetGood, nil)
+	db, err := LoadASNDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, err := ParseTrustedProxies("203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(Options{ASNDB: db, TrustedProxies: proxies})
+	tests := []struct {
+		peer, forwardedFor string
+		wantASN            bool
+	}{
+		{"192.0.2.10", "", true},
+		{"198.51.100.1", "192.0.2.10", false},
+		{"203.0.113.1", "192.0.2.10", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/json", nil)
+		req.RemoteAddr = tt.peer + ":51234"
+		if tt.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		body := rec.Body.String()
+		if !strings.Contains(body, `"ip":"192.0.2.10"`) || strings.Contains(body, `"asn"`) != tt.wantASN {
+			t.Errorf("got %s from %s claiming %q, want the AS of 192.0.2.10: %v", body, tt.peer, tt.forwardedFor, tt.wantASN)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package ippotato
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+)
+
+var udpDatagrams = newCounterVec("ippotato_udp_datagrams_total", "Number of datagrams received by the UDP echo server, by result: answered or rate_limited.", "result")
+
+// UDPServer answers every datagram with the address and source port it came from, as
+// host:port and a newline. Since UDP sources can be spoofed, answers to each address are
+// rate limited so the server can't be used to flood a third party.
+type UDPServer struct {
+	conn    net.PacketConn
+	limiter *rateLimiter
+}
+
+// ListenUDP binds the address for a UDP echo server answering each source address with rate
+// datagrams per second after an initial burst. A rate of zero leaves answers unlimited, which
+// should only be used where sources can't be spoofed.
+func ListenUDP(addr string, rate float64, burst int) (*UDPServer, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &UDPServer{conn: conn}
+	if rate > 0 {
+		s.limiter = newRateLimiter(rate, burst)
+	}
+	return s, nil
+}
+
+// Addr returns the address the server is bound to.
+func (s *UDPServer) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+// Serve answers datagrams until the context expires.
+func (s *UDPServer) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.conn.Close()
+	}()
+	buf := make([]byte, 1500)
+	var retry retryDelay
+	for {
+		_, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Errors such as ICMP port unreachable for an earlier answer only concern one
+			// datagram, the socket itself can still be read. Backing off keeps errors which
+			// persist from spinning.
+			wait := retry.next()
+			slog.Warn("failed to read UDP datagram", slog.Any("error", err), slog.Duration("retry_in", wait))
+			time.Sleep(wait)
+			continue
+		}
+		retry.reset()
+		source, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			continue
+		}
+		source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+		if s.limiter != nil {
+			if ok, _ := s.limiter.Allow(source.Addr().String()); !ok {
+				udpDatagrams.Inc("rate_limited")
+				continue
+			}
+		}
+		udpDatagrams.Inc("answered")
+		_, _ = s.conn.WriteTo([]byte(source.String()+"\n"), addr)
+	}
+}
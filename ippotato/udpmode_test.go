@@ -0,0 +1,101 @@
+package ippotato
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUDPServer(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		burst    int
+		answered int
+	}{
+		{name: "rate limited", rate: 0.001, burst: 2, answered: 2},
+		{name: "unlimited", rate: 0, answered: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := ListenUDP("127.0.0.1:0", tt.rate, tt.burst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go server.Serve(ctx)
+
+			conn, err := net.Dial("udp", server.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			answered := 0
+			buf := make([]byte, 100)
+			for range 4 {
+				if _, err := conn.Write([]byte("ping")); err != nil {
+					t.Fatal(err)
+				}
+				_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				n, err := conn.Read(buf)
+				if err != nil {
+					continue
+				}
+				answered++
+				if got, want := string(buf[:n]), conn.LocalAddr().String()+"\n"; got != want {
+					t.Errorf("answered %q, want %q", got, want)
+				}
+			}
+			if answered != tt.answered {
+				t.Errorf("answered %d datagrams, want %d", answered, tt.answered)
+			}
+		})
+	}
+}
+
+// Fails the first reads like the ICMP errors Linux reports for earlier datagrams.
+type flakyPacketConn struct {
+	net.PacketConn
+	failures int
+}
+
+func (c *flakyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.failures > 0 {
+		c.failures--
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: syscall.ECONNREFUSED}
+	}
+	return c.PacketConn.ReadFrom(b)
+}
+
+// Sends a datagram to addr, returning whether it was answered.
+func udpTestExchange(t *testing.T, addr string, datagram []byte) bool {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(datagram); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1500))
+	return err == nil
+}
+
+func TestUDPServerKeepsReading(t *testing.T) {
+	server, err := ListenUDP("127.0.0.1:0", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.conn = &flakyPacketConn{PacketConn: server.conn, failures: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Serve(ctx)
+	if !udpTestExchange(t, server.Addr(), []byte("ping")) {
+		t.Error("stopped answering after failing to read")
+	}
+}
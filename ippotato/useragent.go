@@ -0,0 +1,125 @@
+package ippotato
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+type userAgentComponent struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+// A best effort interpretation of a User-Agent string. It only recognises the common
+// browsers, operating systems and command line clients, anything else is left empty.
+type userAgentInfo struct {
+	Browser *userAgentComponent `json:"browser,omitempty"`
+	OS      *userAgentComponent `json:"os,omitempty"`
+	Device  string              `json:"device,omitempty"`
+}
+
+// Checked in order since most browsers also claim to be the browsers they derive from, e.g.
+// Edge contains Chrome and Safari tokens.
+var browserTokens = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"FxiOS/", "Firefox"},
+	{"Firefox/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Version/", "Safari"},
+	{"curl/", "curl"},
+	{"Wget/", "Wget"},
+	{"HTTPie/", "HTTPie"},
+	{"python-requests/", "Python Requests"},
+	{"Go-http-client/", "Go"},
+	{"PowerShell/", "PowerShell"},
+}
+
+func parseUserAgent(ua string) userAgentInfo {
+	info := userAgentInfo{}
+	for _, b := range browserTokens {
+		if version, ok := tokenVersion(ua, b.token); ok {
+			if b.name == "Safari" && !strings.Contains(ua, "Safari/") {
+				continue
+			}
+			info.Browser = &userAgentComponent{Name: b.name, Version: version}
+			break
+		}
+	}
+
+	switch {
+	case strings.Contains(ua, "Windows NT "):
+		version, _ := tokenVersion(ua, "Windows NT ")
+		info.OS = &userAgentComponent{Name: "Windows", Version: version}
+	case strings.Contains(ua, "Android"):
+		version, _ := tokenVersion(ua, "Android ")
+		info.OS = &userAgentComponent{Name: "Android", Version: version}
+	case strings.Contains(ua, "iPhone OS "), strings.Contains(ua, "CPU OS "):
+		version, ok := tokenVersion(ua, "iPhone OS ")
+		if !ok {
+			version, _ = tokenVersion(ua, "CPU OS ")
+		}
+		info.OS = &userAgentComponent{Name: "iOS", Version: strings.ReplaceAll(version, "_", ".")}
+	case strings.Contains(ua, "Mac OS X"):
+		version, _ := tokenVersion(ua, "Mac OS X ")
+		info.OS = &userAgentComponent{Name: "macOS", Version: strings.ReplaceAll(version, "_", ".")}
+	case strings.Contains(ua, "CrOS"):
+		info.OS = &userAgentComponent{Name: "ChromeOS"}
+	case strings.Contains(ua, "Linux"):
+		info.OS = &userAgentComponent{Name: "Linux"}
+	}
+
+	lower := strings.ToLower(ua)
+	switch {
+	case strings.Contains(lower, "bot"), strings.Contains(lower, "spider"), strings.Contains(lower, "crawl"):
+		info.Device = "bot"
+	case strings.Contains(ua, "iPad"), strings.Contains(ua, "Tablet"),
+		strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile"):
+		info.Device = "tablet"
+	case strings.Contains(ua, "Mobi"), strings.Contains(ua, "iPhone"):
+		info.Device = "mobile"
+	case info.OS != nil && info.Browser != nil:
+		info.Device = "desktop"
+	}
+	return info
+}
+
+// Returns the version following the token, up to the next space, semicolon or parenthesis.
+func tokenVersion(ua, token string) (string, bool) {
+	i := strings.Index(ua, token)
+	if i == -1 {
+		return "", false
+	}
+	rest := ua[i+len(token):]
+	if end := strings.IndexAny(rest, " ;)"); end != -1 {
+		rest = rest[:end]
+	}
+	return rest, true
+}
+
+func (s *service) userAgentHandler() http.HandlerFunc {
+	return Negotiate(map[string]http.HandlerFunc{
+		"application/json": s.handleUserAgentJSONReq,
+	}, s.handleUserAgentTextReq)
+}
+
+func (s *service) handleUserAgentJSONReq(w http.ResponseWriter, req *http.Request) {
+	resp := struct {
+		UserAgent string `json:"user_agent"`
+		*userAgentInfo
+	}{UserAgent: req.UserAgent()}
+	if s.parseUserAgents && resp.UserAgent != "" {
+		info := parseUserAgent(resp.UserAgent)
+		resp.userAgentInfo = &info
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *service) handleUserAgentTextReq(w http.ResponseWriter, req *http.Request) {
+	s.writeText(w, req, req.UserAgent())
+}
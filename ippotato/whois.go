@@ -0,0 +1,243 @@
+package ippotato
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// The registration of the network an address belongs to, as published over RDAP.
+type whoisInfo struct {
+	Handle   string        `json:"handle,omitempty"`
+	Name     string        `json:"name,omitempty"`
+	Country  string        `json:"country,omitempty"`
+	NetRange whoisNetRange `json:"netrange"`
+	// The organisation the network is registered to.
+	Org   string        `json:"org,omitempty"`
+	Abuse *whoisContact `json:"abuse,omitempty"`
+	// The RDAP server which answered, after following the redirects of the bootstrap service.
+	Source string `json:"source"`
+}
+
+type whoisNetRange struct {
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	CIDRs []string `json:"cidrs,omitempty"`
+}
+
+type whoisContact struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+	Phone string `json:"phone,omitempty"`
+}
+
+// RDAP responses are small, anything larger than this isn't read.
+const maxRDAPResponseBytes = 1 << 20
+
+// Looks up the registration of addresses with RDAP (RFC 9083), starting at a bootstrap
+// service such as https://rdap.org which redirects to the registry of the address. The hosts
+// of the bootstrap service and of every registry it refers to are resolved with the resolver
+// of the options. Successful lookups are cached since registrations rarely change.
+type rdapClient struct {
+	baseURL    string
+	httpClient *http.Client
+	cache      *ttlCache[netip.Addr, *whoisInfo]
+}
+
+func newRDAPClient(baseURL string, resolver Resolver, timeout, cacheTTL time.Duration) *rdapClient {
+	dialer := &net.Dialer{Timeout: timeout}
+	return &rdapClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{
+			// Bounds the whole lookup, including every redirect
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           resolvingDialer(resolver, dialer),
+				TLSHandshakeTimeout:   timeout,
+				ResponseHeaderTimeout: timeout,
+				MaxIdleConnsPerHost:   4,
+				IdleConnTimeout:       time.Minute,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 3 {
+					return errors.New("rdap server redirected too many times")
+				}
+				return nil
+			},
+		},
+		cache: newTTLCache[netip.Addr, *whoisInfo](cacheTTL, 10000),
+	}
+}
+
+func (c *rdapClient) Lookup(ctx context.Context, ip netip.Addr) (*whoisInfo, error) {
+	if info, ok := c.cache.Get(ip); ok {
+		return info, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/ip/"+ip.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/rdap+json, application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rdap server returned status %d", resp.StatusCode)
+	}
+
+	var network rdapNetwork
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRDAPResponseBytes)).Decode(&network); err != nil {
+		return nil, err
+	}
+	if network.ObjectClassName != "ip network" {
+		return nil, fmt.Errorf("rdap server returned a %q object rather than an ip network", network.ObjectClassName)
+	}
+	info := network.info()
+	info.Source = resp.Request.URL.String()
+	c.cache.Set(ip, info)
+	return info, nil
+}
+
+// The parts of an RDAP ip network object (RFC 9083 section 5.4) which are reported.
+type rdapNetwork struct {
+	ObjectClassName string       `json:"objectClassName"`
+	Handle          string       `json:"handle"`
+	Name            string       `json:"name"`
+	Country         string       `json:"country"`
+	StartAddress    string       `json:"startAddress"`
+	EndAddress      string       `json:"endAddress"`
+	Entities        []rdapEntity `json:"entities"`
+	// The CIDR form of the range, an extension (cidr0) most registries support
+	CIDRs []struct {
+		V4Prefix string `json:"v4prefix"`
+		V6Prefix string `json:"v6prefix"`
+		Length   int    `json:"length"`
+	} `json:"cidr0_cidrs"`
+}
+
+type rdapEntity struct {
+	Roles    []string        `json:"roles"`
+	VCard    json.RawMessage `json:"vcardArray"`
+	Entities []rdapEntity    `json:"entities"`
+}
+
+func (n *rdapNetwork) info() *whoisInfo {
+	info := &whoisInfo{
+		Handle:   n.Handle,
+		Name:     n.Name,
+		Country:  n.Country,
+		NetRange: whoisNetRange{Start: n.StartAddress, End: n.EndAddress},
+	}
+	for _, c := range n.CIDRs {
+		prefix := c.V4Prefix + c.V6Prefix
+		if prefix != "" {
+			info.NetRange.CIDRs = append(info.NetRange.CIDRs, fmt.Sprintf("%s/%d", prefix, c.Length))
+		}
+	}
+	if e := findEntity(n.Entities, "registrant"); e != nil {
+		info.Org = parseVCard(e.VCard).Name
+	}
+	if e := findEntity(n.Entities, "abuse"); e != nil {
+		if abuse := parseVCard(e.VCard); abuse != (whoisContact{}) {
+			info.Abuse = &abuse
+		}
+	}
+	return info
+}
+
+// Finds the first entity with the role, searching breadth first since registries nest the
+// abuse contact below the registrant.
+func findEntity(entities []rdapEntity, role string) *rdapEntity {
+	for len(entities) > 0 {
+		var nested []rdapEntity
+		for i := range entities {
+			for _, r := range entities[i].Roles {
+				if r == role {
+					return &entities[i]
+				}
+			}
+			nested = append(nested, entities[i].Entities...)
+		}
+		entities = nested
+	}
+	return nil
+}
+
+// Takes the name, email and phone number from a jCard (RFC 7095), ["vcard", [[name, params,
+// type, value], ...]]. Malformed cards give an empty contact.
+func parseVCard(raw json.RawMessage) whoisContact {
+	var card []json.RawMessage
+	var properties [][]json.RawMessage
+	if json.Unmarshal(raw, &card) != nil || len(card) != 2 || json.Unmarshal(card[1], &properties) != nil {
+		return whoisContact{}
+	}
+	var contact whoisContact
+	for _, p := range properties {
+		if len(p) < 4 {
+			continue
+		}
+		var name, value string
+		if json.Unmarshal(p[0], &name) != nil || json.Unmarshal(p[3], &value) != nil {
+			continue
+		}
+		switch {
+		case name == "fn" && contact.Name == "":
+			contact.Name = value
+		case name == "email" && contact.Email == "":
+			contact.Email = value
+		case name == "tel" && contact.Phone == "":
+			contact.Phone = strings.TrimPrefix(value, "tel:")
+		}
+	}
+	return contact
+}
+
+// Looks up the client address, or the address of the ip query parameter for requests with an
+// API key. The client address is the one the connection or a trusted proxy vouches for, and
+// without a key the override isn't available, so the server can't be used to look up
+// arbitrary addresses anonymously.
+func (s *service) handleWhoisReq(w http.ResponseWriter, req *http.Request) {
+	ipStr := s.proxies.clientIP(req)
+	if override := req.URL.Query().Get("ip"); override != "" {
+		if APIKeyName(req) == "" {
+			s.writeError(w, req, http.StatusForbidden, "looking up other addresses requires an API key")
+			return
+		}
+		ipStr = override
+	}
+	ip, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		s.writeError(w, req, http.StatusBadRequest, "unable to determine client ip")
+		return
+	}
+	ip = ip.Unmap()
+	if ipType := classifyIP(ip.String()); ipType != "public" {
+		s.writeError(w, req, http.StatusUnprocessableEntity, "no registration data for "+ipType+" addresses")
+		return
+	}
+	info, err := s.rdap.Lookup(req.Context(), ip)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			slog.Error("failed to look up rdap registration", slog.String("ip", ip.String()), slog.Any("error", err))
+		}
+		s.writeError(w, req, http.StatusBadGateway, "registration data is currently unavailable")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		IP string `json:"ip"`
+		*whoisInfo
+	}{ip.String(), info})
+}
@@ -0,0 +1,154 @@
+package ippotato
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// An abridged answer of the RIPE NCC RDAP server.
+const testRDAPNetwork = `{
+	"objectClassName": "ip network",
+	"handle": "193.0.0.0 - 193.0.7.255",
+	"name": "RIPE-NCC",
+	"country": "NL",
+	"startAddress": "193.0.0.0",
+	"endAddress": "193.0.7.255",
+	"cidr0_cidrs": [{"v4prefix": "193.0.0.0", "length": 21}],
+	"entities": [
+		{
+			"roles": ["registrant"],
+			"vcardArray": ["vcard", [["version", {}, "text", "4.0"], ["fn", {}, "text", "RIPE Network Coordination Centre"], ["kind", {}, "text", "org"]]],
+			"entities": [
+				{
+					"roles": ["abuse"],
+					"vcardArray": ["vcard", [["fn", {}, "text", "Abuse-C Role"], ["email", {}, "text", "abuse@ripe.net"], ["tel", {"type": "voice"}, "uri", "tel:+31205354444"]]]
+				}
+			]
+		}
+	]
+}`
+
+func TestHandleWhois(t *testing.T) {
+	var lookups []string
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lookups = append(lookups, req.URL.Path)
+		w.Header().Set("Content-Type", "application/rdap+json")
+		_, _ = w.Write([]byte(testRDAPNetwork))
+	}))
+	defer registry.Close()
+	bootstrap := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, registry.URL+req.URL.Path, http.StatusFound)
+	}))
+	defer bootstrap.Close()
+
+	h := Handler(Options{
+		RDAPURL:      bootstrap.URL,
+		RDAPCacheTTL: time.Minute,
+		APIKeys:      []APIKey{{Name: "test", Key: "secret"}},
+	})
+	request := func(target, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "193.0.6.139:51234"
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request("/whois", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d without a key, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec := request("/whois", "Bearer secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var got struct {
+		IP string `json:"ip"`
+		whoisInfo
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := whoisInfo{
+		Handle:   "193.0.0.0 - 193.0.7.255",
+		Name:     "RIPE-NCC",
+		Country:  "NL",
+		NetRange: whoisNetRange{Start: "193.0.0.0", End: "193.0.7.255", CIDRs: []string{"193.0.0.0/21"}},
+		Org:      "RIPE Network Coordination Centre",
+		Abuse:    &whoisContact{Name: "Abuse-C Role", Email: "abuse@ripe.net", Phone: "+31205354444"},
+		Source:   registry.URL + "/ip/193.0.6.139",
+	}
+	if got.IP != "193.0.6.139" || !reflect.DeepEqual(got.whoisInfo, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Cached, so the registry isn't asked again
+	request("/whois", "Bearer secret")
+	if len(lookups) != 1 {
+		t.Errorf("got %d lookups, want the registration to be cached", len(lookups))
+	}
+
+	if rec := request("/whois?ip=192.168.1.1", "Bearer secret"); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d for a private address, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+	if rec := request("/whois?ip=2001:67c:2e8::1", "Bearer secret"); rec.Code != http.StatusOK {
+		t.Errorf("got status %d for another address, want %d", rec.Code, http.StatusOK)
+	}
+	if want := "/ip/2001:67c:2e8::1"; lookups[len(lookups)-1] != want {
+		t.Errorf("looked up %s, want %s", lookups[len(lookups)-1], want)
+	}
+
+	// Without keys configured the override isn't available at all
+	h = Handler(Options{RDAPURL: bootstrap.URL})
+	if rec := request("/whois?ip=2001:67c:2e8::1", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d for an override without a key, want %d", rec.Code, http.StatusForbidden)
+	}
+	// Nor can another address be claimed in X-Forwarded-For
+	req := httptest.NewRequest(http.MethodGet, "/whois", nil)
+	req.RemoteAddr = "193.0.6.139:51234"
+	req.Header.Set("X-Forwarded-For", "2a00:1450::1")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if want := "/ip/193.0.6.139"; rec.Code != http.StatusOK || lookups[len(lookups)-1] != want {
+		t.Errorf("got status %d and looked up %s, want %s of the connection", rec.Code, lookups[len(lookups)-1], want)
+	}
+}
+
+// The host of the bootstrap service, like every registry it refers to, is resolved with the
+// resolver of the options.
+func TestRDAPResolver(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(testRDAPNetwork))
+	}))
+	defer registry.Close()
+	_, port, err := net.SplitHostPort(registry.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := fakeResolver{hosts: map[string][]string{"rdap.test": {"127.0.0.1"}}}
+	client := newRDAPClient("http://rdap.test:"+port, resolver, time.Second, 0)
+	// Proxies from the environment would resolve the host themselves
+	client.httpClient.Transport.(*http.Transport).Proxy = nil
+	info, err := client.Lookup(context.Background(), netip.MustParseAddr("193.0.6.139"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "RIPE-NCC" {
+		t.Errorf("got %+v, want the registration served by the registry", info)
+	}
+
+	client = newRDAPClient("http://unknown.test:"+port, resolver, time.Second, 0)
+	client.httpClient.Transport.(*http.Transport).Proxy = nil
+	if _, err := client.Lookup(context.Background(), netip.MustParseAddr("193.0.6.139")); err == nil {
+		t.Error("looked up a registration on a host the resolver doesn't know")
+	}
+}
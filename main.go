@@ -2,73 +2,327 @@ package main
 
 import (
 	"context"
-	"embed"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"flag"
-	"html/template"
-	"io/fs"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"syscall"
 	"time"
-)
-
-//go:embed templates/*.html
-var htmlTemplates embed.FS
-var templ *template.Template
 
-//go:embed static/*
-var staticFS embed.FS
+	"github.com/jault3/ip-potato/ippotato"
+)
 
 func main() {
-	listenAddr := flag.String("listen", "localhost:8080", "Listen address for the http server")
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		os.Exit(runClient(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ddns" {
+		os.Exit(runDDNS(os.Args[2:]))
+	}
+
+	var cfg config
+	cfg.registerFlags(flag.CommandLine)
 	flag.Parse()
 
-	var err error
-	templ, err = template.ParseFS(htmlTemplates, "templates/*.html")
+	summary := startupSummary{
+		Listeners: map[string]string{},
+		Features:  []string{},
+		Datasets:  []ippotato.DatasetInfo{},
+		Build:     readBuildInfo(),
+	}
+
+	opts, err := cfg.options()
 	if err != nil {
 		panic(err)
 	}
+	if opts.BGPAPI != "" {
+		summary.Features = append(summary.Features, "bgp")
+	}
+	if opts.RDAPURL != "" {
+		summary.Features = append(summary.Features, "whois")
+	}
+
+	if opts.Resolver, err = ippotato.NewResolver(cfg.resolver, cfg.resolverCacheTTL); err != nil {
+		panic(err)
+	}
+	if cfg.resolver != "system" {
+		summary.Features = append(summary.Features, "custom-resolver")
+	}
+	if opts.ReverseDNS {
+		summary.Features = append(summary.Features, "rdns")
+	}
+	if len(opts.DNSBLZones) > 0 {
+		summary.Features = append(summary.Features, "dnsbl")
+	}
+	if opts.SpeedMaxBytes > 0 {
+		summary.Features = append(summary.Features, "speed-test")
+	}
+	if opts.IPv4URL != "" && opts.IPv6URL != "" {
+		summary.Features = append(summary.Features, "dual-stack")
+	}
+	if cfg.uniqueClientStats {
+		opts.ClientStats = ippotato.NewClientStats()
+		summary.Features = append(summary.Features, "unique-client-stats")
+	}
+	if opts.MicroCacheTTL > 0 {
+		summary.Features = append(summary.Features, "micro-cache")
+	}
+	if cfg.accessLog {
+		summary.Features = append(summary.Features, "access-log")
+	}
 
-	server := NewServer(*listenAddr)
+	if cfg.tlsCert != "" {
+		if opts.TLSConfig, err = ippotato.NewTLSConfig(cfg.tlsCert, cfg.tlsKey, cfg.clientAuth, cfg.clientCA); err != nil {
+			panic(err)
+		}
+		summary.Features = append(summary.Features, "tls")
+		if opts.TLSConfig.ClientAuth != tls.NoClientCert {
+			summary.Features = append(summary.Features, "client-certificates")
+		}
+	}
+	verifier := ippotato.DatasetVerifier{RequireChecksum: cfg.datasetRequireChecksum}
+	if cfg.datasetPublicKey != "" {
+		if verifier.PublicKey, err = ippotato.ParseDatasetPublicKey(cfg.datasetPublicKey); err != nil {
+			panic(err)
+		}
+	}
+	if cfg.asnDBPath != "" {
+		if opts.ASNDB, err = verifier.LoadASNDB(cfg.asnDBPath); err != nil {
+			panic(err)
+		}
+		summary.Features = append(summary.Features, "asn")
+		summary.Datasets = append(summary.Datasets, opts.ASNDB.Info())
+	}
+	if opts.ParseUserAgent {
+		summary.Features = append(summary.Features, "user-agent-parsing")
+	}
+	if cfg.proxyProtocol {
+		summary.Features = append(summary.Features, "proxy-protocol")
+	}
+	if opts.TrustedProxies, err = ippotato.ParseTrustedProxies(cfg.trustedProxies); err != nil {
+		panic(err)
+	}
+	if cfg.templatesDir != "" {
+		if opts.Templates, err = ippotato.LoadTemplates(cfg.templatesDir); err != nil {
+			panic(err)
+		}
+		summary.Features = append(summary.Features, "custom-templates")
+	}
+	if cfg.staticDir != "" {
+		summary.Features = append(summary.Features, "custom-static")
+	}
+	if cfg.signingKey != "" {
+		if opts.SigningKey, err = ippotato.LoadSigningKey(cfg.signingKey); err != nil {
+			panic(err)
+		}
+		summary.Features = append(summary.Features, "signed-responses")
+	}
+	if opts.APIKeys, err = ippotato.ParseAPIKeys(cfg.apiKeys); err != nil {
+		panic(err)
+	}
+	if cfg.apiKeysFile != "" {
+		keys, err := ippotato.LoadAPIKeys(cfg.apiKeysFile)
+		if err != nil {
+			panic(err)
+		}
+		opts.APIKeys = append(opts.APIKeys, keys...)
+	}
+	if err := ippotato.CheckAPIKeys(opts.APIKeys); err != nil {
+		panic(err)
+	}
+	if cfg.usersFile != "" {
+		if cfg.apiKeysFile == "" {
+			panic(errors.New("-users-file needs -api-keys-file, which assigns the keys to their users"))
+		}
+		if opts.Users, err = ippotato.LoadUsers(cfg.usersFile); err != nil {
+			panic(err)
+		}
+	}
+	if cfg.portCheckPorts != "" {
+		if opts.PortCheckPorts, err = ippotato.ParsePortRanges(cfg.portCheckPorts); err != nil {
+			panic(err)
+		}
+		if len(opts.APIKeys) == 0 {
+			panic(errors.New("-portcheck-ports needs -api-keys or -api-keys-file, port checks are never served anonymously"))
+		}
+		summary.Features = append(summary.Features, "portcheck")
+	}
+	if len(opts.APIKeys) > 0 {
+		summary.Features = append(summary.Features, "api-keys")
+	}
+	if cfg.historyDB != "" {
+		if len(opts.APIKeys) == 0 {
+			panic(errors.New("-history-db needs -api-keys or -api-keys-file, only requests with a configured key are recorded"))
+		}
+		if opts.History, err = ippotato.OpenHistoryStore(cfg.historyDB, cfg.historyRetention, cfg.historyMaxIPs); err != nil {
+			panic(err)
+		}
+		defer opts.History.Close()
+		summary.Features = append(summary.Features, "history")
+	}
+
+	server := NewServer(cfg.listenAddr, opts)
+	ln, err := Listen(server, cfg.proxyProtocol)
+	if err != nil {
+		panic(err)
+	}
+	summary.Listeners["http"] = ln.Addr().String()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Kill, os.Interrupt)
 	defer cancel()
 
-	if err := ListenAndServe(ctx, server); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	if cfg.adminListenAddr != "" {
+		adminServer := NewAdminServer(cfg.adminListenAddr, opts.ClientStats)
+		adminLn, err := Listen(adminServer, false)
+		if err != nil {
+			panic(err)
+		}
+		summary.Listeners["admin"] = adminLn.Addr().String()
+		go func() {
+			if err := Serve(ctx, adminServer, adminLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Admin HTTP server did not shut down gracefully", slog.Any("error", err))
+			}
+		}()
+	}
+	if cfg.debugListenAddr != "" {
+		debugServer := NewDebugServer(cfg.debugListenAddr)
+		debugLn, err := Listen(debugServer, false)
+		if err != nil {
+			panic(err)
+		}
+		summary.Listeners["debug"] = debugLn.Addr().String()
+		go func() {
+			if err := Serve(ctx, debugServer, debugLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Debug HTTP server did not shut down gracefully", slog.Any("error", err))
+			}
+		}()
+	}
+	if cfg.dnsListenAddr != "" {
+		dns, err := ippotato.ListenDNS(cfg.dnsListenAddr, cfg.dnsZone, cfg.dnsTTL, cfg.dnsRate, cfg.dnsBurst)
+		if err != nil {
+			panic(err)
+		}
+		summary.Listeners["dns"] = dns.Addr()
+		go dns.Serve(ctx)
+	}
+	if cfg.stunListenAddr != "" {
+		stun, err := ippotato.ListenSTUN(cfg.stunListenAddr, cfg.stunRate, cfg.stunBurst)
+		if err != nil {
+			panic(err)
+		}
+		summary.Listeners["stun"] = stun.Addr()
+		go stun.Serve(ctx)
+	}
+	if cfg.tcpListenAddr != "" {
+		tcp, err := ippotato.ListenTCP(cfg.tcpListenAddr)
+		if err != nil {
+			panic(err)
+		}
+		summary.Listeners["tcp"] = tcp.Addr()
+		go tcp.Serve(ctx)
+	}
+	if cfg.udpListenAddr != "" {
+		udp, err := ippotato.ListenUDP(cfg.udpListenAddr, cfg.udpRate, cfg.udpBurst)
+		if err != nil {
+			panic(err)
+		}
+		summary.Listeners["udp"] = udp.Addr()
+		go udp.Serve(ctx)
+	}
+	if opts.History != nil {
+		go opts.History.PruneEvery(ctx, time.Hour)
+	}
+	if opts.Templates != nil {
+		go reloadOnHangup(ctx, "templates", opts.Templates.Reload)
+	}
+	if cfg.pushGateway != "" {
+		if cfg.pushInstance == "" {
+			cfg.pushInstance, _ = os.Hostname()
+		}
+		summary.Features = append(summary.Features, "pushgateway")
+		go ippotato.PushMetrics(ctx, cfg.pushGateway, cfg.pushJob, cfg.pushInstance, cfg.pushInterval, opts.ClientStats)
+	}
+
+	summary.log()
+	if cfg.readyFile != "" {
+		if err := summary.writeFile(cfg.readyFile); err != nil {
+			slog.Error("failed to write readiness file", slog.String("path", cfg.readyFile), slog.Any("error", err))
+		}
+	}
+	if cfg.readyFD >= 0 {
+		if err := summary.writeFD(cfg.readyFD); err != nil {
+			slog.Error("failed to write readiness file descriptor", slog.Int("fd", cfg.readyFD), slog.Any("error", err))
+		}
+	}
+
+	if err := Serve(ctx, server, ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		slog.Error("HTTP server did not shut down gracefully", slog.Any("error", err))
 		panic(err)
 	}
 }
 
-func NewServer(listenAddr string) *http.Server {
-	subFS, err := fs.Sub(staticFS, "static")
-	if err != nil {
-		panic(err)
+// Builds the public http server. The handler needs to know the TLS configuration of the
+// server, so opts.TLSConfig is used for both.
+func NewServer(listenAddr string, opts ippotato.Options) *http.Server {
+	return &http.Server{
+		Addr:        listenAddr,
+		Handler:     ippotato.Handler(opts),
+		TLSConfig:   opts.TLSConfig,
+		ConnContext: ippotato.ConnContext,
 	}
+}
 
-	mux := http.NewServeMux()
-	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServerFS(subFS)))
-	mux.HandleFunc("GET /", handler())
+// The admin server exposes operational endpoints and should not be reachable publicly.
+func NewAdminServer(listenAddr string, stats *ippotato.ClientStats) *http.Server {
+	return &http.Server{
+		Addr:    listenAddr,
+		Handler: ippotato.AdminHandler(stats),
+	}
+}
 
+// The debug server exposes profiles of the process. Addresses without a host, such as :6060,
+// bind to localhost rather than every interface, so it is only public when asked for.
+func NewDebugServer(listenAddr string) *http.Server {
+	if host, port, err := net.SplitHostPort(listenAddr); err == nil && host == "" {
+		listenAddr = net.JoinHostPort("localhost", port)
+	}
 	return &http.Server{
 		Addr:    listenAddr,
-		Handler: mux,
+		Handler: debugHandler(),
 	}
 }
 
-// Runs the http server until the given context expires. Once expired, a graceful shutdown
-// will be triggered with a timeout. This function always returns a non-nil error. After
-// a successful graceful shutdown, the error will be http.ErrServerClosed.
-func ListenAndServe(ctx context.Context, server *http.Server) error {
+// Binds the listen address of the server. With proxyProtocol, every connection must start
+// with a PROXY protocol header identifying the client. For TLS servers the ClientHello of
+// every connection is captured to fingerprint clients.
+func Listen(server *http.Server, proxyProtocol bool) (net.Listener, error) {
+	lc := ippotato.ListenConfig()
+	ln, err := lc.Listen(context.Background(), "tcp", server.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return ippotato.NewListener(ln, proxyProtocol, server.TLSConfig != nil), nil
+}
+
+// Runs the http server on the listener until the given context expires, serving TLS if the
+// server has a TLS configuration. Once expired, a graceful shutdown will be triggered with a
+// timeout. This function always returns a non-nil error. After a successful graceful
+// shutdown, the error will be http.ErrServerClosed.
+func Serve(ctx context.Context, server *http.Server, ln net.Listener) error {
 	serverErr := make(chan error, 1)
 	go func() {
-		slog.Info("Server successfully started", slog.String("addr", server.Addr))
-		serverErr <- server.ListenAndServe()
+		if server.TLSConfig != nil {
+			serverErr <- server.ServeTLS(ln, "", "")
+		} else {
+			serverErr <- server.Serve(ln)
+		}
 	}()
 	var err error
 	select {
@@ -83,60 +337,21 @@ func ListenAndServe(ctx context.Context, server *http.Server) error {
 	return err
 }
 
-func handler() http.HandlerFunc {
-	acceptedMediaTypes := map[string]http.HandlerFunc{
-		"text/html":        handleHTTPReq,
-		"application/json": handleJSONReq,
-	}
-	return func(w http.ResponseWriter, req *http.Request) {
-		accept := req.Header.Get("Accept")
-		requestedMediaTypes := strings.Split(strings.Split(accept, ";")[0], ",")
-		for _, mediaType := range requestedMediaTypes {
-			if mediaTypeHandler, isMapped := acceptedMediaTypes[strings.TrimSpace(mediaType)]; isMapped {
-				mediaTypeHandler(w, req)
-				return
+// Calls reload whenever the process receives SIGHUP, until the context expires.
+func reloadOnHangup(ctx context.Context, name string, reload func() error) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			if err := reload(); err != nil {
+				slog.Error("failed to reload "+name+", keeping the previous ones", slog.Any("error", err))
+				continue
 			}
+			slog.Info("reloaded " + name)
 		}
-		handleTextReq(w, req)
-	}
-}
-
-func handleHTTPReq(w http.ResponseWriter, req *http.Request) {
-	err := templ.ExecuteTemplate(w, "index.html", map[string]string{
-		"ip": realIP(req),
-	})
-	if err != nil {
-		slog.Error("failed to render html template", slog.Any("error", err))
-	}
-}
-
-func handleJSONReq(w http.ResponseWriter, req *http.Request) {
-	_ = json.NewEncoder(w).Encode(map[string]string{
-		"ip": realIP(req),
-	})
-}
-
-func handleTextReq(w http.ResponseWriter, req *http.Request) {
-	w.Write([]byte(realIP(req) + "\n"))
-}
-
-// https://github.com/go-chi/chi/blob/master/middleware/realip.go
-func realIP(r *http.Request) string {
-	var ip string
-
-	if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
-		ip = xrip
-	} else if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		i := strings.Index(xff, ",")
-		if i == -1 {
-			i = len(xff)
-		}
-		ip = xff[:i]
-	} else {
-		ip = strings.Split(r.RemoteAddr, ":")[0]
-	}
-	if ip == "" || net.ParseIP(ip) == nil {
-		return ""
 	}
-	return ip
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Updates a record set through the Route53 API with an UPSERT, which creates it if it doesn't
+// exist yet. Requests are signed with AWS Signature Version 4, Route53 is a global service
+// signed for us-east-1.
+type route53Provider struct {
+	cfg    ddnsProviderConfig
+	client *http.Client
+}
+
+const route53API = "https://route53.amazonaws.com/2013-04-01"
+
+func (p *route53Provider) Name() string { return "route53:" + p.cfg.Name }
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type route53Change struct {
+	Action          string   `xml:"Action"`
+	Name            string   `xml:"ResourceRecordSet>Name"`
+	Type            string   `xml:"ResourceRecordSet>Type"`
+	TTL             int      `xml:"ResourceRecordSet>TTL"`
+	ResourceRecords []string `xml:"ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+func (p *route53Provider) Update(ctx context.Context, ip net.IP) error {
+	ttl := p.cfg.TTL
+	if ttl == 0 {
+		ttl = 300
+	}
+	change := route53ChangeRequest{Changes: []route53Change{{
+		Action:          "UPSERT",
+		Name:            p.cfg.Name,
+		Type:            recordType(ip),
+		TTL:             ttl,
+		ResourceRecords: []string{ip.String()},
+	}}}
+	body, err := xml.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	zone := strings.TrimPrefix(p.cfg.HostedZoneID, "/hostedzone/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, route53API+"/hostedzone/"+url.PathEscape(zone)+"/rrset", bytes.NewReader(append([]byte(xml.Header), body...)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	if p.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.cfg.SessionToken)
+	}
+	if err := signV4(req, p.cfg.AccessKeyID, p.cfg.SecretAccessKey, "us-east-1", "route53", time.Now()); err != nil {
+		return err
+	}
+	return doRequest(p.client, req, nil)
+}
+
+// Signs the request with AWS Signature Version 4, covering the body and every header set so
+// far.
+//
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_sigv-create-signed-request.html
+func signV4(req *http.Request, accessKeyID, secretAccessKey, region, service string, now time.Time) error {
+	var body []byte
+	if req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(r); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+	return nil
+}
+
+func hexSHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The examples of the AWS documentation and of the aws-sig-v4-test-suite, with the
+// credentials they are published with.
+func TestSignV4(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		url      string
+		headers  map[string]string
+		service  string
+		expected string
+	}{
+		{
+			name:     "get-vanilla",
+			url:      "https://example.amazonaws.com/",
+			service:  "service",
+			expected: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:     "iam-list-users",
+			url:      "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08",
+			headers:  map[string]string{"Content-Type": "application/x-www-form-urlencoded; charset=utf-8"},
+			service:  "iam",
+			expected: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			if err := signV4(req, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", tt.service, now); err != nil {
+				t.Fatal(err)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date is %q", got)
+			}
+			if got := req.Header.Get("Authorization"); got != tt.expected {
+				t.Errorf("Authorization is\n%s\nwant\n%s", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSignV4CoversTheBody(t *testing.T) {
+	sign := func(body string) string {
+		req, err := http.NewRequest(http.MethodPost, route53API+"/hostedzone/Z1/rrset", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := signV4(req, "AKIDEXAMPLE", "secret", "us-east-1", "route53", time.Unix(0, 0)); err != nil {
+			t.Fatal(err)
+		}
+		return req.Header.Get("Authorization")
+	}
+	if sign("<a/>") == sign("<b/>") {
+		t.Error("requests with different bodies have the same signature")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestRoute53Update(t *testing.T) {
+	var sent *http.Request
+	var body []byte
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent = req
+		body, _ = io.ReadAll(req.Body)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("<ChangeResourceRecordSetsResponse/>")), Header: http.Header{}}, nil
+	})}
+	p := &route53Provider{client: client, cfg: ddnsProviderConfig{
+		Name:            "home.example.com",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+		HostedZoneID:    "/hostedzone/Z1",
+	}}
+	if err := p.Update(context.Background(), net.ParseIP("2001:db8::1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := sent.URL.String(), route53API+"/hostedzone/Z1/rrset"; got != want {
+		t.Errorf("sent to %s, want %s", got, want)
+	}
+	auth := sent.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/us-east-1/route53/aws4_request") {
+		t.Errorf("unexpected Authorization %q", auth)
+	}
+	if !strings.Contains(auth, "x-amz-security-token") || sent.Header.Get("X-Amz-Security-Token") != "token" {
+		t.Errorf("the session token isn't sent and signed: %q", auth)
+	}
+	var change route53ChangeRequest
+	if err := xml.Unmarshal(body, &change); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+	if len(change.Changes) != 1 {
+		t.Fatalf("expected one change, got %+v", change)
+	}
+	c := change.Changes[0]
+	if c.Action != "UPSERT" || c.Name != "home.example.com" || c.Type != "AAAA" || c.TTL != 300 || len(c.ResourceRecords) != 1 || c.ResourceRecords[0] != "2001:db8::1" {
+		t.Errorf("unexpected change %+v", c)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+
+	"github.com/jault3/ip-potato/ippotato"
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// Everything a supervisor or operator wants to know once the service is ready to handle
+// requests. It is logged once at startup and optionally written out as JSON.
+type startupSummary struct {
+	Listeners map[string]string      `json:"listeners"`
+	Features  []string               `json:"features"`
+	Datasets  []ippotato.DatasetInfo `json:"datasets"`
+	Build     buildInfo              `json:"build"`
+}
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{Version: "unknown"}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Version = bi.Main.Version
+	info.GoVersion = bi.GoVersion
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.Time = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+func (s startupSummary) log() {
+	names := make([]string, 0, len(s.Listeners))
+	for name := range s.Listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	listeners := make([]any, 0, len(names))
+	for _, name := range names {
+		listeners = append(listeners, slog.String(name, s.Listeners[name]))
+	}
+	datasets := make([]any, 0, len(s.Datasets))
+	for _, d := range s.Datasets {
+		datasets = append(datasets, slog.Group(d.Name,
+			slog.String("path", d.Path),
+			slog.Time("modified", d.Modified),
+			slog.Int("entries", d.Entries),
+			slog.String("sha256", d.SHA256),
+			slog.Bool("verified", d.Verified),
+			slog.Bool("last_known_good", d.LastKnownGood),
+		))
+	}
+	slog.Info("Server successfully started",
+		slog.Group("listeners", listeners...),
+		slog.Any("features", s.Features),
+		slog.Group("datasets", datasets...),
+		slog.Group("build",
+			slog.String("version", s.Build.Version),
+			slog.String("go_version", s.Build.GoVersion),
+			slog.String("revision", s.Build.Revision),
+			slog.Bool("modified", s.Build.Modified),
+		),
+	)
+}
+
+// Writes the summary to the file atomically, so supervisors polling for it never observe a
+// partially written file.
+func (s startupSummary) writeFile(path string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Writes the summary as a single line to an inherited file descriptor and closes it. The
+// trailing newline doubles as a readiness notification for supervisors like s6.
+func (s startupSummary) writeFD(fd int) error {
+	f := os.NewFile(uintptr(fd), "ready-fd-"+strconv.Itoa(fd))
+	defer f.Close()
+	return json.NewEncoder(f).Encode(s)
+}
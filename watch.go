@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Checks the public address at an interval for the -watch mode of the client subcommand,
+// printing it and notifying the webhook, if any, whenever it changes.
+type watcher struct {
+	client  *client
+	server  string
+	json    bool
+	out     io.Writer
+	webhook *webhook
+
+	// The address last printed, and when it was first seen.
+	current   string
+	changedAt time.Time
+	// The address the webhook last acknowledged, or the first one observed. It only advances
+	// once a delivery succeeds, so a change whose notification failed is sent again by the
+	// next check.
+	delivered string
+}
+
+// The event printed in JSON format and sent to webhooks. Old is empty for the first address
+// observed, which is printed but not sent.
+type addressChange struct {
+	Old       string    `json:"old_ip"`
+	New       string    `json:"new_ip"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (w *watcher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := w.check(ctx); err != nil {
+			slog.Error("failed to check the public address", slog.Any("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *watcher) check(ctx context.Context) error {
+	body, err := w.client.get(w.server, "text/plain")
+	if err != nil {
+		return err
+	}
+	ip := strings.TrimSpace(string(body))
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("%s answered %q, not an address", w.server, body)
+	}
+	if ip != w.current {
+		w.changedAt = time.Now().UTC()
+		change := addressChange{Old: w.current, New: ip, Timestamp: w.changedAt}
+		w.current = ip
+		if w.json {
+			_ = json.NewEncoder(w.out).Encode(change)
+		} else {
+			fmt.Fprintln(w.out, ip)
+		}
+	}
+	if w.webhook == nil || ip == w.delivered {
+		return nil
+	}
+	if w.delivered == "" {
+		w.delivered = ip
+		return nil
+	}
+	change := addressChange{Old: w.delivered, New: ip, Timestamp: w.changedAt}
+	if err := w.webhook.notify(ctx, change); err != nil {
+		return fmt.Errorf("notifying the webhook of the change from %s to %s: %w", change.Old, change.New, err)
+	}
+	w.delivered = ip
+	return nil
+}
+
+// Delivers address changes with a JSON POST. With a secret, the X-IP-Potato-Signature header
+// holds "sha256=" and the hex encoded HMAC-SHA256 of the body, which includes the timestamp
+// so receivers can reject replays.
+type webhook struct {
+	url     string
+	secret  []byte
+	http    *http.Client
+	retries int
+	// Delay before the first retry, doubled for every following one.
+	backoff time.Duration
+}
+
+func (h *webhook) notify(ctx context.Context, change addressChange) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	delay := h.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := h.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt > h.retries {
+			return err
+		}
+		slog.Warn("webhook delivery failed, retrying", slog.Duration("backoff", delay), slog.Any("error", err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// Reports whether a failed delivery is worth retrying.
+func (h *webhook) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ip-potato-client/"+readBuildInfo().Version)
+	if len(h.secret) > 0 {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set("X-IP-Potato-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return retryableStatus(resp.StatusCode), fmt.Errorf("%s: %s", endpoint(req.URL), resp.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatcherRedeliversFailedChanges(t *testing.T) {
+	addresses := []string{"192.0.2.1", "192.0.2.2", "192.0.2.2", "192.0.2.3"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, addresses[0]+"\n")
+		addresses = addresses[1:]
+	}))
+	defer server.Close()
+
+	var received []addressChange
+	failing := true
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			failing = false
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var change addressChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			t.Errorf("decoding the webhook payload: %v", err)
+		}
+		received = append(received, change)
+	}))
+	defer hook.Close()
+
+	var out strings.Builder
+	w := &watcher{
+		client:  &client{http: server.Client()},
+		server:  server.URL,
+		out:     &out,
+		webhook: &webhook{url: hook.URL, http: hook.Client()},
+	}
+	ctx := context.Background()
+	if err := w.check(ctx); err != nil {
+		t.Fatalf("first check: %v", err)
+	}
+	if err := w.check(ctx); err == nil {
+		t.Fatal("expected the failed delivery to be reported")
+	}
+	if err := w.check(ctx); err != nil {
+		t.Fatalf("expected the pending change to be delivered, got %v", err)
+	}
+	if err := w.check(ctx); err != nil {
+		t.Fatalf("last check: %v", err)
+	}
+
+	if got, want := out.String(), "192.0.2.1\n192.0.2.2\n192.0.2.3\n"; got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+	want := [][2]string{{"192.0.2.1", "192.0.2.2"}, {"192.0.2.2", "192.0.2.3"}}
+	if len(received) != len(want) {
+		t.Fatalf("webhook received %+v, want %v", received, want)
+	}
+	for i, change := range received {
+		if change.Old != want[i][0] || change.New != want[i][1] {
+			t.Errorf("change %d is %s -> %s, want %s -> %s", i, change.Old, change.New, want[i][0], want[i][1])
+		}
+		if change.Timestamp.IsZero() || time.Since(change.Timestamp) > time.Minute {
+			t.Errorf("change %d has timestamp %v", i, change.Timestamp)
+		}
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	secret := []byte("webhook secret")
+	var body []byte
+	var signature string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get("X-IP-Potato-Signature")
+	}))
+	defer hook.Close()
+
+	change := addressChange{Old: "192.0.2.1", New: "2001:db8::1", Timestamp: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	h := &webhook{url: hook.URL, secret: secret, http: hook.Client()}
+	if err := h.notify(context.Background(), change); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(body), `{"old_ip":"192.0.2.1","new_ip":"2001:db8::1","timestamp":"2024-05-01T12:00:00Z"}`; got != want {
+		t.Errorf("sent %s, want %s", got, want)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+		t.Errorf("signature is %q, want %q", signature, want)
+	}
+
+	h.secret = nil
+	if err := h.notify(context.Background(), change); err != nil {
+		t.Fatal(err)
+	}
+	if signature != "" {
+		t.Errorf("unexpected signature %q without a secret", signature)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		status   int
+		attempts int
+	}{
+		{status: http.StatusServiceUnavailable, attempts: 3},
+		{status: http.StatusTooManyRequests, attempts: 3},
+		{status: http.StatusNotFound, attempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			attempts := 0
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				w.WriteHeader(tt.status)
+			}))
+			defer hook.Close()
+
+			h := &webhook{url: hook.URL, http: hook.Client(), retries: 2, backoff: time.Millisecond}
+			if err := h.notify(context.Background(), addressChange{}); err == nil {
+				t.Fatal("expected an error")
+			}
+			if attempts != tt.attempts {
+				t.Errorf("made %d attempts, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}